@@ -0,0 +1,67 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	"sigs.k8s.io/yaml"
+)
+
+// loadConfigFile sets the flags of fs from the YAML file at path, which maps
+// flag names to values, or to lists of values for flags that can be specified
+// multiple times. Flags set on the command line take precedence over the file.
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var settings map[string]interface{}
+	if err := yaml.Unmarshal(buf, &settings); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+
+	for name, value := range settings {
+		if fs.Lookup(name) == nil {
+			return fmt.Errorf("unknown setting %q in %s", name, path)
+		}
+		if explicit[name] {
+			continue
+		}
+
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			str := fmt.Sprint(v)
+			if number, ok := v.(float64); ok {
+				// Avoid exponents for large numbers
+				str = strconv.FormatFloat(number, 'f', -1, 64)
+			}
+			if err := fs.Set(name, str); err != nil {
+				return fmt.Errorf("invalid setting %q in %s: %v", name, path, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfigFile writes content to a config file removed when the test ends
+func writeConfigFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigFilePrecedence(t *testing.T) {
+	os.Setenv("EXTERNAL_MDNS_TEST_TTL", "90")
+	os.Setenv("EXTERNAL_MDNS_TEST_DOMAIN", "env.example")
+	defer os.Unsetenv("EXTERNAL_MDNS_TEST_TTL")
+	defer os.Unsetenv("EXTERNAL_MDNS_TEST_DOMAIN")
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	namespace := fs.String("namespace", "", "")
+	ttl := fs.Int("record-ttl", lookupEnvOrInt("EXTERNAL_MDNS_TEST_TTL", 120), "")
+	domain := fs.String("domain", lookupEnvOrString("EXTERNAL_MDNS_TEST_DOMAIN", "local"), "")
+	limit := fs.Int("max-total-records", 0, "")
+	var sources k8sSource
+	fs.Var(&sources, "source", "")
+	if err := fs.Parse([]string{"-namespace=cli"}); err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeConfigFile(t, `
+namespace: file
+record-ttl: 60
+max-total-records: 10000000
+source:
+  - service
+  - ingress
+`)
+	if err := loadConfigFile(fs, path); err != nil {
+		t.Fatal(err)
+	}
+
+	// The command line takes precedence over the file, which takes
+	// precedence over the environment
+	if *namespace != "cli" {
+		t.Errorf("namespace = %q, want the command line value", *namespace)
+	}
+	if *ttl != 60 {
+		t.Errorf("record-ttl = %d, want the file value", *ttl)
+	}
+	if *domain != "env.example" {
+		t.Errorf("domain = %q, want the environment value", *domain)
+	}
+	if *limit != 10000000 {
+		t.Errorf("max-total-records = %d, want the file value", *limit)
+	}
+	if want := (k8sSource{"service", "ingress"}); !reflect.DeepEqual(sources, want) {
+		t.Errorf("source = %v, want %v", sources, want)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{name: "unknown setting", content: "record-tll: 60", want: `unknown setting "record-tll"`},
+		{name: "invalid value", content: "record-ttl: soon", want: `invalid setting "record-ttl"`},
+		{name: "invalid YAML", content: "record-ttl: [60", want: "failed to parse"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.Int("record-ttl", 120, "")
+			err := loadConfigFile(fs, writeConfigFile(t, tt.content))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("loadConfigFile() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestEphemeralMode(t *testing.T) {
+	oldDebounce, oldGrace := debounce, deleteGrace
+	t.Cleanup(func() { debounce, deleteGrace = oldDebounce, oldGrace })
+
+	tests := []struct {
+		name      string
+		args      []string
+		env       time.Duration // debounce set by the environment
+		wantDelay time.Duration
+		wantGrace time.Duration
+	}{
+		{name: "preset", wantDelay: 2 * time.Second, wantGrace: 30 * time.Second},
+		{name: "debounce disabled", args: []string{"-debounce=0"}, wantDelay: 0, wantGrace: 30 * time.Second},
+		{name: "delete grace set", args: []string{"-delete-grace=5s"}, wantDelay: 2 * time.Second, wantGrace: 5 * time.Second},
+		{name: "debounce from environment", env: time.Second, wantDelay: time.Second, wantGrace: 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			fs.DurationVar(&debounce, "debounce", tt.env, "")
+			fs.DurationVar(&deleteGrace, "delete-grace", 0, "")
+			if err := fs.Parse(tt.args); err != nil {
+				t.Fatal(err)
+			}
+
+			applyEphemeralMode(fs)
+			if debounce != tt.wantDelay || deleteGrace != tt.wantGrace {
+				t.Errorf("debounce %s, delete grace %s, want %s and %s", debounce, deleteGrace, tt.wantDelay, tt.wantGrace)
+			}
+		})
+	}
+}
+
+func TestInterfaceListSet(t *testing.T) {
+	fakeInterfaces := map[string]*net.Interface{
+		"eth0":    {Index: 2, Name: "eth0", Flags: net.FlagUp | net.FlagMulticast},
+		"eth0.20": {Index: 3, Name: "eth0.20", Flags: net.FlagUp | net.FlagMulticast},
+		"wg0":     {Index: 4, Name: "wg0", Flags: net.FlagUp | net.FlagPointToPoint},
+	}
+	oldInterfaceByName := interfaceByName
+	interfaceByName = func(name string) (*net.Interface, error) {
+		if iface, ok := fakeInterfaces[name]; ok {
+			return iface, nil
+		}
+		return nil, fmt.Errorf("no such network interface %s", name)
+	}
+	t.Cleanup(func() { interfaceByName = oldInterfaceByName })
+
+	var list interfaceList
+	for _, name := range []string{"eth0.20", "eth0"} {
+		if err := list.Set(name); err != nil {
+			t.Fatalf("Set(%q) = %v", name, err)
+		}
+	}
+	if len(list) != 2 || list[0] != fakeInterfaces["eth0.20"] || list[1] != fakeInterfaces["eth0"] {
+		t.Errorf("interfaces = %v, want [eth0.20 eth0]", list.String())
+	}
+
+	for _, name := range []string{"wg0", "eth1.30"} {
+		if err := list.Set(name); err == nil {
+			t.Errorf("Set(%q) succeeded, want an error", name)
+		}
+	}
+}
+
+func TestSourcesFromEnv(t *testing.T) {
+	os.Setenv("EXTERNAL_MDNS_TEST_SOURCE", "service, ingress,endpoints")
+	defer os.Unsetenv("EXTERNAL_MDNS_TEST_SOURCE")
+
+	var sources k8sSource
+	lookupEnvOrList("EXTERNAL_MDNS_TEST_SOURCE", &sources)
+	if want := (k8sSource{"service", "ingress", "endpoints"}); !reflect.DeepEqual(sources, want) {
+		t.Errorf("sources = %v, want %v", sources, want)
+	}
+
+	// Unset variables leave the list alone
+	lookupEnvOrList("EXTERNAL_MDNS_TEST_UNSET", &sources)
+	if len(sources) != 3 {
+		t.Errorf("sources = %v after an unset variable, want them unchanged", sources)
+	}
+
+	for _, value := range []string{"pods", ""} {
+		if err := sources.Set(value); err == nil {
+			t.Errorf("Set(%q) succeeded, want an error", value)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/blake/external-mdns/resource"
+	"github.com/miekg/dns"
+)
+
+type avahiServiceGroup struct {
+	XMLName xml.Name     `xml:"service-group"`
+	Name    string       `xml:"name"`
+	Service avahiService `xml:"service"`
+}
+
+type avahiService struct {
+	Type      string   `xml:"type"`
+	HostName  string   `xml:"host-name"`
+	Port      uint16   `xml:"port"`
+	TxtRecord []string `xml:"txt-record"`
+}
+
+type avahiInstance struct {
+	srv *dns.SRV
+	txt *dns.TXT
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// AvahiExporter maintains one Avahi .service file per DNS-SD service instance
+// in a directory watched by avahi-daemon (usually /etc/avahi/services).
+type AvahiExporter struct {
+	dir       string
+	instances map[string]*avahiInstance
+}
+
+// NewAvahiExporter creates an AvahiExporter writing to dir
+func NewAvahiExporter(dir string) *AvahiExporter {
+	return &AvahiExporter{
+		dir:       dir,
+		instances: make(map[string]*avahiInstance),
+	}
+}
+
+// Export updates the service files affected by the SRV and TXT records of
+// res. All other record types are ignored, Avahi publishes host records
+// itself.
+func (a *AvahiExporter) Export(res resource.Resource) error {
+	changed := map[string]bool{}
+	for _, rr := range res.Records {
+		name := rr.Header().Name
+		instance, ok := a.instances[name]
+		switch rr := rr.(type) {
+		case *dns.SRV:
+			if res.Action == resource.Deleted {
+				if ok {
+					instance.srv = nil
+				}
+			} else if ok {
+				instance.srv = rr
+			} else {
+				a.instances[name] = &avahiInstance{srv: rr}
+			}
+		case *dns.TXT:
+			if res.Action == resource.Deleted {
+				if ok {
+					instance.txt = nil
+				}
+			} else if ok {
+				instance.txt = rr
+			} else {
+				a.instances[name] = &avahiInstance{txt: rr}
+			}
+		default:
+			continue
+		}
+		// Keep the TXT record of an instance whose SRV record is replaced,
+		// and the other way round
+		if ok && instance.srv == nil && instance.txt == nil {
+			delete(a.instances, name)
+		}
+		changed[name] = true
+	}
+
+	for name := range changed {
+		if err := a.writeFile(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *AvahiExporter) writeFile(name string) error {
+	path := filepath.Join(a.dir, unsafeFileChars.ReplaceAllString(strings.TrimSuffix(name, "."), "_")+".service")
+
+	instance, ok := a.instances[name]
+	if !ok || instance.srv == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	labels := dns.SplitDomainName(name)
+	if len(labels) < 3 {
+		return nil
+	}
+	group := avahiServiceGroup{
+		Name: labels[0],
+		Service: avahiService{
+			Type:     labels[1] + "." + labels[2],
+			HostName: strings.TrimSuffix(instance.srv.Target, "."),
+			Port:     instance.srv.Port,
+		},
+	}
+	if instance.txt != nil {
+		for _, txt := range instance.txt.Txt {
+			if txt != "" {
+				group.Service.TxtRecord = append(group.Service.TxtRecord, txt)
+			}
+		}
+	}
+
+	buf, err := xml.MarshalIndent(group, "", "  ")
+	if err != nil {
+		return err
+	}
+	content := xml.Header + "<!DOCTYPE service-group SYSTEM \"avahi-service.dtd\">\n" + string(buf) + "\n"
+
+	return ioutil.WriteFile(path, []byte(content), 0644)
+}
@@ -0,0 +1,114 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/blake/external-mdns/resource"
+	"github.com/miekg/dns"
+)
+
+const (
+	webSRV  = "web._http._tcp.local. 120 IN SRV 0 0 80 web.default.local."
+	webTXT  = `web._http._tcp.local. 120 IN TXT "path=/" "version=2"`
+	webFile = "web._http._tcp.local.service"
+)
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func export(t *testing.T, a *AvahiExporter, action string, records ...string) {
+	t.Helper()
+	res := resource.Resource{Action: action}
+	for _, s := range records {
+		res.Records = append(res.Records, mustRR(t, s))
+	}
+	if err := a.Export(res); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readServiceFile(t *testing.T, dir string) string {
+	t.Helper()
+	buf, err := ioutil.ReadFile(filepath.Join(dir, webFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func TestAvahiExport(t *testing.T) {
+	dir := t.TempDir()
+	a := NewAvahiExporter(dir)
+
+	export(t, a, resource.Added, webSRV, webTXT)
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE service-group SYSTEM "avahi-service.dtd">
+<service-group>
+  <name>web</name>
+  <service>
+    <type>_http._tcp</type>
+    <host-name>web.default.local</host-name>
+    <port>80</port>
+    <txt-record>path=/</txt-record>
+    <txt-record>version=2</txt-record>
+  </service>
+</service-group>
+`
+	if got := readServiceFile(t, dir); got != want {
+		t.Errorf("service file =\n%s\nwant\n%s", got, want)
+	}
+
+	// A port change replaces only the SRV record, the TXT record is kept
+	export(t, a, resource.Deleted, webSRV)
+	if _, err := os.Stat(filepath.Join(dir, webFile)); !os.IsNotExist(err) {
+		t.Errorf("service file of instance without SRV record exists: %v", err)
+	}
+	export(t, a, resource.Added, "web._http._tcp.local. 120 IN SRV 0 0 8080 web.default.local.")
+	want = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE service-group SYSTEM "avahi-service.dtd">
+<service-group>
+  <name>web</name>
+  <service>
+    <type>_http._tcp</type>
+    <host-name>web.default.local</host-name>
+    <port>8080</port>
+    <txt-record>path=/</txt-record>
+    <txt-record>version=2</txt-record>
+  </service>
+</service-group>
+`
+	if got := readServiceFile(t, dir); got != want {
+		t.Errorf("service file =\n%s\nwant\n%s", got, want)
+	}
+
+	export(t, a, resource.Deleted, "web._http._tcp.local. 120 IN SRV 0 0 8080 web.default.local.", webTXT)
+	if _, err := os.Stat(filepath.Join(dir, webFile)); !os.IsNotExist(err) {
+		t.Errorf("service file of withdrawn instance exists: %v", err)
+	}
+	if len(a.instances) != 0 {
+		t.Errorf("withdrawn instance is still tracked: %v", a.instances)
+	}
+}
@@ -0,0 +1,27 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package export hands the computed records to other responders, such as a
+// host-level Avahi daemon or a sidecar, instead of (or in addition to)
+// answering mDNS queries directly.
+package export
+
+import (
+	"github.com/blake/external-mdns/resource"
+)
+
+// Exporter receives every change to the set of advertised records
+type Exporter interface {
+	Export(res resource.Resource) error
+}
@@ -0,0 +1,211 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/blake/external-mdns/resource"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/websocket"
+)
+
+// streamBuffer is the number of changes buffered per stream client. Clients
+// falling further behind are disconnected.
+const streamBuffer = 256
+
+var (
+	recordTTLDesc = prometheus.NewDesc("external_mdns_record_ttl_seconds",
+		"TTLs of the advertised records.", nil, nil)
+	recordAgeDesc = prometheus.NewDesc("external_mdns_record_age_seconds",
+		"Time since the advertised records were published.", nil, nil)
+
+	recordTTLBuckets = []float64{10, 30, 60, 120, 300, 600, 1800, 3600, 4500}
+	recordAgeBuckets = []float64{60, 300, 900, 3600, 6 * 3600, 24 * 3600, 7 * 24 * 3600}
+)
+
+type httpRecord struct {
+	Record
+	refs      int // number of times the record was published
+	published time.Time
+}
+
+// HTTPExporter keeps the currently advertised records for serving them over
+// HTTP, both as a snapshot and as a WebSocket stream of changes.
+type HTTPExporter struct {
+	records     map[string]*httpRecord // by the string representation of the record
+	subscribers map[chan Record]bool
+	mutex       sync.Mutex
+}
+
+// NewHTTPExporter creates an empty HTTPExporter
+func NewHTTPExporter() *HTTPExporter {
+	return &HTTPExporter{
+		records:     make(map[string]*httpRecord),
+		subscribers: make(map[chan Record]bool),
+	}
+}
+
+// Export updates the advertised records and pushes every change to the
+// stream clients
+func (h *HTTPExporter) Export(res resource.Resource) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	for _, rr := range res.Records {
+		key := rr.String()
+		record, ok := h.records[key]
+		switch res.Action {
+		case resource.Added:
+			if ok {
+				record.refs++
+				continue
+			}
+			h.records[key] = &httpRecord{NewRecord(res.Action, res.SourceType, rr), 1, time.Now()}
+		case resource.Deleted:
+			if !ok {
+				continue
+			}
+			if record.refs--; record.refs > 0 {
+				continue
+			}
+			delete(h.records, key)
+		}
+		change := NewRecord(res.Action, res.SourceType, rr)
+		for subscriber := range h.subscribers {
+			select {
+			case subscriber <- change:
+			default:
+				log.Println("Disconnecting record stream client which is too slow")
+				delete(h.subscribers, subscriber)
+				close(subscriber)
+			}
+		}
+	}
+	return nil
+}
+
+// Describe implements prometheus.Collector
+func (h *HTTPExporter) Describe(ch chan<- *prometheus.Desc) {
+	ch <- recordTTLDesc
+	ch <- recordAgeDesc
+}
+
+// Collect implements prometheus.Collector, exporting the distribution of the
+// TTLs and ages of the advertised records
+func (h *HTTPExporter) Collect(ch chan<- prometheus.Metric) {
+	h.mutex.Lock()
+	ttls := make([]float64, 0, len(h.records))
+	ages := make([]float64, 0, len(h.records))
+	now := time.Now()
+	for _, record := range h.records {
+		ttls = append(ttls, float64(record.TTL))
+		ages = append(ages, now.Sub(record.published).Seconds())
+	}
+	h.mutex.Unlock()
+
+	ch <- histogram(recordTTLDesc, recordTTLBuckets, ttls)
+	ch <- histogram(recordAgeDesc, recordAgeBuckets, ages)
+}
+
+func histogram(desc *prometheus.Desc, buckets []float64, values []float64) prometheus.Metric {
+	counts := make(map[float64]uint64, len(buckets))
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+		for _, bound := range buckets {
+			if value <= bound {
+				counts[bound]++
+			}
+		}
+	}
+	return prometheus.MustNewConstHistogram(desc, uint64(len(values)), sum, counts)
+}
+
+// ServeRecords responds with a JSON array of all advertised records
+func (h *HTTPExporter) ServeRecords(w http.ResponseWriter, r *http.Request) {
+	h.mutex.Lock()
+	keys := make([]string, 0, len(h.records))
+	for key := range h.records {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	records := make([]Record, 0, len(keys))
+	for _, key := range keys {
+		records = append(records, h.records[key].Record)
+	}
+	h.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(records); err != nil {
+		log.Println("Failed to send records:", err)
+	}
+}
+
+// StreamHandler returns a WebSocket handler sending every change to the
+// advertised records as a JSON message, in the format of the socket exporter
+func (h *HTTPExporter) StreamHandler() http.Handler {
+	return websocket.Handler(func(ws *websocket.Conn) {
+		changes := h.subscribe()
+		defer h.unsubscribe(changes)
+
+		// Clients are not expected to send anything, a failed read means
+		// the connection was closed
+		closed := make(chan struct{})
+		go func() {
+			var discard []byte
+			for websocket.Message.Receive(ws, &discard) == nil {
+			}
+			close(closed)
+		}()
+
+		for {
+			select {
+			case change, ok := <-changes:
+				if !ok {
+					return
+				}
+				if err := websocket.JSON.Send(ws, change); err != nil {
+					return
+				}
+			case <-closed:
+				return
+			}
+		}
+	})
+}
+
+func (h *HTTPExporter) subscribe() chan Record {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	changes := make(chan Record, streamBuffer)
+	h.subscribers[changes] = true
+	return changes
+}
+
+func (h *HTTPExporter) unsubscribe(changes chan Record) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	// Slow clients have already been removed
+	if h.subscribers[changes] {
+		delete(h.subscribers, changes)
+		close(changes)
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blake/external-mdns/resource"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/websocket"
+)
+
+const webA = "web.default.local. 120 IN A 10.0.0.10"
+
+func exportHTTP(t *testing.T, h *HTTPExporter, action string, records ...string) {
+	t.Helper()
+	res := resource.Resource{SourceType: "service", Action: action}
+	for _, s := range records {
+		res.Records = append(res.Records, mustRR(t, s))
+	}
+	if err := h.Export(res); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// getRecords returns the records served at /records
+func getRecords(t *testing.T, h *HTTPExporter) []Record {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeRecords(w, httptest.NewRequest("GET", "/records", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("content type = %q, want application/json", ct)
+	}
+	var records []Record
+	if err := json.Unmarshal(w.Body.Bytes(), &records); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestHTTPExporterRecords(t *testing.T) {
+	h := NewHTTPExporter()
+	if got := getRecords(t, h); len(got) != 0 {
+		t.Errorf("served %v without records, want an empty array", got)
+	}
+
+	// The record published by two objects is served until both withdrew it
+	exportHTTP(t, h, resource.Added, webA, webSRV)
+	exportHTTP(t, h, resource.Added, webA)
+	exportHTTP(t, h, resource.Deleted, webA, webSRV)
+	want := []Record{{Action: resource.Added, Source: "service", Name: "web.default.local.", Type: "A", TTL: 120, Data: "10.0.0.10"}}
+	if got := getRecords(t, h); !reflect.DeepEqual(got, want) {
+		t.Errorf("served %v, want %v", got, want)
+	}
+
+	exportHTTP(t, h, resource.Deleted, webA)
+	if got := getRecords(t, h); len(got) != 0 {
+		t.Errorf("served %v after all records were withdrawn, want none", got)
+	}
+}
+
+func TestHTTPExporterStream(t *testing.T) {
+	h := NewHTTPExporter()
+	server := httptest.NewServer(h.StreamHandler())
+	defer server.Close()
+
+	ws, err := websocket.Dial(strings.Replace(server.URL, "http://", "ws://", 1), "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		h.mutex.Lock()
+		subscribed := len(h.subscribers) == 1
+		h.mutex.Unlock()
+		if subscribed {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("stream client did not subscribe")
+		}
+	}
+
+	exportHTTP(t, h, resource.Added, webA)
+	// Publishing the record again is no change
+	exportHTTP(t, h, resource.Added, webA)
+	exportHTTP(t, h, resource.Deleted, webA)
+	exportHTTP(t, h, resource.Deleted, webA)
+
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for _, action := range []string{resource.Added, resource.Deleted} {
+		var change Record
+		if err := websocket.JSON.Receive(ws, &change); err != nil {
+			t.Fatal(err)
+		}
+		want := Record{Action: action, Source: "service", Name: "web.default.local.", Type: "A", TTL: 120, Data: "10.0.0.10"}
+		if change != want {
+			t.Errorf("streamed %+v, want %+v", change, want)
+		}
+	}
+}
+
+func TestHTTPExporterMetrics(t *testing.T) {
+	h := NewHTTPExporter()
+	exportHTTP(t, h, resource.Added, webA, webSRV, "_http._tcp.local. 4500 IN PTR web._http._tcp.local.")
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(h)
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	histograms := map[string]bool{}
+	for _, family := range families {
+		histogram := family.GetMetric()[0].GetHistogram()
+		if histogram.GetSampleCount() != 3 {
+			t.Errorf("%s counts %d records, want 3", family.GetName(), histogram.GetSampleCount())
+		}
+		switch family.GetName() {
+		case "external_mdns_record_ttl_seconds":
+			if histogram.GetSampleSum() != 4740 {
+				t.Errorf("TTLs sum up to %v, want 4740", histogram.GetSampleSum())
+			}
+			buckets := map[float64]uint64{}
+			for _, bucket := range histogram.GetBucket() {
+				buckets[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+			}
+			if buckets[60] != 0 || buckets[120] != 2 || buckets[3600] != 2 || buckets[4500] != 3 {
+				t.Errorf("TTL buckets = %v, want 2 records up to 120s and 3 up to 4500s", buckets)
+			}
+		case "external_mdns_record_age_seconds":
+			if histogram.GetSampleSum() > 60 {
+				t.Errorf("ages sum up to %vs, want the records just published", histogram.GetSampleSum())
+			}
+		}
+		histograms[family.GetName()] = true
+	}
+	if !histograms["external_mdns_record_ttl_seconds"] || !histograms["external_mdns_record_age_seconds"] {
+		t.Errorf("collected %v, want the TTL and age histograms", histograms)
+	}
+}
+
+func TestHTTPExporterMetricsFollowRecords(t *testing.T) {
+	h := NewHTTPExporter()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(h)
+	exportHTTP(t, h, resource.Added, webA, webSRV)
+	h.mutex.Lock()
+	h.records[mustRR(t, webA).String()].published = time.Now().Add(-2 * time.Hour)
+	h.mutex.Unlock()
+
+	// cumulative returns the cumulative bucket counts of the histogram name
+	cumulative := func(name string) map[float64]uint64 {
+		families, err := registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		buckets := map[float64]uint64{}
+		for _, family := range families {
+			if family.GetName() == name {
+				for _, bucket := range family.GetMetric()[0].GetHistogram().GetBucket() {
+					buckets[bucket.GetUpperBound()] = bucket.GetCumulativeCount()
+				}
+			}
+		}
+		return buckets
+	}
+
+	if ages := cumulative("external_mdns_record_age_seconds"); ages[60] != 1 || ages[3600] != 1 || ages[6*3600] != 2 {
+		t.Errorf("age buckets = %v, want one record up to a minute and one up to 6 hours old", ages)
+	}
+
+	exportHTTP(t, h, resource.Deleted, webSRV)
+	if ttls := cumulative("external_mdns_record_ttl_seconds"); ttls[120] != 1 || ttls[4500] != 1 {
+		t.Errorf("TTL buckets = %v after a withdrawal, want the remaining record", ttls)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+
+	"github.com/blake/external-mdns/resource"
+	"github.com/miekg/dns"
+)
+
+// Record is the JSON representation of a single record change
+type Record struct {
+	Action string `json:"action"`
+	Source string `json:"source"`
+	Name   string `json:"name"`
+	Type   string `json:"type"`
+	TTL    uint32 `json:"ttl"`
+	Data   string `json:"data"`
+}
+
+// NewRecord converts rr into its JSON representation
+func NewRecord(action string, source string, rr dns.RR) Record {
+	return Record{
+		Action: action,
+		Source: source,
+		Name:   rr.Header().Name,
+		Type:   dns.TypeToString[rr.Header().Rrtype],
+		TTL:    rr.Header().Ttl,
+		Data:   strings.TrimPrefix(rr.String(), rr.Header().String()),
+	}
+}
+
+// SocketExporter writes each record change as a newline-terminated JSON
+// object to a Unix datagram socket, one datagram per record.
+type SocketExporter struct {
+	conn *net.UnixConn
+}
+
+// NewSocketExporter connects to the Unix datagram socket at path
+func NewSocketExporter(path string) (*SocketExporter, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &SocketExporter{conn: conn}, nil
+}
+
+// Export sends the records of res to the socket
+func (s *SocketExporter) Export(res resource.Resource) error {
+	for _, rr := range res.Records {
+		buf, err := json.Marshal(NewRecord(res.Action, res.SourceType, rr))
+		if err != nil {
+			return err
+		}
+		if _, err := s.conn.Write(append(buf, '\n')); err != nil {
+			return err
+		}
+	}
+	return nil
+}
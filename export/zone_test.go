@@ -0,0 +1,63 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package export
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestWriteZoneFile(t *testing.T) {
+	records := []dns.RR{
+		mustRR(t, webSRV),
+		mustRR(t, webTXT),
+		mustRR(t, "_http._tcp.local. 4500 IN PTR web._http._tcp.local."),
+		mustRR(t, "web.default.local. 120 IN A 10.0.0.10"),
+		mustRR(t, "web.default.local. 120 IN AAAA fd00::10"),
+	}
+	path := filepath.Join(t.TempDir(), "local.zone")
+	if err := WriteZoneFile(path, records); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []string
+	zp := dns.NewZoneParser(f, "", path)
+	for rr, ok := zp.Next(); ok; rr, ok = zp.Next() {
+		got = append(got, rr.String())
+	}
+	if err := zp.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	var want []string
+	for _, rr := range records {
+		want = append(want, rr.String())
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("zone file parsed to %v, want %v", got, want)
+	}
+}
@@ -3,11 +3,16 @@ module github.com/blake/external-mdns
 go 1.16
 
 require (
+	github.com/godbus/dbus/v5 v5.1.0
 	github.com/jpillora/go-tld v1.0.0
 	github.com/miekg/dns v1.1.31
 	github.com/mitchellh/copystructure v1.0.0
 	github.com/mitchellh/go-homedir v1.1.0
+	github.com/prometheus/client_golang v1.11.1
+	golang.org/x/net v0.0.0-20210520170846-37e1c6afe023
+	golang.org/x/time v0.0.0-20210723032227-1f47c861a9ac
 	k8s.io/api v0.22.2
 	k8s.io/apimachinery v0.22.2
 	k8s.io/client-go v0.22.2
+	sigs.k8s.io/yaml v1.2.0
 )
@@ -15,16 +15,29 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	homedir "github.com/mitchellh/go-homedir"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+var apiserverConnected = promauto.NewGauge(prometheus.GaugeOpts{
+	Name: "external_mdns_apiserver_connected",
+	Help: "Whether the last check of the connection to the Kubernetes API server succeeded.",
+})
+
 func initAuthCreds() *rest.Config {
 
 	// Use Kubernetes service account for authentication when running in-cluster
@@ -67,3 +80,120 @@ func newK8sClient() (*kubernetes.Clientset, error) {
 	}
 	return k8sClient, nil
 }
+
+// checkSourceAccess lists one object of every resource type the source
+// watches, returning the first error, e.g. because RBAC denies access.
+func checkSourceAccess(k8sClient kubernetes.Interface, src string) error {
+	opts := metav1.ListOptions{Limit: 1}
+	var resources []func() error
+	listServices := func() error {
+		_, err := k8sClient.CoreV1().Services(namespace).List(context.TODO(), opts)
+		return err
+	}
+	listEndpoints := func() error {
+		_, err := k8sClient.CoreV1().Endpoints(namespace).List(context.TODO(), opts)
+		return err
+	}
+	switch src {
+	case "service":
+		resources = append(resources, listServices)
+	case "endpoints":
+		resources = append(resources, listEndpoints, listServices)
+	case "ingress":
+		resources = append(resources, func() error {
+			_, err := k8sClient.NetworkingV1().Ingresses(namespace).List(context.TODO(), opts)
+			return err
+		})
+		if requireBackend {
+			resources = append(resources, listServices)
+		}
+	}
+
+	for _, list := range resources {
+		if err := list(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// monitorConnection checks the connection to the API server every interval,
+// logging when it is lost or restored. Records are kept while disconnected:
+// the informers list all objects again after reconnecting, and only objects
+// which are gone by then are withdrawn.
+func monitorConnection(k8sClient kubernetes.Interface, interval time.Duration, stopCh <-chan struct{}) {
+	_, err := k8sClient.Discovery().ServerVersion()
+	connected := err == nil
+	if connected {
+		apiserverConnected.Set(1)
+	} else {
+		log.Println("No connection to the API server:", err)
+		apiserverConnected.Set(0)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_, err := k8sClient.Discovery().ServerVersion()
+			switch {
+			case err != nil && connected:
+				log.Println("Lost connection to the API server, keeping all records:", err)
+				apiserverConnected.Set(0)
+			case err == nil && !connected:
+				log.Println("Connection to the API server restored")
+				apiserverConnected.Set(1)
+			}
+			connected = err == nil
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// waitForSources waits until each of the named sources has been received from
+// synced, or timeout has passed, logging the sources which have not
+// synchronized by then. A zero timeout waits forever.
+func waitForSources(names []string, synced <-chan string, timeout time.Duration) {
+	pending := map[string]bool{}
+	for _, name := range names {
+		pending[name] = true
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for len(pending) > 0 {
+		select {
+		case name := <-synced:
+			delete(pending, name)
+		case <-expired:
+			var stuck []string
+			for name := range pending {
+				stuck = append(stuck, name)
+			}
+			sort.Strings(stuck)
+			log.Printf("Sources not synchronized after %s, publishing the others: %s", timeout, strings.Join(stuck, ", "))
+			return
+		}
+	}
+	log.Println("All sources synchronized")
+}
+
+// authorizedSources returns the sources whose resources RBAC grants access
+// to, logging the ones that are disabled.
+func authorizedSources(k8sClient kubernetes.Interface, sources k8sSource) k8sSource {
+	var authorized k8sSource
+	for _, src := range sources {
+		err := checkSourceAccess(k8sClient, src)
+		if apierrors.IsForbidden(err) || apierrors.IsUnauthorized(err) {
+			log.Printf("Disabling source %s: %v", src, err)
+			continue
+		}
+		authorized = append(authorized, src)
+	}
+	return authorized
+}
@@ -0,0 +1,208 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/version"
+	"k8s.io/client-go/discovery"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// captureLog returns the buffer the log is written to until the test ends
+func captureLog(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	return &buf
+}
+
+func TestWaitForSources(t *testing.T) {
+	buf := captureLog(t)
+	synced := make(chan string, 2)
+	synced <- "service"
+	synced <- "ingress"
+
+	waitForSources([]string{"ingress", "service"}, synced, time.Minute)
+	if !strings.Contains(buf.String(), "All sources synchronized") {
+		t.Errorf("log = %q, want all sources synchronized", buf.String())
+	}
+}
+
+func TestWaitForSourcesTimeout(t *testing.T) {
+	buf := captureLog(t)
+	synced := make(chan string, 3)
+	synced <- "service"
+
+	done := make(chan struct{})
+	go func() {
+		waitForSources([]string{"endpoints", "ingress", "service"}, synced, 10*time.Millisecond)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("waitForSources did not return after the timeout")
+	}
+	if want := "publishing the others: endpoints, ingress"; !strings.Contains(buf.String(), want) {
+		t.Errorf("log = %q, want it to contain %q", buf.String(), want)
+	}
+}
+
+func TestMonitorConnectionInterval(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		monitorConnection(client, 10*time.Millisecond, stop)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	close(stop)
+	<-done
+
+	checks := 0
+	for _, action := range client.Actions() {
+		if action.GetVerb() == "get" && action.GetResource().Resource == "version" {
+			checks++
+		}
+	}
+	if checks < 3 {
+		t.Errorf("checked the connection %d times in 100ms, want about every 10ms", checks)
+	}
+}
+
+// forbidIngresses makes client deny listing ingresses
+func forbidIngresses(client *fake.Clientset) {
+	client.PrependReactor("list", "ingresses", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Group: "networking.k8s.io", Resource: "ingresses"}, "", errors.New("RBAC denied"))
+	})
+}
+
+func TestCheckSourceAccess(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	forbidIngresses(client)
+
+	if err := checkSourceAccess(client, "service"); err != nil {
+		t.Errorf("checkSourceAccess(service) = %v, want access", err)
+	}
+	err := checkSourceAccess(client, "ingress")
+	if !apierrors.IsForbidden(err) || !strings.Contains(err.Error(), "ingresses") {
+		t.Errorf("checkSourceAccess(ingress) = %v, want ingresses forbidden", err)
+	}
+}
+
+func TestAuthorizedSources(t *testing.T) {
+	buf := captureLog(t)
+	client := fake.NewSimpleClientset()
+	forbidIngresses(client)
+
+	got := authorizedSources(client, k8sSource{"service", "ingress", "endpoints"})
+	if want := (k8sSource{"service", "endpoints"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("authorizedSources() = %v, want %v", got, want)
+	}
+	if !strings.Contains(buf.String(), "Disabling source ingress") {
+		t.Errorf("log = %q, want the ingress source disabled", buf.String())
+	}
+}
+
+// flakyDiscovery fails to get the server version while fail is set
+type flakyDiscovery struct {
+	*fakediscovery.FakeDiscovery
+	fail *int32
+}
+
+func (d flakyDiscovery) ServerVersion() (*version.Info, error) {
+	if atomic.LoadInt32(d.fail) != 0 {
+		return nil, errors.New("connection refused")
+	}
+	return d.FakeDiscovery.ServerVersion()
+}
+
+// flakyClient is a fake client whose API server can be disconnected
+type flakyClient struct {
+	*fake.Clientset
+	fail int32
+}
+
+func (c *flakyClient) Discovery() discovery.DiscoveryInterface {
+	return flakyDiscovery{FakeDiscovery: c.Clientset.Discovery().(*fakediscovery.FakeDiscovery), fail: &c.fail}
+}
+
+// waitGauge waits for the apiserver connected gauge to reach want
+func waitGauge(t *testing.T, want float64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(apiserverConnected) != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("apiserver connected gauge = %v, want %v", testutil.ToFloat64(apiserverConnected), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestMonitorConnectionGauge(t *testing.T) {
+	captureLog(t)
+	tests := []struct {
+		name     string
+		interval time.Duration
+		recovers bool
+	}{
+		// Not reported as connected before the first check succeeded
+		{name: "before the first interval", interval: time.Hour},
+		{name: "on recovery", interval: 10 * time.Millisecond, recovers: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &flakyClient{Clientset: fake.NewSimpleClientset(), fail: 1}
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			defer func() {
+				close(stop)
+				<-done
+			}()
+			apiserverConnected.Set(1)
+			go func() {
+				monitorConnection(client, tt.interval, stop)
+				close(done)
+			}()
+
+			waitGauge(t, 0)
+			if !tt.recovers {
+				return
+			}
+			atomic.StoreInt32(&client.fail, 0)
+			waitGauge(t, 1)
+			atomic.StoreInt32(&client.fail, 1)
+			waitGauge(t, 0)
+		})
+	}
+}
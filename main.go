@@ -17,33 +17,178 @@ package main
 import (
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"text/template"
+	"time"
 
+	"github.com/blake/external-mdns/export"
 	"github.com/blake/external-mdns/mdns"
+	"github.com/blake/external-mdns/publish"
 	"github.com/blake/external-mdns/resource"
 	"github.com/blake/external-mdns/source"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/informers"
 )
 
+// controller is implemented by all sources
+type controller interface {
+	Run(stopCh chan struct{}) error
+	Reconcile()
+}
+
 type k8sSource []string
 
 func (s *k8sSource) String() string {
 	return fmt.Sprint(*s)
 }
 
+func (s *k8sSource) contains(value string) bool {
+	for _, src := range *s {
+		if src == value {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *k8sSource) Set(value string) error {
 	switch value {
-	case "ingress", "service":
+	case "endpoints", "ingress", "service":
+		*s = append(*s, value)
+		return nil
+	}
+	return fmt.Errorf("unknown source %q", value)
+}
+
+type serviceTypeList []string
+
+func (s *serviceTypeList) String() string {
+	return fmt.Sprint(*s)
+}
+
+func (s *serviceTypeList) Set(value string) error {
+	switch corev1.ServiceType(value) {
+	case corev1.ServiceTypeClusterIP, corev1.ServiceTypeNodePort, corev1.ServiceTypeLoadBalancer, corev1.ServiceTypeExternalName:
 		*s = append(*s, value)
+		return nil
+	}
+	return fmt.Errorf("unknown service type %q", value)
+}
+
+type aliasMap map[string]string
+
+func (a *aliasMap) String() string {
+	return fmt.Sprint(map[string]string(*a))
+}
+
+func (a *aliasMap) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("expected alias=target, got %q", value)
+	}
+	if *a == nil {
+		*a = aliasMap{}
+	}
+	(*a)[source.QualifyHostname(parts[0])] = source.QualifyHostname(parts[1])
+	return nil
+}
+
+type namespaceTTLMap map[string]int
+
+func (n *namespaceTTLMap) String() string {
+	return fmt.Sprint(map[string]int(*n))
+}
+
+func (n *namespaceTTLMap) Set(value string) error {
+	if *n == nil {
+		*n = namespaceTTLMap{}
+	}
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return fmt.Errorf("expected namespace=ttl, got %q", pair)
+		}
+		ttl, err := strconv.Atoi(parts[1])
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid TTL for namespace %s: %q", parts[0], parts[1])
+		}
+		(*n)[parts[0]] = ttl
 	}
 	return nil
 }
 
+type namespaceDomainMap map[string]string
+
+func (n *namespaceDomainMap) String() string {
+	return fmt.Sprint(map[string]string(*n))
+}
+
+func (n *namespaceDomainMap) Set(value string) error {
+	if *n == nil {
+		*n = namespaceDomainMap{}
+	}
+	for _, pair := range strings.Split(value, ",") {
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || strings.Trim(parts[1], ".") == "" {
+			return fmt.Errorf("expected namespace=domain, got %q", pair)
+		}
+		(*n)[parts[0]] = source.QualifyHostname(strings.TrimPrefix(parts[1], "."))
+	}
+	return nil
+}
+
+type interfaceList []*net.Interface
+
+func (i *interfaceList) String() string {
+	var names []string
+	for _, iface := range *i {
+		names = append(names, iface.Name)
+	}
+	return fmt.Sprint(names)
+}
+
+// interfaceByName looks up a network interface, including VLAN interfaces
+// such as eth0.20. Tests replace it with a fake interface set.
+var interfaceByName = net.InterfaceByName
+
+func (i *interfaceList) Set(value string) error {
+	iface, err := interfaceByName(value)
+	if err != nil {
+		return err
+	}
+	if iface.Flags&net.FlagMulticast == 0 {
+		return fmt.Errorf("interface %s does not support multicast", value)
+	}
+	*i = append(*i, iface)
+	return nil
+}
+
+type subnetList []*net.IPNet
+
+func (s *subnetList) String() string {
+	return fmt.Sprint(*s)
+}
+
+func (s *subnetList) Set(value string) error {
+	_, subnet, err := net.ParseCIDR(value)
+	if err != nil {
+		return err
+	}
+	*s = append(*s, subnet)
+	return nil
+}
+
 /*
 The following functions were obtained from
 https://www.gmarik.info/blog/2019/12-factor-golang-flag-package/
@@ -91,30 +236,551 @@ func lookupEnvOrBool(key string, defaultVal bool) bool {
 	return defaultVal
 }
 
+// lookupEnvOrList sets value to each entry of the comma-separated list in the
+// environment variable key, if set
+func lookupEnvOrList(key string, value flag.Value) {
+	if val, ok := os.LookupEnv(key); ok {
+		for _, entry := range strings.Split(val, ",") {
+			if err := value.Set(strings.TrimSpace(entry)); err != nil {
+				log.Fatalf("lookupEnvOrList[%s]: %v", key, err)
+			}
+		}
+	}
+}
+
+func lookupEnvOrDuration(key string, defaultVal time.Duration) time.Duration {
+	if val, ok := os.LookupEnv(key); ok {
+		v, err := time.ParseDuration(val)
+		if err != nil {
+			log.Fatalf("lookupEnvOrDuration[%s]: %v", key, err)
+		}
+		return v
+	}
+	return defaultVal
+}
+
 var (
-	master           = ""
-	namespace        = ""
-	publishAll       = false
-	test             = flag.Bool("test", false, "testing mode, no connection to k8s")
-	sourceFlag       k8sSource
-	kubeconfig       string
-	recordTTL        = 120
+	master            = ""
+	namespace         = ""
+	publishAll        = false
+	test              = flag.Bool("test", false, "testing mode, no connection to k8s")
+	sourceFlag        k8sSource
+	kubeconfig        string
+	recordTTL         = 120
+	reverseZones      subnetList
+	lbAddressType     = source.AddressTypeAll
+	lbHostnameMode    = source.LoadBalancerHostnameSkip
+	lbHostnameFamily  = source.AddressFamilyAny
+	lbHostnameRefresh = time.Minute
+	txtPrefix         = ""
+	strictAnnotations = false
+	exportSocket      = ""
+	avahiServiceDir   = ""
+	disableResponder  = false
+	lowercaseNames    = false
+	enumerateServices = false
+	protoLabelCase    = source.LabelCaseLower
+	srvTTL            = 0
+	txtTTL            = 0
+	ptrTTL            = 0
+	sharedTTL         = 0
+	clusterName       = ""
+	httpAddress       = ""
+	instanceConflict  = source.InstanceConflictWarn
+	serviceTypes      serviceTypeList
+	reachability      = source.ReachabilityOff
+	recordClass       = "IN"
+	recordClassValue  = uint16(dns.ClassINET)
+	announce          = false
+	requireBackend    = false
+	zone              = ""
+	skipLocalReverse  = false
+	validate          = false
+	selfName          = ""
+	ingressPreference = source.IngressAddressIP
+	announceInterval  time.Duration
+	announceJitter    time.Duration
+	ptrInterval       time.Duration
+	ptrJitter         time.Duration
+	debounce          time.Duration
+	deleteGrace       time.Duration
+	ephemeralMode     = false
+	aliasDomain       = ""
+	targetPortTXT     = false
+	instanceSeparator = "/"
+	forwardRecords    = true
+	maxTotalRecords   = 0
+	hostnameAliases   aliasMap
+	exportZone        = ""
+	exportZoneEvery   = time.Minute
+	namespaceTTLs     namespaceTTLMap
+	namespaceDomains  namespaceDomainMap
+	requireReady      = false
+	configFile        = ""
+	skipUnauthorized  = false
+	announceCount     = 2
+	resolveExternal   = false
+	labelsToTXT       = ""
+	nat64Prefix       = ""
+	interfaces        interfaceList
+	ingressSRV        = false
+	podHostnames      = false
+	ingressInstance   = source.IngressInstanceHost
+	reverseConflict   = source.ReverseConflictFirst
+	reconcileInterval time.Duration
+	syncTimeout       = 2 * time.Minute
+	apiCheckInterval  = 10 * time.Second
+	backend           = "native"
+	withdrawnNSEC     time.Duration
+	responseDelay     time.Duration
+	unicastResponses  = false
+	suppressRecent    = false
+	reachableRoutes   = false
+	publishCGNAT      = true
+	quiet             quietHours
+	requirePort       = ""
+	instanceTemplate  = ""
+	ownerID           = ""
+	readyPortsOnly    = false
+	externalIPsPolicy = source.ExternalIPsPolicyBoth
+	detailedMetrics   = false
+	publisher         publish.Publisher
+	exporters         []export.Exporter
+	advertised        = map[string][]dns.RR{}       // published records by their string representation
+	rejected          = map[string]map[string]int{} // records rejected by -max-total-records by object and string representation
+	recordsRejected   = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "external_mdns_records_rejected_total",
+		Help: "Number of records not published because -max-total-records was reached.",
+	})
+	recordsPublished *prometheus.CounterVec
+	recordsWithdrawn *prometheus.CounterVec
 )
 
+// ttlFor returns the TTL for the record of an object in namespace, taking the
+// per type and per namespace overrides into account.
+func ttlFor(record dns.RR, namespace string) uint32 {
+	ttl := 0
+	switch record.Header().Rrtype {
+	case dns.TypeSRV:
+		ttl = srvTTL
+	case dns.TypeTXT:
+		ttl = txtTTL
+	case dns.TypePTR:
+		ttl = ptrTTL
+		// DNS-SD pointers are shared by all responders, unlike the reverse
+		// mapping of addresses
+		name := strings.ToLower(record.Header().Name)
+		if sharedTTL != 0 && !strings.HasSuffix(name, ".in-addr.arpa.") && !strings.HasSuffix(name, ".ip6.arpa.") {
+			ttl = sharedTTL
+		}
+	}
+	if ttl <= 0 {
+		ttl = recordTTL
+		if namespaceTTL, ok := namespaceTTLs[namespace]; ok {
+			ttl = namespaceTTL
+		}
+	}
+	return uint32(ttl)
+}
+
+// checkTTLs returns an error if a TTL flag is out of range. A TTL of zero
+// withdraws a record in mDNS instead of keeping it forever, so -record-ttl
+// must be at least 1; the per type TTLs fall back to it if 0.
+func checkTTLs() error {
+	if recordTTL < 1 {
+		return fmt.Errorf("record TTL %d is below 1, a TTL of 0 withdraws records", recordTTL)
+	}
+	for _, t := range []struct {
+		name string
+		ttl  int
+	}{{"SRV", srvTTL}, {"TXT", txtTTL}, {"PTR", ptrTTL}, {"shared record", sharedTTL}} {
+		if t.ttl < 0 {
+			return fmt.Errorf("%s TTL %d is negative", t.name, t.ttl)
+		}
+	}
+	return nil
+}
+
+// interfaceAddrs returns the addresses of all network interfaces which are
+// up, except for loopback interfaces. Tests replace it with a fake interface
+// set.
+var interfaceAddrs = func() ([]net.Addr, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []net.Addr
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, ifaceAddrs...)
+	}
+	return addrs, nil
+}
+
+// defaultRouteAddress returns the source address of the default route. Tests
+// replace it along with interfaceAddrs.
+var defaultRouteAddress = func() (net.IP, error) {
+	// Connecting a UDP socket sends no packets but selects the source address
+	conn, err := net.Dial("udp", "192.0.2.1:9")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// localSubnets returns the subnets of all network interfaces which are up,
+// except for loopback interfaces.
+func localSubnets() ([]*net.IPNet, error) {
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	var subnets []*net.IPNet
+	for _, addr := range addrs {
+		if subnet, ok := addr.(*net.IPNet); ok {
+			subnets = append(subnets, subnet)
+		}
+	}
+	return subnets, nil
+}
+
+// primaryAddress returns the address of the interface holding the default
+// route, falling back to the first address of any local subnet.
+func primaryAddress() (net.IP, error) {
+	if ip, err := defaultRouteAddress(); err == nil {
+		return ip, nil
+	}
+
+	subnets, err := localSubnets()
+	if err != nil {
+		return nil, err
+	}
+	if len(subnets) == 0 {
+		return nil, fmt.Errorf("no network interface is up")
+	}
+	return subnets[0].IP, nil
+}
+
+// advertiseSelf publishes the primary address of the host under hostname
+func advertiseSelf(hostname string, cfg source.Config) error {
+	ip, err := primaryAddress()
+	if err != nil {
+		return err
+	}
+	advertise(resource.Resource{
+		SourceType: "self",
+		Action:     resource.Added,
+		Records:    source.BuildHostRecords(hostname, ip, cfg),
+	})
+	return nil
+}
+
+// newRecordCounters returns the unregistered published and withdrawn record
+// counters, labeled with the namespace and name of the object if
+// detailedMetrics is set
+func newRecordCounters() (published, withdrawn *prometheus.CounterVec) {
+	labels := []string{"source", "type"}
+	if detailedMetrics {
+		labels = append(labels, "namespace", "name")
+	}
+	published = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "external_mdns_records_published_total",
+		Help: "Number of records published, by source and record type.",
+	}, labels)
+	withdrawn = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "external_mdns_records_withdrawn_total",
+		Help: "Number of records withdrawn, by source and record type.",
+	}, labels)
+	return published, withdrawn
+}
+
+// recordLabels returns the label values of the published and withdrawn record
+// counters for record of res
+func recordLabels(res resource.Resource, record dns.RR) []string {
+	labels := []string{res.SourceType, dns.Type(record.Header().Rrtype).String()}
+	if detailedMetrics {
+		labels = append(labels, res.Namespace, res.Name)
+	}
+	return labels
+}
+
+func advertise(advertiseResource resource.Resource) {
+	if aliasDomain != "" {
+		aliases := source.BuildAliasRecords(advertiseResource.Records, aliasDomain)
+		advertiseResource.Records = append(append([]dns.RR{}, advertiseResource.Records...), aliases...)
+	}
+
+	object := advertiseResource.SourceType + "/" + advertiseResource.Namespace + "/" + advertiseResource.Name
+	var accepted []dns.RR
+	for _, record := range advertiseResource.Records {
+		// The sources keep the records they notified to compare later
+		// changes against, leave them untouched
+		record = dns.Copy(record)
+		record.Header().Ttl = ttlFor(record, advertiseResource.Namespace)
+		// Keep a class set by the source if asked to
+		if recordClass != "preserve" || record.Header().Class == 0 {
+			record.Header().Class = recordClassValue
+		}
+		key := record.String()
+		switch advertiseResource.Action {
+		case resource.Added:
+			if _, ok := advertised[key]; !ok && maxTotalRecords > 0 && len(advertised) >= maxTotalRecords {
+				log.Printf("Not publishing %s: limit of %d records reached", record, maxTotalRecords)
+				recordsRejected.Inc()
+				if rejected[object] == nil {
+					rejected[object] = map[string]int{}
+				}
+				rejected[object][key]++
+				continue
+			}
+			advertised[key] = append(advertised[key], record)
+		case resource.Deleted:
+			// Rejected when the object added it, even if another object
+			// published it since
+			if rejected[object][key] > 0 {
+				if rejected[object][key]--; rejected[object][key] == 0 {
+					delete(rejected[object], key)
+				}
+				if len(rejected[object]) == 0 {
+					delete(rejected, object)
+				}
+				continue
+			}
+			if _, ok := advertised[key]; !ok {
+				continue
+			}
+			if len(advertised[key]) > 1 {
+				advertised[key] = advertised[key][1:]
+			} else {
+				delete(advertised, key)
+			}
+		}
+		var err error
+		switch advertiseResource.Action {
+		case resource.Added:
+			err = publisher.Publish(record)
+			recordsPublished.WithLabelValues(recordLabels(advertiseResource, record)...).Inc()
+		case resource.Deleted:
+			err = publisher.UnPublish(record)
+			recordsWithdrawn.WithLabelValues(recordLabels(advertiseResource, record)...).Inc()
+		}
+		if err != nil {
+			log.Printf("Failed to update %s: %v", record, err)
+		}
+		accepted = append(accepted, record)
+	}
+	advertiseResource.Records = accepted
+
+	for _, exporter := range exporters {
+		if err := exporter.Export(advertiseResource); err != nil {
+			log.Println("Failed to export records:", err)
+		}
+	}
+}
+
+// resync replaces the records in the mDNS zone with the ones advertised,
+// correcting any drift between them. Avahi keeps its own records.
+func resync() {
+	if backend != "native" {
+		return
+	}
+	var records []dns.RR
+	for _, published := range advertised {
+		records = append(records, published...)
+	}
+	mdns.Sync(records)
+}
+
+// applyEphemeralMode defaults -debounce and -delete-grace for short-lived
+// objects, unless they were set on the command line of fs or otherwise.
+func applyEphemeralMode(fs *flag.FlagSet) {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if !explicit["debounce"] && debounce == 0 {
+		debounce = 2 * time.Second
+	}
+	if !explicit["delete-grace"] && deleteGrace == 0 {
+		deleteGrace = 30 * time.Second
+	}
+}
+
 func main() {
 
+	flag.StringVar(&configFile, "config", lookupEnvOrString("EXTERNAL_MDNS_CONFIG", configFile), "YAML file mapping flag names to values; flags on the command line take precedence (default: none)")
+
 	// Kubernetes options
 	flag.StringVar(&kubeconfig, "kubeconfig", lookupEnvOrString("EXTERNAL_MDNS_KUBECONFIG", kubeconfigPath()), "(optional) Absolute path to the kubeconfig file")
 	flag.StringVar(&master, "master", lookupEnvOrString("EXTERNAL_MDNS_MASTER", master), "URL to Kubernetes master")
 
 	// External-mDNS options
+	flag.StringVar(&requirePort, "require-port", lookupEnvOrString("EXTERNAL_MDNS_REQUIRE_PORT", requirePort), "Only publish services with a port of this name or number, e.g. web (default: any)")
+	flag.Var(&serviceTypes, "service-type", "Only publish services of this type; specify multiple times for multiple types (default: all types, options: ClusterIP, NodePort, LoadBalancer, ExternalName)")
+	flag.BoolVar(&resolveExternal, "resolve-external-names", lookupEnvOrBool("EXTERNAL_MDNS_RESOLVE_EXTERNAL_NAMES", resolveExternal), "Publish the resolved addresses of ExternalName services outside .local instead of a CNAME (default: false)")
+	flag.StringVar(&ownerID, "owner-id", lookupEnvOrString("EXTERNAL_MDNS_OWNER_ID", ownerID), "Only publish services whose external-mdns.blake.github.io/owner-id annotation matches this ID, to run several instances side by side (default: only services without owner)")
+	flag.StringVar(&externalIPsPolicy, "external-ips-policy", lookupEnvOrString("EXTERNAL_MDNS_EXTERNAL_IPS_POLICY", externalIPsPolicy), "Addresses to publish for services with both a cluster IP and external IPs in use (default: both, options: clusterip, externalips, both)")
 	flag.BoolVar(&publishAll, "publish-all", lookupEnvOrBool("EXTERNAL_MDNS_PUBLISH_ALL", publishAll), "Published all services, including those without annotation (default: false)")
+	flag.BoolVar(&requireBackend, "ingress-require-backend", lookupEnvOrBool("EXTERNAL_MDNS_INGRESS_REQUIRE_BACKEND", requireBackend), "Skip ingress rules whose paths reference no existing service (default: false)")
+	flag.BoolVar(&requireReady, "ingress-require-ready", lookupEnvOrBool("EXTERNAL_MDNS_INGRESS_REQUIRE_READY", requireReady), "Skip ingresses whose load balancer status reports port errors (default: false)")
+	flag.BoolVar(&readyPortsOnly, "ready-ports-only", lookupEnvOrBool("EXTERNAL_MDNS_READY_PORTS_ONLY", readyPortsOnly), "Only publish DNS-SD records for service ports with a ready endpoint; requires -source=endpoints (default: false)")
+	flag.BoolVar(&podHostnames, "pod-hostnames", lookupEnvOrBool("EXTERNAL_MDNS_POD_HOSTNAMES", podHostnames), "Also publish each endpoint of a headless service with a stable hostname, such as a StatefulSet pod, as <hostname>.<service hostname> (default: false)")
+	flag.BoolVar(&ingressSRV, "ingress-service-records", lookupEnvOrBool("EXTERNAL_MDNS_INGRESS_SERVICE_RECORDS", ingressSRV), "Publish _http._tcp and, for TLS hosts, _https._tcp DNS-SD records for ingress hosts (default: false)")
+	flag.StringVar(&ingressInstance, "ingress-instance-name", lookupEnvOrString("EXTERNAL_MDNS_INGRESS_INSTANCE_NAME", ingressInstance), "DNS-SD instance name of ingress hosts, the first label of the host or namespace and name of the ingress (options: host, object)")
+	flag.StringVar(&ingressPreference, "ingress-address-preference", lookupEnvOrString("EXTERNAL_MDNS_INGRESS_ADDRESS_PREFERENCE", ingressPreference), "Load balancer field ingress hosts resolve to if the status carries both an IP and a hostname (options: ip, hostname)")
 	flag.StringVar(&namespace, "namespace", lookupEnvOrString("EXTERNAL_MDNS_NAMESPACE", namespace), "Limit sources of endpoints to a specific namespace (default: all namespaces)")
-	flag.Var(&sourceFlag, "source", "The resource types that are queried for endpoints; specify multiple times for multiple sources (required, options: service, ingress)")
-	flag.IntVar(&recordTTL, "record-ttl", lookupEnvOrInt("EXTERNAL_MDNS_RECORD_TTL", recordTTL), "DNS record time-to-live")
+	flag.Var(&sourceFlag, "source", "The resource types that are queried for endpoints; specify multiple times for multiple sources (required, options: service, ingress, endpoints)")
+	flag.DurationVar(&debounce, "debounce", lookupEnvOrDuration("EXTERNAL_MDNS_DEBOUNCE", debounce), "Delay publishing changes of an object until it has not changed for this long (default: disabled)")
+	flag.DurationVar(&deleteGrace, "delete-grace", lookupEnvOrDuration("EXTERNAL_MDNS_DELETE_GRACE", deleteGrace), "Keep the records of deleted objects for this long, in case they are recreated (default: disabled)")
+	flag.BoolVar(&ephemeralMode, "ephemeral-mode", lookupEnvOrBool("EXTERNAL_MDNS_EPHEMERAL_MODE", ephemeralMode), "Preset for short-lived objects such as services of jobs, defaulting -debounce to 2s and -delete-grace to 30s (default: false)")
+	flag.BoolVar(&skipUnauthorized, "skip-unauthorized-sources", lookupEnvOrBool("EXTERNAL_MDNS_SKIP_UNAUTHORIZED_SOURCES", skipUnauthorized), "Disable sources whose resources RBAC denies access to, instead of waiting for them forever (default: false)")
+	flag.IntVar(&recordTTL, "record-ttl", lookupEnvOrInt("EXTERNAL_MDNS_RECORD_TTL", recordTTL), "DNS record time-to-live in seconds, at least 1")
+	flag.StringVar(&recordClass, "record-class", lookupEnvOrString("EXTERNAL_MDNS_RECORD_CLASS", recordClass), "DNS class of published records, or preserve to keep the class set by the source, for interoperability testing (options: IN, CH, HS, ANY, preserve)")
+	flag.IntVar(&maxTotalRecords, "max-total-records", lookupEnvOrInt("EXTERNAL_MDNS_MAX_TOTAL_RECORDS", maxTotalRecords), "Maximum number of distinct records published at the same time, further records are rejected (default: unlimited)")
+	flag.Var(&namespaceDomains, "namespace-domain", "Comma-separated namespace=domain pairs replacing <namespace>.local in the default hostnames of these namespaces, e.g. prod=prod.local,dev=test.local")
+	flag.Var(&namespaceTTLs, "namespace-ttl", "Comma-separated namespace=ttl pairs overriding -record-ttl for the objects of these namespaces, e.g. prod=300,dev=30")
+	flag.IntVar(&srvTTL, "srv-ttl", lookupEnvOrInt("EXTERNAL_MDNS_SRV_TTL", srvTTL), "SRV record time-to-live (default: record-ttl)")
+	flag.IntVar(&txtTTL, "txt-ttl", lookupEnvOrInt("EXTERNAL_MDNS_TXT_TTL", txtTTL), "TXT record time-to-live (default: record-ttl)")
+	flag.IntVar(&ptrTTL, "ptr-ttl", lookupEnvOrInt("EXTERNAL_MDNS_PTR_TTL", ptrTTL), "PTR record time-to-live (default: record-ttl)")
+	flag.IntVar(&sharedTTL, "shared-record-ttl", lookupEnvOrInt("EXTERNAL_MDNS_SHARED_RECORD_TTL", sharedTTL), "Time-to-live of shared DNS-SD PTR records, overriding -ptr-ttl for them (default: ptr-ttl)")
+	flag.BoolVar(&publishCGNAT, "publish-cgnat", lookupEnvOrBool("EXTERNAL_MDNS_PUBLISH_CGNAT", publishCGNAT), "Publish addresses in the CGNAT range 100.64.0.0/10, as used by Tailscale and similar overlays (default: true)")
+	flag.BoolVar(&reachableRoutes, "reachability-routes", lookupEnvOrBool("EXTERNAL_MDNS_REACHABILITY_ROUTES", reachableRoutes), "Also consider the destinations of the host's routes other than the default route reachable for -check-reachability (default: false)")
+	flag.StringVar(&reachability, "check-reachability", lookupEnvOrString("EXTERNAL_MDNS_CHECK_REACHABILITY", reachability), "Handling of addresses outside the subnets of local network interfaces (options: off, warn, skip)")
+	flag.StringVar(&zone, "zone", lookupEnvOrString("EXTERNAL_MDNS_ZONE", zone), "Topology zone of the responder, load balancer addresses in this zone are preferred (default: none)")
+	flag.BoolVar(&forwardRecords, "forward-records", lookupEnvOrBool("EXTERNAL_MDNS_FORWARD_RECORDS", forwardRecords), "Publish forward A/AAAA records; disable for a reverse-only responder")
+	flag.StringVar(&nat64Prefix, "nat64-prefix", lookupEnvOrString("EXTERNAL_MDNS_NAT64_PREFIX", nat64Prefix), "NAT64 prefix to synthesize AAAA records for IPv4 addresses with, e.g. 64:ff9b::/96 (default: disabled)")
+	flag.StringVar(&reverseConflict, "reverse-conflict", lookupEnvOrString("EXTERNAL_MDNS_REVERSE_CONFLICT", reverseConflict), "Objects publishing the reverse PTR record of an address shared by several objects (options: first, all)")
+	flag.BoolVar(&skipLocalReverse, "skip-local-ipv6-reverse", lookupEnvOrBool("EXTERNAL_MDNS_SKIP_LOCAL_IPV6_REVERSE", skipLocalReverse), "Do not publish reverse PTR records for IPv6 link-local and unique local addresses (default: false)")
+	flag.StringVar(&aliasDomain, "alias-domain", lookupEnvOrString("EXTERNAL_MDNS_ALIAS_DOMAIN", aliasDomain), "Domain to additionally publish every .local hostname in via CNAME, e.g. home.local (default: disabled)")
+	flag.StringVar(&lbHostnameMode, "loadbalancer-hostname-mode", lookupEnvOrString("EXTERNAL_MDNS_LOADBALANCER_HOSTNAME_MODE", lbHostnameMode), "Handling of load balancers reporting only a hostname, such as on AWS: publish the addresses it resolves to, a CNAME to it, or nothing (options: resolve, cname, skip)")
+	flag.StringVar(&lbHostnameFamily, "loadbalancer-hostname-family", lookupEnvOrString("EXTERNAL_MDNS_LOADBALANCER_HOSTNAME_FAMILY", lbHostnameFamily), "Address family published for load balancer hostnames with -loadbalancer-hostname-mode=resolve (default: any, options: any, ipv4, ipv6)")
+	flag.DurationVar(&lbHostnameRefresh, "loadbalancer-hostname-refresh", lookupEnvOrDuration("EXTERNAL_MDNS_LOADBALANCER_HOSTNAME_REFRESH", lbHostnameRefresh), "Interval to resolve load balancer hostnames with -loadbalancer-hostname-mode=resolve and external names with -resolve-external-names again, 0 to resolve them only whenever records are rebuilt (default: 1m)")
+	flag.StringVar(&lbAddressType, "loadbalancer-address-type", lookupEnvOrString("EXTERNAL_MDNS_LOADBALANCER_ADDRESS_TYPE", lbAddressType), "Load balancer addresses to publish (options: all, external, internal)")
+	flag.StringVar(&txtPrefix, "annotation-to-txt-prefix", lookupEnvOrString("EXTERNAL_MDNS_ANNOTATION_TO_TXT_PREFIX", txtPrefix), "Publish service annotations below this prefix as TXT key=value pairs (default: disabled)")
+	flag.StringVar(&labelsToTXT, "labels-to-txt", lookupEnvOrString("EXTERNAL_MDNS_LABELS_TO_TXT", labelsToTXT), "Comma-separated service label keys to publish as TXT key=value pairs, e.g. version,team (default: none)")
+	flag.BoolVar(&strictAnnotations, "strict-annotations", lookupEnvOrBool("EXTERNAL_MDNS_STRICT_ANNOTATIONS", strictAnnotations), "Do not publish services whose annotations reference nonexistent ports (default: false)")
+	flag.BoolVar(&targetPortTXT, "target-port-txt", lookupEnvOrBool("EXTERNAL_MDNS_TARGET_PORT_TXT", targetPortTXT), "Add the target port of each service port to its TXT record, for debugging port mappings (default: false)")
+	flag.StringVar(&clusterName, "cluster-name", lookupEnvOrString("EXTERNAL_MDNS_CLUSTER_NAME", clusterName), "Cluster name to include in default hostnames (default: none)")
+	flag.Var(&hostnameAliases, "hostname-alias", "Resolve hostnames set by annotation through an alias=target pair of .local names, following chains of aliases; specify multiple times for multiple aliases")
+	flag.BoolVar(&lowercaseNames, "lowercase-hostnames", lookupEnvOrBool("EXTERNAL_MDNS_LOWERCASE_HOSTNAMES", lowercaseNames), "Lowercase hostnames set by annotation and ingress hosts (default: false)")
+	flag.StringVar(&instanceSeparator, "instance-separator", lookupEnvOrString("EXTERNAL_MDNS_INSTANCE_SEPARATOR", instanceSeparator), "Separator of namespace and name in default DNS-SD service instance names")
+	flag.StringVar(&instanceTemplate, "instance-template", lookupEnvOrString("EXTERNAL_MDNS_INSTANCE_TEMPLATE", instanceTemplate), "Go template deriving the DNS-SD instance name of each service port from .Instance, .Namespace, .Name and .Port, e.g. '{{.Instance}} {{.Port}}' (default: the instance name)")
+	flag.StringVar(&instanceConflict, "instance-conflict", lookupEnvOrString("EXTERNAL_MDNS_INSTANCE_CONFLICT", instanceConflict), "Handling of DNS-SD service instance names used by several services (options: warn, skip, suffix)")
+	flag.BoolVar(&enumerateServices, "service-enumeration", lookupEnvOrBool("EXTERNAL_MDNS_SERVICE_ENUMERATION", enumerateServices), "Publish DNS-SD service type enumeration records (default: false)")
+	flag.StringVar(&protoLabelCase, "protocol-label-case", lookupEnvOrString("EXTERNAL_MDNS_PROTOCOL_LABEL_CASE", protoLabelCase), "Casing of the DNS-SD protocol label, for interoperability testing (options: lower, upper)")
+	flag.BoolVar(&detailedMetrics, "detailed-metrics", lookupEnvOrBool("EXTERNAL_MDNS_DETAILED_METRICS", detailedMetrics), "Label the published and withdrawn record counters with the namespace and name of the object; beware of the number of time series on large clusters (default: false)")
+	flag.StringVar(&httpAddress, "http-address", lookupEnvOrString("EXTERNAL_MDNS_HTTP_ADDRESS", httpAddress), "Address to serve Prometheus metrics on at /metrics and the advertised records at /records, e.g. :9090 (default: disabled)")
+	flag.Var(&quiet, "quiet-hours", "Daily window of local time during which new records are held back and only withdrawals are sent, e.g. 22:00-06:00 (default: none)")
+	flag.BoolVar(&announce, "announce", lookupEnvOrBool("EXTERNAL_MDNS_ANNOUNCE", announce), "Announce new records and send goodbyes for withdrawn records, logging send failures (default: false)")
+	flag.IntVar(&announceCount, "announce-count", lookupEnvOrInt("EXTERNAL_MDNS_ANNOUNCE_COUNT", announceCount), "Number of times new records are announced, with the interval doubling from one second (options: 1-8)")
+	flag.DurationVar(&announceInterval, "announce-interval", lookupEnvOrDuration("EXTERNAL_MDNS_ANNOUNCE_INTERVAL", announceInterval), "Minimum interval between announcements of forward records, e.g. 20ms (default: unlimited)")
+	flag.DurationVar(&announceJitter, "announce-jitter", lookupEnvOrDuration("EXTERNAL_MDNS_ANNOUNCE_JITTER", announceJitter), "Maximum random delay of announcements of forward records (default: none)")
+	flag.DurationVar(&responseDelay, "response-delay", lookupEnvOrDuration("EXTERNAL_MDNS_RESPONSE_DELAY", responseDelay), "Window to collect queries in and answer them with a single response, e.g. 50ms (default: answer immediately)")
+	flag.BoolVar(&unicastResponses, "unicast-responses", lookupEnvOrBool("EXTERNAL_MDNS_UNICAST_RESPONSES", unicastResponses), "Answer queries asking for a unicast response by unicast, multicasting the response if that fails (default: false)")
+	flag.BoolVar(&suppressRecent, "suppress-recent", lookupEnvOrBool("EXTERNAL_MDNS_SUPPRESS_RECENT", suppressRecent), "Leave records multicast within the last quarter of their TTL out of responses (default: false)")
+	flag.DurationVar(&withdrawnNSEC, "withdrawn-nsec", lookupEnvOrDuration("EXTERNAL_MDNS_WITHDRAWN_NSEC", withdrawnNSEC), "How long to answer queries for names whose records were all withdrawn with an NSEC record asserting they have none, e.g. 2m (default: disabled)")
+	flag.DurationVar(&ptrInterval, "ptr-announce-interval", lookupEnvOrDuration("EXTERNAL_MDNS_PTR_ANNOUNCE_INTERVAL", ptrInterval), "Minimum interval between announcements of reverse PTR records (default: unlimited)")
+	flag.DurationVar(&ptrJitter, "ptr-announce-jitter", lookupEnvOrDuration("EXTERNAL_MDNS_PTR_ANNOUNCE_JITTER", ptrJitter), "Maximum random delay of announcements of reverse PTR records (default: none)")
+	flag.StringVar(&exportSocket, "export-socket", lookupEnvOrString("EXTERNAL_MDNS_EXPORT_SOCKET", exportSocket), "Unix datagram socket to send record changes to as JSON lines (default: disabled)")
+	flag.StringVar(&exportZone, "export-zone", lookupEnvOrString("EXTERNAL_MDNS_EXPORT_ZONE", exportZone), "File to periodically write all published records to in BIND zone file format (default: disabled)")
+	flag.DurationVar(&exportZoneEvery, "export-zone-interval", lookupEnvOrDuration("EXTERNAL_MDNS_EXPORT_ZONE_INTERVAL", exportZoneEvery), "Interval to write the -export-zone file at")
+	flag.StringVar(&avahiServiceDir, "avahi-service-dir", lookupEnvOrString("EXTERNAL_MDNS_AVAHI_SERVICE_DIR", avahiServiceDir), "Directory to maintain Avahi .service files for DNS-SD services in (default: disabled)")
+	flag.Var(&interfaces, "interface", "Network interface to answer queries and announce on, e.g. eth0 or the VLAN interface eth0.20; specify multiple times for multiple interfaces (default: system default)")
+	flag.StringVar(&backend, "backend", lookupEnvOrString("EXTERNAL_MDNS_BACKEND", backend), "Backend to publish records with, the built-in responder or the Avahi daemon of the host via D-Bus (options: native, avahi)")
+	flag.BoolVar(&disableResponder, "disable-responder", lookupEnvOrBool("EXTERNAL_MDNS_DISABLE_RESPONDER", disableResponder), "Do not answer mDNS queries, only export records (default: false)")
+	flag.DurationVar(&reconcileInterval, "reconcile-interval", lookupEnvOrDuration("EXTERNAL_MDNS_RECONCILE_INTERVAL", reconcileInterval), "Interval to recompute all records from the informer caches and correct any drift, e.g. 10m (default: disabled)")
+	flag.DurationVar(&apiCheckInterval, "apiserver-check-interval", lookupEnvOrDuration("EXTERNAL_MDNS_APISERVER_CHECK_INTERVAL", apiCheckInterval), "Interval to check the connection to the Kubernetes API server at (default: 10s)")
+	flag.DurationVar(&syncTimeout, "sync-timeout", lookupEnvOrDuration("EXTERNAL_MDNS_SYNC_TIMEOUT", syncTimeout), "How long to hold back records at startup until all sources have synchronized, 0 to wait forever (default: 2m)")
+	flag.BoolVar(&validate, "validate", lookupEnvOrBool("EXTERNAL_MDNS_VALIDATE", validate), "Check the annotations of all objects of the selected sources, print any errors and exit non-zero if there are any (default: false)")
+	flag.StringVar(&selfName, "self-name", lookupEnvOrString("EXTERNAL_MDNS_SELF_NAME", selfName), "Hostname to publish the host's primary address under, e.g. gateway.local (default: disabled)")
+	flag.Var(&reverseZones, "reverse-zone", "Subnet (CIDR) for which DNS-SD browsing domain pointers are published; specify multiple times for multiple subnets")
 
 	flag.Parse()
 
+	if configFile != "" {
+		if err := loadConfigFile(flag.CommandLine, configFile); err != nil {
+			log.Fatalln("Failed to load config file:", err)
+		}
+	}
+	if len(sourceFlag) == 0 {
+		lookupEnvOrList("EXTERNAL_MDNS_SOURCE", &sourceFlag)
+	}
+
+	if ephemeralMode {
+		applyEphemeralMode(flag.CommandLine)
+	}
+
+	recordsPublished, recordsWithdrawn = newRecordCounters()
+	prometheus.MustRegister(recordsPublished, recordsWithdrawn)
+
+	if httpAddress != "" {
+		records := export.NewHTTPExporter()
+		exporters = append(exporters, records)
+		prometheus.MustRegister(records)
+		http.Handle("/metrics", promhttp.Handler())
+		http.HandleFunc("/records", records.ServeRecords)
+		http.Handle("/records/stream", records.StreamHandler())
+		go func() {
+			log.Fatalln(http.ListenAndServe(httpAddress, nil))
+		}()
+	}
+
+	if recordClass != "preserve" {
+		class, ok := dns.StringToClass[strings.ToUpper(recordClass)]
+		if !ok {
+			log.Fatalf("Invalid record class: %q", recordClass)
+		}
+		recordClassValue = class
+	}
+
+	if err := checkTTLs(); err != nil {
+		log.Fatalln("Invalid TTL:", err)
+	}
+
+	if announceCount < 1 || announceCount > 8 {
+		log.Fatalf("Invalid announce count: %d", announceCount)
+	}
+
+	if apiCheckInterval <= 0 {
+		log.Fatalf("Invalid API server check interval: %s", apiCheckInterval)
+	}
+	if exportZone != "" && exportZoneEvery <= 0 {
+		log.Fatalf("Invalid zone export interval: %s", exportZoneEvery)
+	}
+	mdns.SetAnnounceCount(announceCount)
+	mdns.SetAnnounceThrottle(announceInterval, announceJitter, ptrInterval, ptrJitter)
+	mdns.SetWithdrawnNSEC(withdrawnNSEC)
+	mdns.SetResponseDelay(responseDelay)
+	mdns.SetUnicastResponses(unicastResponses)
+	mdns.SetSuppressRecent(suppressRecent)
+
+	switch backend {
+	case "native":
+		publisher = &publish.Native{Announce: announce}
+		if !disableResponder && !validate {
+			if err := mdns.Listen(interfaces); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	case "avahi":
+		if !validate {
+			avahi, err := publish.NewAvahi()
+			if err != nil {
+				log.Fatalln("Failed to connect to Avahi:", err)
+			}
+			publisher = avahi
+		}
+	default:
+		log.Fatalf("Invalid backend: %q", backend)
+	}
+
 	if *test {
 		mdns.Publish(&dns.A{Hdr: dns.RR_Header{Name: "router.local.", Ttl: uint32(recordTTL), Class: dns.ClassINET, Rrtype: dns.TypeA}, A: net.ParseIP("192.168.1.254")})
 		mdns.UnPublish(&dns.PTR{Hdr: dns.RR_Header{Name: "254.1.168.192.in-addr.arpa.", Ttl: uint32(recordTTL), Class: dns.ClassINET, Rrtype: dns.TypePTR}, Ptr: "router.local."})
@@ -128,6 +794,91 @@ func main() {
 		os.Exit(1)
 	}
 
+	switch lbAddressType {
+	case source.AddressTypeAll, source.AddressTypeExternal, source.AddressTypeInternal:
+	default:
+		log.Fatalf("Invalid load balancer address type: %q", lbAddressType)
+	}
+
+	switch lbHostnameMode {
+	case source.LoadBalancerHostnameSkip, source.LoadBalancerHostnameResolve, source.LoadBalancerHostnameCNAME:
+	default:
+		log.Fatalf("Invalid load balancer hostname mode: %q", lbHostnameMode)
+	}
+	switch externalIPsPolicy {
+	case source.ExternalIPsPolicyClusterIP, source.ExternalIPsPolicyExternalIPs, source.ExternalIPsPolicyBoth:
+	default:
+		log.Fatalf("Invalid external IPs policy: %q", externalIPsPolicy)
+	}
+	switch lbHostnameFamily {
+	case source.AddressFamilyAny, source.AddressFamilyIPv4, source.AddressFamilyIPv6:
+	default:
+		log.Fatalf("Invalid load balancer hostname family: %q", lbHostnameFamily)
+	}
+
+	switch protoLabelCase {
+	case source.LabelCaseLower, source.LabelCaseUpper:
+	default:
+		log.Fatalf("Invalid protocol label case: %q", protoLabelCase)
+	}
+
+	switch reachability {
+	case source.ReachabilityOff, source.ReachabilityWarn, source.ReachabilitySkip:
+	default:
+		log.Fatalf("Invalid reachability check: %q", reachability)
+	}
+
+	if instanceSeparator == "" || strings.ContainsAny(instanceSeparator, ".\\\"") {
+		log.Fatalf("Invalid instance separator: %q", instanceSeparator)
+	}
+
+	var instanceTmpl *template.Template
+	if instanceTemplate != "" {
+		var err error
+		instanceTmpl, err = template.New("instance").Option("missingkey=error").Parse(instanceTemplate)
+		if err == nil {
+			err = instanceTmpl.Execute(ioutil.Discard, source.InstanceNameData{})
+		}
+		if err != nil {
+			log.Fatalf("Invalid instance template: %v", err)
+		}
+	}
+
+	switch reverseConflict {
+	case source.ReverseConflictFirst, source.ReverseConflictAll:
+	default:
+		log.Fatalf("Invalid reverse conflict policy: %q", reverseConflict)
+	}
+
+	switch ingressInstance {
+	case source.IngressInstanceHost, source.IngressInstanceObject:
+	default:
+		log.Fatalf("Invalid ingress instance name: %q", ingressInstance)
+	}
+
+	switch ingressPreference {
+	case source.IngressAddressIP, source.IngressAddressHostname:
+	default:
+		log.Fatalf("Invalid ingress address preference: %q", ingressPreference)
+	}
+
+	switch instanceConflict {
+	case source.InstanceConflictWarn, source.InstanceConflictSkip, source.InstanceConflictSuffix:
+	default:
+		log.Fatalf("Invalid instance conflict policy: %q", instanceConflict)
+	}
+
+	if exportSocket != "" {
+		exporter, err := export.NewSocketExporter(exportSocket)
+		if err != nil {
+			log.Fatalln("Failed to connect to export socket:", err)
+		}
+		exporters = append(exporters, exporter)
+	}
+	if avahiServiceDir != "" {
+		exporters = append(exporters, export.NewAvahiExporter(avahiServiceDir))
+	}
+
 	// Print parsed configuration
 	log.Printf("app.config %v\n", getConfig(flag.CommandLine))
 
@@ -136,36 +887,202 @@ func main() {
 		log.Fatalln("Failed to create Kubernetes client:", err)
 	}
 
+	if skipUnauthorized {
+		sourceFlag = authorizedSources(k8sClient, sourceFlag)
+		if len(sourceFlag) == 0 {
+			log.Fatalln("No source is authorized")
+		}
+	}
+
 	notifyMdns := make(chan resource.Resource)
 	stopper := make(chan struct{})
 	defer close(stopper)
 	defer runtime.HandleCrash()
 
+	sourceConfig := source.Config{
+		Namespace:                   namespace,
+		PublishAll:                  publishAll,
+		ExternalIPsPolicy:           externalIPsPolicy,
+		OwnerID:                     strings.TrimSpace(ownerID),
+		LoadBalancerAddressType:     lbAddressType,
+		LoadBalancerHostnameMode:    lbHostnameMode,
+		LoadBalancerHostnameFamily:  lbHostnameFamily,
+		LoadBalancerHostnameRefresh: lbHostnameRefresh,
+		SkipCGNAT:                   !publishCGNAT,
+		AnnotationTXTPrefix:         txtPrefix,
+		StrictAnnotations:           strictAnnotations,
+		LowercaseHostnames:          lowercaseNames,
+		ServiceEnumeration:          enumerateServices,
+		ProtocolLabelCase:           protoLabelCase,
+		HostnameAliases:             hostnameAliases,
+		ClusterName:                 clusterName,
+		NamespaceDomains:            namespaceDomains,
+		TargetPortTXT:               targetPortTXT,
+		WatchEndpoints:              sourceFlag.contains("endpoints"),
+		ReadyPortsOnly:              readyPortsOnly,
+		InstanceSeparator:           instanceSeparator,
+		InstanceConflict:            instanceConflict,
+		ResolveExternalNames:        resolveExternal,
+		ServiceTypes:                serviceTypes,
+		InstanceTemplate:            instanceTmpl,
+		RequirePort:                 strings.TrimSpace(requirePort),
+		ReachabilityCheck:           reachability,
+		IngressRequireBackend:       requireBackend,
+		IngressServiceRecords:       ingressSRV,
+		PodHostnames:                podHostnames,
+		IngressInstanceName:         ingressInstance,
+		IngressRequireReady:         requireReady,
+		IngressAddressPreference:    ingressPreference,
+		ReverseOnly:                 !forwardRecords,
+		ReverseConflict:             reverseConflict,
+		SkipLocalIPv6Reverse:        skipLocalReverse,
+		Debounce:                    debounce,
+		DeleteGrace:                 deleteGrace,
+		Zone:                        zone,
+	}
+	if nat64Prefix != "" {
+		_, prefix, err := net.ParseCIDR(nat64Prefix)
+		if err != nil || prefix.IP.To4() != nil {
+			log.Fatalf("Invalid NAT64 prefix: %q", nat64Prefix)
+		}
+		switch ones, _ := prefix.Mask.Size(); ones {
+		case 32, 40, 48, 56, 64, 96:
+		default:
+			log.Fatalf("Invalid NAT64 prefix length: %d", ones)
+		}
+		sourceConfig.NAT64Prefix = prefix
+	}
+	for _, key := range strings.Split(labelsToTXT, ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			sourceConfig.LabelsToTXT = append(sourceConfig.LabelsToTXT, key)
+		}
+	}
+	if reachability != source.ReachabilityOff {
+		sourceConfig.LocalSubnets, err = localSubnets()
+		if err != nil {
+			log.Fatalln("Failed to determine local subnets:", err)
+		}
+		if reachableRoutes {
+			routed, err := routedSubnets()
+			if err != nil {
+				log.Fatalln("Failed to read routes:", err)
+			}
+			sourceConfig.LocalSubnets = append(sourceConfig.LocalSubnets, routed...)
+		}
+	}
+
+	if validate {
+		invalid, err := validateObjects(k8sClient, sourceConfig)
+		if err != nil {
+			log.Fatalln("Failed to list objects:", err)
+		}
+		if invalid > 0 {
+			fmt.Printf("%d invalid objects\n", invalid)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	for _, subnet := range reverseZones {
+		advertise(resource.Resource{
+			SourceType: "reverse-zone",
+			Action:     resource.Added,
+			Records:    source.BuildBrowsingDomainRecords(subnet),
+		})
+	}
+
+	if selfName != "" {
+		if err := advertiseSelf(selfName, sourceConfig); err != nil {
+			log.Fatalln("Failed to determine primary address:", err)
+		}
+	}
+
 	factory := informers.NewSharedInformerFactory(k8sClient, 0)
+	var controllers []controller
+	var controllerNames []string
 	for _, src := range sourceFlag {
 		switch src {
 		case "ingress":
-			ingressController := source.NewIngressWatcher(factory, namespace, notifyMdns)
-			go ingressController.Run(stopper)
+			controllers = append(controllers, source.NewIngressWatcher(factory, sourceConfig, notifyMdns))
 		case "service":
-			serviceController := source.NewServicesWatcher(factory, publishAll, notifyMdns)
-			go serviceController.Run(stopper)
+			controllers = append(controllers, source.NewServicesWatcher(factory, sourceConfig, notifyMdns))
+		case "endpoints":
+			controllers = append(controllers, source.NewEndpointsWatcher(factory, sourceConfig, notifyMdns))
+		default:
+			continue
 		}
+		controllerNames = append(controllerNames, src)
+	}
+	factory.Start(stopper)
+
+	// Hold back all events until every source has synchronized, so that the
+	// initial state is complete before anything gets announced. The informers
+	// queue the events meanwhile. A source that cannot synchronize, e.g. for
+	// lack of permissions, holds back the others until -sync-timeout only.
+	synced := make(chan string, len(controllers))
+	for i, c := range controllers {
+		go func(name string, c controller) {
+			c.Run(stopper)
+			synced <- name
+		}(controllerNames[i], c)
+	}
+	waitForSources(controllerNames, synced, syncTimeout)
+	go monitorConnection(k8sClient, apiCheckInterval, stopper)
+
+	// Periodically rebuild the records of all sources to recover from missed
+	// events, then bring the zone in line with the result
+	reconciled := make(chan struct{})
+	if reconcileInterval > 0 {
+		go func() {
+			ticker := time.NewTicker(reconcileInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					for _, c := range controllers {
+						c.Reconcile()
+					}
+					reconciled <- struct{}{}
+				case <-stopper:
+					return
+				}
+			}
+		}()
+	}
+
+	// Added records are held back during quiet hours
+	deferred := &deferral{hours: &quiet}
+	var quietTick <-chan time.Time
+	if quiet.set {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		quietTick = ticker.C
+	}
+
+	var zoneExport <-chan time.Time
+	if exportZone != "" {
+		ticker := time.NewTicker(exportZoneEvery)
+		defer ticker.Stop()
+		zoneExport = ticker.C
 	}
 
 	for {
 		select {
-		case advertiseResource := <-notifyMdns:
-			for _, record := range advertiseResource.Records {
-				record.Header().Ttl = uint32(recordTTL)
-				record.Header().Class = dns.ClassINET
-				switch advertiseResource.Action {
-				case resource.Added:
-					mdns.Publish(record)
-				case resource.Deleted:
-					mdns.UnPublish(record)
-				}
+		case <-zoneExport:
+			// Shared records are only listed once
+			var records []dns.RR
+			for _, published := range advertised {
+				records = append(records, published[0])
+			}
+			if err := export.WriteZoneFile(exportZone, records); err != nil {
+				log.Println("Failed to export zone file:", err)
 			}
+		case advertiseResource := <-notifyMdns:
+			deferred.handle(advertiseResource, time.Now())
+		case now := <-quietTick:
+			deferred.tick(now)
+		case <-reconciled:
+			resync()
 		case <-stopper:
 			fmt.Println("Stopping program")
 		}
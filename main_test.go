@@ -0,0 +1,530 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/blake/external-mdns/publish"
+	"github.com/blake/external-mdns/resource"
+	"github.com/blake/external-mdns/source"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// recordingPublisher records the records published and withdrawn
+type recordingPublisher struct {
+	published []string
+	withdrawn []string
+}
+
+var _ publish.Publisher = &recordingPublisher{}
+
+func (p *recordingPublisher) Publish(rr dns.RR) error {
+	p.published = append(p.published, rr.String())
+	return nil
+}
+
+func (p *recordingPublisher) UnPublish(rr dns.RR) error {
+	p.withdrawn = append(p.withdrawn, rr.String())
+	return nil
+}
+
+// testPublisher makes advertise publish to a recordingPublisher with an empty
+// zone until the test ends
+func testPublisher(t *testing.T) *recordingPublisher {
+	p := &recordingPublisher{}
+	oldPublisher, oldAdvertised, oldPublished, oldWithdrawn := publisher, advertised, recordsPublished, recordsWithdrawn
+	publisher = p
+	advertised = map[string][]dns.RR{}
+	recordsPublished, recordsWithdrawn = newRecordCounters()
+	t.Cleanup(func() {
+		publisher, advertised, recordsPublished, recordsWithdrawn = oldPublisher, oldAdvertised, oldPublished, oldWithdrawn
+	})
+	return p
+}
+
+// advertiseAll advertises the notifications sent to notify until there are
+// none for a while
+func advertiseAll(notify <-chan resource.Resource) int {
+	n := 0
+	for {
+		select {
+		case res := <-notify:
+			advertise(res)
+			n++
+		case <-time.After(200 * time.Millisecond):
+			return n
+		}
+	}
+}
+
+func TestAdvertiseLeavesRecordsUntouched(t *testing.T) {
+	testPublisher(t)
+	rr, err := dns.NewRR("web.default.local. 0 A 10.0.0.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr.Header().Class = 0
+
+	advertise(resource.Resource{SourceType: "service", Action: resource.Added, Records: []dns.RR{rr}})
+	if rr.Header().Ttl != 0 || rr.Header().Class != 0 {
+		t.Errorf("advertise() changed the record of the source to %s", rr)
+	}
+}
+
+func TestAdvertiseUnchangedObject(t *testing.T) {
+	p := testPublisher(t)
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			Annotations: map[string]string{"external-mdns.blake.github.io/publish": "true"},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:       corev1.ServiceTypeClusterIP,
+			ClusterIP:  "10.0.0.10",
+			ClusterIPs: []string{"10.0.0.10"},
+			Ports:      []corev1.ServicePort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}},
+		},
+	}
+	client := fake.NewSimpleClientset(service)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	notify := make(chan resource.Resource)
+	s := source.NewServicesWatcher(factory, source.Config{ReverseConflict: source.ReverseConflictAll}, notify)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	s.Run(stop)
+	if n := advertiseAll(notify); n == 0 || len(p.published) == 0 {
+		t.Fatal("the records of the service were not published")
+	}
+
+	// Rebuilding the records of the unchanged service changes nothing
+	go s.Reconcile()
+	if n := advertiseAll(notify); n != 0 {
+		t.Errorf("got %d notifications for the unchanged service, want none", n)
+	}
+	if len(p.withdrawn) != 0 {
+		t.Errorf("withdrew %v, want nothing withdrawn", p.withdrawn)
+	}
+}
+
+func TestAdvertiseMaxTotalRecords(t *testing.T) {
+	p := testPublisher(t)
+	oldMax := maxTotalRecords
+	maxTotalRecords = 1
+	t.Cleanup(func() { maxTotalRecords = oldMax; rejected = map[string]map[string]int{} })
+
+	parse := func(s string) []dns.RR {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr.Header().Class = 0
+		return []dns.RR{rr}
+	}
+	a := resource.Resource{SourceType: "service", Namespace: "default", Name: "a"}
+	b := resource.Resource{SourceType: "service", Namespace: "default", Name: "b"}
+	update := func(res resource.Resource, action string, s string) {
+		res.Action = action
+		res.Records = parse(s)
+		advertise(res)
+	}
+
+	update(a, resource.Added, "a.local. 0 A 10.0.0.1")
+	update(a, resource.Added, "shared.local. 0 A 10.0.0.2")
+	if len(p.published) != 1 {
+		t.Fatalf("published %v, want the record beyond the limit rejected", p.published)
+	}
+
+	// Once there is room, another object publishes the rejected record,
+	// which the first object withdrawing it must not remove
+	update(a, resource.Deleted, "a.local. 0 A 10.0.0.1")
+	update(b, resource.Added, "shared.local. 0 A 10.0.0.2")
+	update(a, resource.Deleted, "shared.local. 0 A 10.0.0.2")
+	if len(p.withdrawn) != 1 {
+		t.Errorf("withdrew %v, want only the record of a.local withdrawn", p.withdrawn)
+	}
+	if len(advertised) != 1 {
+		t.Errorf("advertised %v, want the record of the second object", advertised)
+	}
+
+	update(b, resource.Deleted, "shared.local. 0 A 10.0.0.2")
+	if len(p.withdrawn) != 2 || len(advertised) != 0 {
+		t.Errorf("withdrew %v, advertised %v, want the record of the second object withdrawn", p.withdrawn, advertised)
+	}
+}
+
+func TestAdvertiseRecordTTLs(t *testing.T) {
+	p := testPublisher(t)
+	oldTTLs := []int{recordTTL, srvTTL, txtTTL, ptrTTL}
+	recordTTL, srvTTL, txtTTL, ptrTTL = 120, 300, 600, 900
+	t.Cleanup(func() { recordTTL, srvTTL, txtTTL, ptrTTL = oldTTLs[0], oldTTLs[1], oldTTLs[2], oldTTLs[3] })
+
+	tests := []struct {
+		record string
+		want   uint32
+	}{
+		{record: "web.default.local. 0 A 10.0.0.10", want: 120},
+		{record: "web._http._tcp.local. 0 SRV 0 0 80 web.default.local.", want: 300},
+		{record: `web._http._tcp.local. 0 TXT "path=/"`, want: 600},
+		{record: "_http._tcp.local. 0 PTR web._http._tcp.local.", want: 900},
+		{record: "10.0.0.10.in-addr.arpa. 0 PTR web.default.local.", want: 900},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.record, func(t *testing.T) {
+			rr, err := dns.NewRR(tt.record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr.Header().Class = 0
+			p.published = nil
+
+			advertise(resource.Resource{SourceType: "service", Namespace: "default", Name: "web", Action: resource.Added, Records: []dns.RR{rr}})
+			if len(p.published) != 1 {
+				t.Fatalf("published %v, want the record", p.published)
+			}
+			published, err := dns.NewRR(p.published[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if published.Header().Ttl != tt.want {
+				t.Errorf("published %s, want TTL %d", published, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckTTLs(t *testing.T) {
+	oldTTLs := []int{recordTTL, srvTTL, txtTTL, ptrTTL, sharedTTL}
+	t.Cleanup(func() {
+		recordTTL, srvTTL, txtTTL, ptrTTL, sharedTTL = oldTTLs[0], oldTTLs[1], oldTTLs[2], oldTTLs[3], oldTTLs[4]
+	})
+
+	tests := []struct {
+		name    string
+		ttls    []int // record, SRV, TXT, PTR and shared record TTL
+		wantErr bool
+	}{
+		{name: "defaults", ttls: []int{120, 0, 0, 0, 0}},
+		{name: "overrides", ttls: []int{120, 300, 600, 900, 30}},
+		{name: "record TTL 0", ttls: []int{0, 300, 600, 900, 30}, wantErr: true},
+		{name: "negative record TTL", ttls: []int{-1, 0, 0, 0, 0}, wantErr: true},
+		{name: "negative SRV TTL", ttls: []int{120, -1, 0, 0, 0}, wantErr: true},
+		{name: "negative shared record TTL", ttls: []int{120, 0, 0, 0, -1}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recordTTL, srvTTL, txtTTL, ptrTTL, sharedTTL = tt.ttls[0], tt.ttls[1], tt.ttls[2], tt.ttls[3], tt.ttls[4]
+			if err := checkTTLs(); (err != nil) != tt.wantErr {
+				t.Errorf("checkTTLs() = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAdvertiseSharedTTL(t *testing.T) {
+	p := testPublisher(t)
+	oldTTLs := []int{recordTTL, ptrTTL, sharedTTL}
+	recordTTL, ptrTTL, sharedTTL = 120, 0, 30
+	t.Cleanup(func() { recordTTL, ptrTTL, sharedTTL = oldTTLs[0], oldTTLs[1], oldTTLs[2] })
+
+	tests := []struct {
+		record string
+		want   uint32
+	}{
+		{record: "web.default.local. 0 A 10.0.0.10", want: 120},
+		{record: "_http._tcp.local. 0 PTR web._http._tcp.local.", want: 30},
+		{record: "10.0.0.10.in-addr.arpa. 0 PTR web.default.local.", want: 120},
+		{record: "A.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.D.F.IP6.ARPA. 0 PTR web.default.local.", want: 120},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.record, func(t *testing.T) {
+			rr, err := dns.NewRR(tt.record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.published = nil
+
+			advertise(resource.Resource{SourceType: "service", Namespace: "default", Name: "web", Action: resource.Added, Records: []dns.RR{rr}})
+			if len(p.published) != 1 {
+				t.Fatalf("published %v, want the record", p.published)
+			}
+			published, err := dns.NewRR(p.published[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if published.Header().Ttl != tt.want {
+				t.Errorf("published %s, want TTL %d", published, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdvertiseNamespaceTTLs(t *testing.T) {
+	p := testPublisher(t)
+	oldTTLs, oldNamespaceTTLs := []int{recordTTL, srvTTL}, namespaceTTLs
+	recordTTL, srvTTL = 120, 600
+	namespaceTTLs = nil
+	t.Cleanup(func() { recordTTL, srvTTL, namespaceTTLs = oldTTLs[0], oldTTLs[1], oldNamespaceTTLs })
+	if err := namespaceTTLs.Set("prod=300,dev=30"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		namespace string
+		record    string
+		want      uint32
+	}{
+		{namespace: "prod", record: "web.prod.local. 0 A 10.0.0.10", want: 300},
+		{namespace: "dev", record: "web.dev.local. 0 A 10.0.0.10", want: 30},
+		{namespace: "default", record: "web.default.local. 0 A 10.0.0.10", want: 120},
+		// Per type TTLs take precedence
+		{namespace: "dev", record: "web._http._tcp.local. 0 SRV 0 0 80 web.dev.local.", want: 600},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.namespace+" "+tt.record, func(t *testing.T) {
+			rr, err := dns.NewRR(tt.record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p.published = nil
+
+			advertise(resource.Resource{SourceType: "service", Namespace: tt.namespace, Name: "web", Action: resource.Added, Records: []dns.RR{rr}})
+			if len(p.published) != 1 {
+				t.Fatalf("published %v, want the record", p.published)
+			}
+			published, err := dns.NewRR(p.published[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if published.Header().Ttl != tt.want {
+				t.Errorf("published %s, want TTL %d", published, tt.want)
+			}
+		})
+	}
+}
+
+func TestNamespaceTTLMapSet(t *testing.T) {
+	for _, value := range []string{"prod", "=300", "prod=0", "prod=-1", "prod=short", "prod=300,dev"} {
+		var n namespaceTTLMap
+		if err := n.Set(value); err == nil {
+			t.Errorf("Set(%q) accepted %v, want an error", value, n)
+		}
+	}
+}
+
+func TestNamespaceDomainMapSet(t *testing.T) {
+	var n namespaceDomainMap
+	if err := n.Set("prod=prod.local,dev=.dev.local."); err != nil {
+		t.Fatal(err)
+	}
+	if want := (namespaceDomainMap{"prod": "prod.local.", "dev": "dev.local."}); !reflect.DeepEqual(n, want) {
+		t.Errorf("domains = %v, want %v", n, want)
+	}
+
+	for _, value := range []string{"prod", "=prod.local", "prod=", "prod=.", "prod=prod.local,dev"} {
+		var n namespaceDomainMap
+		if err := n.Set(value); err == nil {
+			t.Errorf("Set(%q) accepted %v, want an error", value, n)
+		}
+	}
+}
+
+func TestAdvertiseRecordClass(t *testing.T) {
+	p := testPublisher(t)
+	oldClass, oldClassValue := recordClass, recordClassValue
+	t.Cleanup(func() { recordClass, recordClassValue = oldClass, oldClassValue })
+
+	tests := []struct {
+		recordClass string
+		classValue  uint16
+		sourceClass uint16
+		want        uint16
+	}{
+		{recordClass: "IN", classValue: dns.ClassINET, want: dns.ClassINET},
+		{recordClass: "CH", classValue: dns.ClassCHAOS, want: dns.ClassCHAOS},
+		{recordClass: "CH", classValue: dns.ClassCHAOS, sourceClass: dns.ClassHESIOD, want: dns.ClassCHAOS},
+		{recordClass: "preserve", classValue: dns.ClassINET, sourceClass: dns.ClassCHAOS, want: dns.ClassCHAOS},
+		{recordClass: "preserve", classValue: dns.ClassINET, want: dns.ClassINET},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.recordClass+" "+dns.Class(tt.sourceClass).String(), func(t *testing.T) {
+			recordClass, recordClassValue = tt.recordClass, tt.classValue
+			rr, err := dns.NewRR("web.default.local. 0 A 10.0.0.10")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr.Header().Class = tt.sourceClass
+			p.published = nil
+
+			advertise(resource.Resource{SourceType: "service", Namespace: "default", Name: "web", Action: resource.Added, Records: []dns.RR{rr}})
+			// Withdraw it again, so that the next case publishes it anew
+			advertise(resource.Resource{SourceType: "service", Namespace: "default", Name: "web", Action: resource.Deleted, Records: []dns.RR{rr}})
+			if len(p.published) != 1 {
+				t.Fatalf("published %v, want the record", p.published)
+			}
+			published, err := dns.NewRR(p.published[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if published.Header().Class != tt.want {
+				t.Errorf("published %s, want class %s", published, dns.Class(tt.want))
+			}
+		})
+	}
+}
+
+func TestAdvertiseDetailedMetrics(t *testing.T) {
+	oldDetailed := detailedMetrics
+	t.Cleanup(func() { detailedMetrics = oldDetailed })
+
+	tests := []struct {
+		detailed  bool
+		labels    map[string][]string
+		published map[string]float64
+		withdrawn map[string]float64
+	}{
+		{
+			// Both objects share the same time series
+			detailed:  false,
+			labels:    map[string][]string{"web": {"service", "A"}, "api": {"service", "A"}},
+			published: map[string]float64{"web": 2, "api": 2},
+			withdrawn: map[string]float64{"web": 1, "api": 1},
+		},
+		{
+			detailed:  true,
+			labels:    map[string][]string{"web": {"service", "A", "default", "web"}, "api": {"service", "A", "default", "api"}},
+			published: map[string]float64{"web": 1, "api": 1},
+			withdrawn: map[string]float64{"web": 1, "api": 0},
+		},
+	}
+
+	for _, tt := range tests {
+		detailedMetrics = tt.detailed
+		testPublisher(t)
+		records := map[string]dns.RR{}
+		for i, name := range []string{"web", "api"} {
+			rr, err := dns.NewRR(fmt.Sprintf("%s.default.local. 0 A 10.0.0.%d", name, 10+i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			records[name] = rr
+			advertise(resource.Resource{SourceType: "service", Namespace: "default", Name: name, Action: resource.Added, Records: []dns.RR{rr}})
+		}
+		advertise(resource.Resource{SourceType: "service", Namespace: "default", Name: "web", Action: resource.Deleted, Records: []dns.RR{records["web"]}})
+
+		for name, labels := range tt.labels {
+			if got := testutil.ToFloat64(recordsPublished.WithLabelValues(labels...)); got != tt.published[name] {
+				t.Errorf("detailed %t: published %v records of %s, want %v", tt.detailed, got, name, tt.published[name])
+			}
+			if got := testutil.ToFloat64(recordsWithdrawn.WithLabelValues(labels...)); got != tt.withdrawn[name] {
+				t.Errorf("detailed %t: withdrawn %v records of %s, want %v", tt.detailed, got, name, tt.withdrawn[name])
+			}
+		}
+	}
+}
+
+func TestAdvertiseSelf(t *testing.T) {
+	oldAddrs, oldRoute := interfaceAddrs, defaultRouteAddress
+	t.Cleanup(func() { interfaceAddrs, defaultRouteAddress = oldAddrs, oldRoute })
+
+	subnet := func(s string) net.Addr {
+		ip, subnet, err := net.ParseCIDR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		subnet.IP = ip
+		return subnet
+	}
+	noRoute := func() (net.IP, error) { return nil, errors.New("network is unreachable") }
+
+	tests := []struct {
+		name    string
+		route   func() (net.IP, error)
+		addrs   []net.Addr
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:  "default route",
+			route: func() (net.IP, error) { return net.ParseIP("192.168.1.5"), nil },
+			addrs: []net.Addr{subnet("10.0.0.5/8"), subnet("192.168.1.5/24")},
+			want: []string{
+				"gateway.local.\t120\tIN\tA\t192.168.1.5",
+				"5.1.168.192.in-addr.arpa.\t120\tIN\tPTR\tgateway.local.",
+			},
+		},
+		{
+			name:  "first interface",
+			route: noRoute,
+			addrs: []net.Addr{subnet("10.0.0.5/8"), subnet("192.168.1.5/24")},
+			want: []string{
+				"gateway.local.\t120\tIN\tA\t10.0.0.5",
+				"5.0.0.10.in-addr.arpa.\t120\tIN\tPTR\tgateway.local.",
+			},
+		},
+		{
+			name:  "IPv6 interface",
+			route: noRoute,
+			addrs: []net.Addr{subnet("2001:db8::5/64")},
+			want: []string{
+				"gateway.local.\t120\tIN\tAAAA\t2001:db8::5",
+				"5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.\t120\tIN\tPTR\tgateway.local.",
+			},
+		},
+		{
+			name:    "no interface",
+			route:   noRoute,
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := testPublisher(t)
+			defaultRouteAddress = tt.route
+			interfaceAddrs = func() ([]net.Addr, error) { return tt.addrs, nil }
+
+			err := advertiseSelf("gateway", source.Config{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("advertiseSelf() error = %v, want error %v", err, tt.wantErr)
+			}
+			sort.Strings(p.published)
+			want := append([]string(nil), tt.want...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(p.published, want) {
+				t.Errorf("published %q, want %q", p.published, want)
+			}
+		})
+	}
+}
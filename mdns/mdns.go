@@ -3,13 +3,20 @@ package mdns
 // Advertise network services via multicast DNS
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"math/rand"
 	"net"
+	"strings"
+	"time"
 
 	"reflect"
+	"sync"
 
 	"github.com/miekg/dns"
 	"github.com/mitchellh/copystructure"
+	"golang.org/x/time/rate"
 )
 
 var (
@@ -23,40 +30,225 @@ var (
 		Port: 5353,
 	}
 	local *zone // the local mdns zone
+
+	connectors []*connector // connections the responder listens on
+	connMutex  sync.Mutex
+
+	// announcements of reverse PTR records are throttled separately, so that
+	// they cannot delay the forward records
+	forwardThrottle = newThrottle(0, 0)
+	reverseThrottle = newThrottle(0, 0)
+
+	announceCount = 2 // number of times new records are announced
+
+	sleep = time.Sleep // waits between repeated announcements, replaced by tests
+
+	withdrawnNSEC time.Duration // how long withdrawn names are answered with NSEC
+
+	responseDelay time.Duration // window to coalesce queries in
+
+	unicastResponses = false // answer QU questions by unicast
+
+	suppressRecent = false // do not answer with records multicast recently
 )
 
-func init() {
-	local = &zone{
-		entries: make(map[string]entries),
-		op:      make(chan operation),
-		queries: make(chan *query, 16),
+// throttle limits the rate of announcements and delays each by a random jitter
+type throttle struct {
+	limiter *rate.Limiter
+	jitter  time.Duration
+}
+
+func newThrottle(interval time.Duration, jitter time.Duration) *throttle {
+	limit := rate.Inf
+	if interval > 0 {
+		limit = rate.Every(interval)
+	}
+	return &throttle{
+		limiter: rate.NewLimiter(limit, 1),
+		jitter:  jitter,
+	}
+}
+
+func (t *throttle) wait() {
+	if t.jitter > 0 {
+		time.Sleep(time.Duration(rand.Int63n(int64(t.jitter))))
 	}
+	t.limiter.Wait(context.Background())
+}
+
+// SetAnnounceThrottle limits announcements and goodbyes to one per interval
+// (unlimited if 0), each delayed by up to jitter. Reverse PTR records use
+// the ptr settings, all other records the forward settings. It must be called
+// before anything is announced.
+func SetAnnounceThrottle(forwardInterval, forwardJitter, ptrInterval, ptrJitter time.Duration) {
+	forwardThrottle = newThrottle(forwardInterval, forwardJitter)
+	reverseThrottle = newThrottle(ptrInterval, ptrJitter)
+}
+
+// throttleFor returns the throttle for announcing rr
+func throttleFor(rr dns.RR) *throttle {
+	name := strings.ToLower(rr.Header().Name)
+	if rr.Header().Rrtype == dns.TypePTR && (strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.")) {
+		return reverseThrottle
+	}
+	return forwardThrottle
+}
+
+func init() {
+	local = newZone()
 	go local.mainloop()
-	if err := local.listen(ipv4mcastaddr); err != nil {
-		log.Fatalf("Failed to listen %s: %s", ipv4mcastaddr, err)
+}
+
+// Listen starts answering queries for the published records on the mDNS
+// multicast group, joined on each of the given interfaces, or on the system's
+// default multicast interface if there are none. Records can be published
+// without listening, e.g. when they are only exported to another responder.
+func Listen(ifaces []*net.Interface) error {
+	if len(ifaces) == 0 {
+		ifaces = []*net.Interface{nil}
+	}
+	for _, iface := range ifaces {
+		if err := local.listen(ipv4mcastaddr, iface); err != nil {
+			if iface != nil {
+				return fmt.Errorf("failed to listen %s on %s: %s", ipv4mcastaddr, iface.Name, err)
+			}
+			return fmt.Errorf("failed to listen %s: %s", ipv4mcastaddr, err)
+		}
 	}
 	// TODO re-enable IPV6 with better error handling
 	//if err := local.listen(ipv6mcastaddr); err != nil {
 	//	log.Printf("Failed to listen %s: %s", ipv6mcastaddr, err)
 	//}
+	return nil
 }
 
 // Publish adds a record, describewrite tod in RFC XXX
 func Publish(rr dns.RR) {
 	log.Printf("Add %s\n", rr)
-	local.op <- operation{"add", &entry{rr}}
+	local.op <- operation{"add", &entry{rr}, nil}
 }
 
 // UnPublish removes mDNS advertisement for the given record
 func UnPublish(rr dns.RR) {
 	log.Printf("Del %s\n", rr)
-	local.op <- operation{"del", &entry{rr}}
+	local.op <- operation{"del", &entry{rr}, nil}
+}
+
+// SendResult is the outcome of sending a message on one connection
+type SendResult struct {
+	Addr net.Addr // local address of the connection
+	Err  error
+}
+
+// PublishAsync adds a record like Publish and announces it with an
+// unsolicited response on every connection the responder listens on, as many
+// times as set by SetAnnounceCount. The returned channel receives one
+// SendResult per connection and announcement and is closed once all
+// announcements have been sent.
+func PublishAsync(rr dns.RR) <-chan SendResult {
+	Publish(rr)
+	return announce(dns.Copy(rr), announceCount)
+}
+
+// SetAnnounceCount sets how many times PublishAsync announces each record,
+// with the interval between announcements starting at one second and
+// doubling each time (RFC 6762, section 8.3). The default is 2.
+func SetAnnounceCount(count int) {
+	announceCount = count
+}
+
+// SetWithdrawnNSEC makes the responder answer queries for a name whose records
+// have all been withdrawn with an NSEC record asserting that the name has no
+// records (RFC 6762, section 6.1), for duration after the withdrawal. This
+// lets clients which missed the goodbye notice the removal before their cached
+// records expire. It is disabled by default and must be called before anything
+// is published.
+func SetWithdrawnNSEC(duration time.Duration) {
+	withdrawnNSEC = duration
+}
+
+// SetResponseDelay makes the responder collect the queries arriving within
+// delay of the first one and answer them with a single response, answering
+// each distinct question once. This reduces multicast traffic when many
+// clients ask for the same names at once. It is disabled by default and must
+// be called before Listen.
+func SetResponseDelay(delay time.Duration) {
+	responseDelay = delay
+}
+
+// SetUnicastResponses makes the responder answer queries whose questions all
+// have the unicast-response bit set by unicast to the querier (RFC 6762,
+// section 5.4). If the unicast response cannot be sent, it is multicast
+// instead, so that the answer still reaches the querier. Queries of several
+// queriers coalesced by the response delay are always answered by multicast.
+// By default all responses are multicast. It must be called before Listen.
+func SetUnicastResponses(enabled bool) {
+	unicastResponses = enabled
+}
+
+// SetSuppressRecent makes the responder leave out records from its responses
+// which it multicast on the same connection within the last quarter of their
+// TTL, as the queriers have most likely received them already (RFC 6762,
+// sections 5.4 and 7.1). This also applies to announcements, but not to
+// unicast responses. It is disabled by default and must be called before
+// Listen.
+func SetSuppressRecent(enabled bool) {
+	suppressRecent = enabled
+}
+
+// UnPublishAsync removes a record like UnPublish and sends a goodbye (the
+// record with a TTL of zero) on every connection the responder listens on.
+// The returned channel reports the outcome like PublishAsync.
+func UnPublishAsync(rr dns.RR) <-chan SendResult {
+	UnPublish(rr)
+	goodbye := dns.Copy(rr)
+	goodbye.Header().Ttl = 0
+	return announce(goodbye, 1)
+}
+
+func announce(rr dns.RR, count int) <-chan SendResult {
+	connMutex.Lock()
+	conns := append([]*connector{}, connectors...)
+	connMutex.Unlock()
+
+	results := make(chan SendResult, len(conns)*count)
+	go func() {
+		defer close(results)
+		// Set Cache-Flush bit
+		rr.Header().Class = rr.Header().Class | 0x8000
+		msg := &dns.Msg{
+			MsgHdr: dns.MsgHdr{Response: true, Authoritative: true},
+			Answer: []dns.RR{rr},
+		}
+		interval := time.Second
+		for n := 0; n < count; n++ {
+			if n > 0 {
+				sleep(interval)
+				interval *= 2
+			}
+			throttleFor(rr).wait()
+			for _, c := range conns {
+				results <- SendResult{
+					Addr: c.LocalAddr(),
+					Err:  c.writeMessage(msg, c.UDPAddr),
+				}
+			}
+		}
+	}()
+	return results
 }
 
 // Clear removes all entries from advertisement
 func Clear() {
 	log.Printf("Clear\n")
-	local.op <- operation{"clr", nil}
+	local.op <- operation{"clr", nil, nil}
+}
+
+// Sync replaces the advertised records with records, which must contain each
+// record once for every time it should have been published. Records that
+// differ from the current advertisement are logged.
+func Sync(records []dns.RR) {
+	local.op <- operation{"sync", nil, records}
 }
 
 type entry struct {
@@ -84,14 +276,57 @@ func (e entries) contains(entry *entry) int {
 }
 
 type operation struct {
-	op string // one of add, del, clr
+	op string // one of add, del, clr, sync
 	*entry
+	records []dns.RR // desired records for sync
 }
 
 type zone struct {
-	entries map[string]entries
-	op      chan operation
-	queries chan *query // query existing entries in zone
+	entries   map[string]entries
+	refs      map[string]int // number of times each entry was published
+	withdrawn map[string]*withdrawal
+	op        chan operation
+	queries   chan *query // query existing entries in zone
+}
+
+func newZone() *zone {
+	return &zone{
+		entries:   make(map[string]entries),
+		refs:      make(map[string]int),
+		withdrawn: make(map[string]*withdrawal),
+		op:        make(chan operation),
+		queries:   make(chan *query, 16),
+	}
+}
+
+// withdrawal is a name whose records have all been withdrawn, answered with
+// nsec until expires
+type withdrawal struct {
+	nsec    *entry
+	expires time.Time
+}
+
+// withdraw remembers that the last record of the name of e was withdrawn
+func (z *zone) withdraw(e *entry) {
+	now := time.Now()
+	for name, w := range z.withdrawn {
+		if now.After(w.expires) {
+			delete(z.withdrawn, name)
+		}
+	}
+	if withdrawnNSEC <= 0 {
+		return
+	}
+	nsec := &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   e.fqdn(),
+			Rrtype: dns.TypeNSEC,
+			Class:  e.Header().Class &^ 0x8000,
+			Ttl:    e.Header().Ttl,
+		},
+		NextDomain: e.fqdn(),
+	}
+	z.withdrawn[e.fqdn()] = &withdrawal{&entry{nsec}, now.Add(withdrawnNSEC)}
 }
 
 func (z *zone) mainloop() {
@@ -101,16 +336,25 @@ func (z *zone) mainloop() {
 			entry := op.entry
 			switch op.op {
 			case "add":
+				z.refs[entry.String()]++
+				delete(z.withdrawn, entry.fqdn())
 				if z.entries[entry.fqdn()].contains(entry) == -1 {
 					z.entries[entry.fqdn()] = append(z.entries[entry.fqdn()], entry)
 				}
 			case "del":
+				// Records shared by several resources are only removed
+				// once the last of them is withdrawn
+				if z.refs[entry.String()]--; z.refs[entry.String()] > 0 {
+					continue
+				}
+				delete(z.refs, entry.String())
 				entries := z.entries[entry.fqdn()]
 				idx := z.entries[entry.fqdn()].contains(entry)
 				if idx != -1 {
 					numEntries := len(entries)
 					if numEntries == 1 {
 						delete(z.entries, entry.fqdn())
+						z.withdraw(entry)
 					} else {
 						// Copy last element to index idx
 						entries[idx] = entries[numEntries-1]
@@ -122,18 +366,71 @@ func (z *zone) mainloop() {
 				}
 			case "clr":
 				z.entries = make(map[string]entries)
+				z.refs = make(map[string]int)
+				z.withdrawn = make(map[string]*withdrawal)
+			case "sync":
+				z.sync(op.records)
 			}
 		case q := <-z.queries:
-			for _, entry := range z.entries[q.Question.Name] {
+			entries, ok := z.entries[q.Question.Name]
+			if !ok {
+				entries = z.wildcard(q.Question.Name)
+			}
+			for _, entry := range entries {
 				if q.matches(entry) {
 					q.result <- entry
 				}
 			}
+			if w, ok := z.withdrawn[q.Question.Name]; ok && time.Now().Before(w.expires) {
+				q.result <- w.nsec
+			}
 			close(q.result)
 		}
 	}
 }
 
+// wildcard returns the entries of the closest wildcard name *.<domain> above
+// name, renamed to name, or nil if there is none (RFC 4592).
+func (z *zone) wildcard(name string) entries {
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		wildcards, ok := z.entries["*."+name[off:]]
+		if !ok {
+			continue
+		}
+		var synthesized entries
+		for _, e := range wildcards {
+			rr := dns.Copy(e.RR)
+			rr.Header().Name = name
+			synthesized = append(synthesized, &entry{rr})
+		}
+		return synthesized
+	}
+	return nil
+}
+
+func (z *zone) sync(records []dns.RR) {
+	refs := make(map[string]int)
+	entries := make(map[string]entries)
+	for _, rr := range records {
+		entry := &entry{rr}
+		if refs[entry.String()]++; refs[entry.String()] == 1 {
+			entries[entry.fqdn()] = append(entries[entry.fqdn()], entry)
+		}
+	}
+	for key := range refs {
+		if _, ok := z.refs[key]; !ok {
+			log.Printf("Reconcile add %s\n", key)
+		}
+	}
+	for key := range z.refs {
+		if _, ok := refs[key]; !ok {
+			log.Printf("Reconcile del %s\n", key)
+		}
+	}
+	z.entries = entries
+	z.refs = refs
+}
+
 func (z *zone) query(q dns.Question) (entries []*entry) {
 	res := make(chan *entry, 16)
 	z.queries <- &query{q, res}
@@ -148,18 +445,28 @@ func (z *zone) query(q dns.Question) (entries []*entry) {
 	return
 }
 
+// matches reports whether entry answers the question. Questions of type ANY
+// are answered with the records of every type of the name, e.g. its A, AAAA,
+// SRV and TXT records.
 func (q *query) matches(entry *entry) bool {
-	return q.Question.Qtype == dns.TypeANY || q.Question.Qtype == entry.RR.Header().Rrtype
+	// Ignore the unicast-response bit of the class, and the cache-flush bit
+	// of the record class
+	qclass := q.Question.Qclass &^ 0x8000
+	class := entry.RR.Header().Class &^ 0x8000
+	return (q.Question.Qtype == dns.TypeANY || q.Question.Qtype == entry.RR.Header().Rrtype) &&
+		(qclass == dns.ClassANY || qclass == class)
 }
 
 type connector struct {
 	*net.UDPAddr
 	*net.UDPConn
 	*zone
+	recent      map[string]time.Time // until when each record counts as recently multicast
+	recentMutex sync.Mutex
 }
 
-func (z *zone) listen(addr *net.UDPAddr) error {
-	conn, err := openSocket(addr)
+func (z *zone) listen(addr *net.UDPAddr, iface *net.Interface) error {
+	conn, err := openSocket(addr, iface)
 	if err != nil {
 		return err
 	}
@@ -167,21 +474,31 @@ func (z *zone) listen(addr *net.UDPAddr) error {
 		UDPAddr: addr,
 		UDPConn: conn,
 		zone:    z,
+		recent:  make(map[string]time.Time),
 	}
 	go c.mainloop()
 
+	connMutex.Lock()
+	connectors = append(connectors, c)
+	connMutex.Unlock()
+
 	return nil
 }
 
-func openSocket(addr *net.UDPAddr) (*net.UDPConn, error) {
+// openSocket joins the multicast group on iface, which is also used for
+// sending. If iface is nil, the system chooses the interface.
+func openSocket(addr *net.UDPAddr, iface *net.Interface) (*net.UDPConn, error) {
 	switch addr.IP.To4() {
 	case nil:
-		return net.ListenMulticastUDP("udp6", nil, ipv6mcastaddr)
+		return net.ListenMulticastUDP("udp6", iface, ipv6mcastaddr)
 	default:
-		return net.ListenMulticastUDP("udp4", nil, ipv4mcastaddr)
+		return net.ListenMulticastUDP("udp4", iface, ipv4mcastaddr)
 	}
 }
 
+// maxMessageSize is the size of the receive buffer
+const maxMessageSize = 4096
+
 type pkt struct {
 	*dns.Msg
 	*net.UDPAddr
@@ -192,7 +509,7 @@ func (c *connector) readloop(in chan pkt) {
 		msg, addr, err := c.readMessage()
 		if err != nil {
 			// log dud packets
-			log.Printf("Could not read from %s: %s", c.UDPConn, err)
+			log.Printf("Could not read from %v: %s", c.UDPConn, err)
 			continue
 		}
 		if len(msg.Question) > 0 {
@@ -206,36 +523,102 @@ func (c *connector) mainloop() {
 	go c.readloop(in)
 	for {
 		msg := <-in
+		countQuestions(queriesReceived, msg.Question)
+		shared := false // whether the questions come from several queriers
+		if responseDelay > 0 {
+			shared = c.coalesce(msg, in)
+		}
+		questions := msg.Question
+		// Answer EDNS0 queries in kind, with the size of our receive buffer
+		opt := msg.IsEdns0()
 		msg.MsgHdr.Response = true // convert question to response
 		msg.MsgHdr.Authoritative = true
 		msg.Answer = make([]dns.RR, 0) // some queries already have an answer, we should not answer them
+		msg.Ns = nil                   // known answers and probe records of the query
+		msg.Extra = nil                // including the OPT pseudo-record of the query
 		for _, result := range c.query(msg.Question) {
 			// Set Cache-Flush bit
 			result.RR.Header().Class = result.RR.Header().Class | 0x8000
 			msg.Answer = append(msg.Answer, result.RR)
 		}
+
+		addr := c.UDPAddr // the multicast group
+		// check unicast-response bit https://tools.ietf.org/html/rfc6762#section-5.4
+		if unicastResponses && !shared && unicastRequested(questions) {
+			addr = msg.UDPAddr
+		}
+		// A querier asking for a unicast response may not have received
+		// the recent multicast
+		if suppressRecent && addr == c.UDPAddr {
+			msg.Answer = c.withoutRecent(msg.Answer)
+		}
 		msg.Extra = append(msg.Extra, c.findExtra(msg.Answer...)...)
+		if opt != nil {
+			msg.SetEdns0(maxMessageSize, false)
+		}
 
 		if len(msg.Answer) > 0 {
-			addr := ipv4mcastaddr
-			// check unicast-response bit https://tools.ietf.org/html/rfc6762#section-5.4
-			//if msg.Question[0].Qclass & 32768 > 0 {
-			//	log.Println("using unicast")
-			//	addr = msg.UDPAddr
-			//}
-
 			// nuke questions
 			msg.Question = nil
 
-			msg.UDPAddr = addr
-
-			if err := c.writeMessage(msg.Msg, addr); err != nil {
+			err := c.writeMessage(msg.Msg, addr)
+			if err != nil && addr != c.UDPAddr {
+				log.Printf("Cannot send unicast response to %s, multicasting it instead: %s", addr, err)
+				err = c.writeMessage(msg.Msg, c.UDPAddr)
+			}
+			if err != nil {
 				log.Println("Cannot send: ", err)
+			} else {
+				countQuestions(responsesSent, questions)
 			}
 		}
 	}
 }
 
+// unicastRequested reports whether all questions have the unicast-response
+// bit set
+func unicastRequested(questions []dns.Question) bool {
+	for _, q := range questions {
+		if q.Qclass&0x8000 == 0 {
+			return false
+		}
+	}
+	return len(questions) > 0
+}
+
+// coalesce adds the distinct questions of the queries arriving within the
+// response delay to msg. It reports whether any of them came from another
+// querier than msg, in which case the response must be multicast to reach
+// them all.
+func (c *connector) coalesce(msg pkt, in chan pkt) (shared bool) {
+	seen := map[dns.Question]bool{}
+	for _, q := range msg.Question {
+		seen[q] = true
+	}
+	timeout := time.After(responseDelay)
+	for {
+		select {
+		case next := <-in:
+			countQuestions(queriesReceived, next.Question)
+			if next.UDPAddr.String() != msg.UDPAddr.String() {
+				shared = true
+			}
+			for _, q := range next.Question {
+				if !seen[q] {
+					seen[q] = true
+					msg.Question = append(msg.Question, q)
+				}
+			}
+			// Answer in kind if any query used EDNS0
+			if opt := next.IsEdns0(); opt != nil && msg.IsEdns0() == nil {
+				msg.Extra = append(msg.Extra, opt)
+			}
+		case <-timeout:
+			return shared
+		}
+	}
+}
+
 func (c *connector) query(qs []dns.Question) (results []*entry) {
 	for _, q := range qs {
 		results = append(results, c.zone.query(q)...)
@@ -253,13 +636,13 @@ func (c *connector) findExtra(r ...dns.RR) (extra []dns.RR) {
 			q = dns.Question{
 				Name:   rr.Ptr,
 				Qtype:  dns.TypeANY,
-				Qclass: dns.ClassINET,
+				Qclass: rr.Header().Class &^ 0x8000,
 			}
 		case *dns.SRV:
 			q = dns.Question{
 				Name:   rr.Target,
 				Qtype:  dns.TypeA,
-				Qclass: dns.ClassINET,
+				Qclass: rr.Header().Class &^ 0x8000,
 			}
 		default:
 			continue
@@ -274,6 +657,36 @@ func (c *connector) findExtra(r ...dns.RR) (extra []dns.RR) {
 	return
 }
 
+// withoutRecent returns the records which were not multicast recently
+func (c *connector) withoutRecent(records []dns.RR) []dns.RR {
+	c.recentMutex.Lock()
+	defer c.recentMutex.Unlock()
+	now := time.Now()
+	var result []dns.RR
+	for _, rr := range records {
+		if until, ok := c.recent[rr.String()]; ok && now.Before(until) {
+			continue
+		}
+		result = append(result, rr)
+	}
+	return result
+}
+
+// markRecent remembers the answers of msg as multicast now
+func (c *connector) markRecent(msg *dns.Msg) {
+	c.recentMutex.Lock()
+	defer c.recentMutex.Unlock()
+	now := time.Now()
+	for key, until := range c.recent {
+		if now.After(until) {
+			delete(c.recent, key)
+		}
+	}
+	for _, rr := range msg.Answer {
+		c.recent[rr.String()] = now.Add(time.Duration(rr.Header().Ttl) * time.Second / 4)
+	}
+}
+
 // encode an mdns msg and broadcast it on the wire
 func (c *connector) writeMessage(msg *dns.Msg, addr *net.UDPAddr) error {
 	buf, err := msg.Pack()
@@ -281,12 +694,15 @@ func (c *connector) writeMessage(msg *dns.Msg, addr *net.UDPAddr) error {
 		return err
 	}
 	_, err = c.WriteToUDP(buf, addr)
+	if err == nil && suppressRecent && addr == c.UDPAddr {
+		c.markRecent(msg)
+	}
 	return err
 }
 
 // consume an mdns packet from the wire and decode it
 func (c *connector) readMessage() (*dns.Msg, *net.UDPAddr, error) {
-	buf := make([]byte, 4096)
+	buf := make([]byte, maxMessageSize)
 	read, addr, err := c.ReadFromUDP(buf)
 	if err != nil {
 		return nil, nil, err
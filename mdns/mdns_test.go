@@ -0,0 +1,601 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mdns
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// listenLoopback returns a UDP socket on the loopback interface
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// testZone returns a running zone holding records
+func testZone(t *testing.T, records ...string) *zone {
+	t.Helper()
+	z := newZone()
+	go z.mainloop()
+	for _, s := range records {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		z.op <- operation{"add", &entry{rr}, nil}
+	}
+	return z
+}
+
+// testConnector starts a connector answering queries for z on a loopback
+// socket. Instead of the mDNS group, it multicasts to the returned socket.
+func testConnector(t *testing.T, z *zone) (*connector, *net.UDPConn) {
+	t.Helper()
+	group := listenLoopback(t)
+	t.Cleanup(func() { group.Close() })
+	// The socket of the connector is left open, as its read loop does not
+	// end when it is closed
+	c := &connector{
+		UDPAddr: group.LocalAddr().(*net.UDPAddr),
+		UDPConn: listenLoopback(t),
+		zone:    z,
+		recent:  make(map[string]time.Time),
+	}
+	go c.mainloop()
+	return c, group
+}
+
+// ask sends a query with questions from client to c
+func ask(t *testing.T, client *net.UDPConn, c *connector, questions ...dns.Question) {
+	t.Helper()
+	msg := &dns.Msg{Question: questions}
+	buf, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.WriteToUDP(buf, c.LocalAddr().(*net.UDPAddr)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readResponse returns the next message received on conn, or nil if there is
+// none within timeout
+func readResponse(t *testing.T, conn *net.UDPConn, timeout time.Duration) *dns.Msg {
+	t.Helper()
+	buf := make([]byte, maxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, _, err := conn.ReadFromUDP(buf)
+	if err, ok := err.(net.Error); ok && err.Timeout() {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dns.Msg
+	if err := msg.Unpack(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	return &msg
+}
+
+func TestQueryMetrics(t *testing.T) {
+	c, group := testConnector(t, testZone(t,
+		"web.local. 120 IN A 10.0.0.10",
+		`web.local. 120 IN TXT "path=/"`,
+	))
+	client := listenLoopback(t)
+	defer client.Close()
+
+	tests := []struct {
+		qtype    uint16
+		answered bool
+	}{
+		{qtype: dns.TypeA, answered: true},
+		{qtype: dns.TypeTXT, answered: true},
+		{qtype: dns.TypeAAAA, answered: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(dns.Type(tt.qtype).String(), func(t *testing.T) {
+			label := dns.Type(tt.qtype).String()
+			received := testutil.ToFloat64(queriesReceived.WithLabelValues(label))
+			sent := testutil.ToFloat64(responsesSent.WithLabelValues(label))
+
+			ask(t, client, c, dns.Question{Name: "web.local.", Qtype: tt.qtype, Qclass: dns.ClassINET})
+			timeout := 5 * time.Second
+			if !tt.answered {
+				timeout = 200 * time.Millisecond
+			}
+			if msg := readResponse(t, group, timeout); (msg != nil) != tt.answered {
+				t.Fatalf("got response %v, want answered %v", msg, tt.answered)
+			}
+
+			if got := testutil.ToFloat64(queriesReceived.WithLabelValues(label)) - received; got != 1 {
+				t.Errorf("queries received increased by %v, want 1", got)
+			}
+			want := 0.0
+			if tt.answered {
+				want = 1
+			}
+			if got := testutil.ToFloat64(responsesSent.WithLabelValues(label)) - sent; got != want {
+				t.Errorf("responses sent increased by %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestPublishAsync(t *testing.T) {
+	good, group := testConnector(t, newZone())
+	// Sending fails on the closed socket of the second connector
+	closed := listenLoopback(t)
+	closed.Close()
+	bad := &connector{UDPAddr: group.LocalAddr().(*net.UDPAddr), UDPConn: closed, zone: newZone()}
+
+	connMutex.Lock()
+	oldConnectors := connectors
+	connectors = []*connector{good, bad}
+	connMutex.Unlock()
+	oldCount := announceCount
+	SetAnnounceCount(1)
+	t.Cleanup(func() {
+		connMutex.Lock()
+		connectors = oldConnectors
+		connMutex.Unlock()
+		SetAnnounceCount(oldCount)
+	})
+
+	rr, err := dns.NewRR("web.local. 120 IN A 10.0.0.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		send    func(dns.RR) <-chan SendResult
+		wantTTL uint32
+	}{
+		{name: "publish", send: PublishAsync, wantTTL: 120},
+		{name: "unpublish", send: UnPublishAsync, wantTTL: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := map[string]error{}
+			for result := range tt.send(rr) {
+				results[result.Addr.String()] = result.Err
+			}
+			if len(results) != 2 {
+				t.Fatalf("got results %v, want one per connector", results)
+			}
+			if err := results[good.LocalAddr().String()]; err != nil {
+				t.Errorf("sending on %s failed: %v", good.LocalAddr(), err)
+			}
+			if err := results[bad.LocalAddr().String()]; err == nil {
+				t.Errorf("sending on the closed socket %s succeeded", bad.LocalAddr())
+			}
+
+			msg := readResponse(t, group, 5*time.Second)
+			if msg == nil || len(msg.Answer) != 1 {
+				t.Fatalf("announced %v, want the record", msg)
+			}
+			if got := msg.Answer[0].Header(); got.Ttl != tt.wantTTL || got.Class != dns.ClassINET|0x8000 {
+				t.Errorf("announced %s, want TTL %d with the cache-flush bit set", msg.Answer[0], tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestAnnounceCount(t *testing.T) {
+	c, group := testConnector(t, newZone())
+	connMutex.Lock()
+	oldConnectors := connectors
+	connectors = []*connector{c}
+	connMutex.Unlock()
+	oldCount, oldSleep := announceCount, sleep
+	var slept []time.Duration
+	sleep = func(d time.Duration) { slept = append(slept, d) }
+	SetAnnounceCount(4)
+	t.Cleanup(func() {
+		connMutex.Lock()
+		connectors = oldConnectors
+		connMutex.Unlock()
+		SetAnnounceCount(oldCount)
+		sleep = oldSleep
+	})
+
+	rr, err := dns.NewRR("web.local. 120 IN A 10.0.0.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sent := 0
+	for result := range PublishAsync(rr) {
+		if result.Err != nil {
+			t.Errorf("sending on %s failed: %v", result.Addr, result.Err)
+		}
+		sent++
+	}
+	if sent != 4 {
+		t.Errorf("sent %d announcements, want 4", sent)
+	}
+	if want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second}; !reflect.DeepEqual(slept, want) {
+		t.Errorf("waited %v between announcements, want %v", slept, want)
+	}
+	for n := 0; n < 4; n++ {
+		if msg := readResponse(t, group, 5*time.Second); msg == nil || len(msg.Answer) != 1 {
+			t.Fatalf("announcement %d was %v, want the record", n+1, msg)
+		}
+	}
+}
+
+func TestAnnounceThrottle(t *testing.T) {
+	oldForward, oldReverse := forwardThrottle, reverseThrottle
+	t.Cleanup(func() { forwardThrottle, reverseThrottle = oldForward, oldReverse })
+	SetAnnounceThrottle(time.Hour, 0, time.Hour, 0)
+
+	tests := []struct {
+		record  string
+		reverse bool
+	}{
+		{record: "web.local. 120 IN A 10.0.0.10", reverse: false},
+		{record: "_http._tcp.local. 120 IN PTR web._http._tcp.local.", reverse: false},
+		{record: "10.0.0.10.in-addr.arpa. 120 IN PTR web.local.", reverse: true},
+		{record: "A.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.D.F.IP6.ARPA. 120 IN PTR web.local.", reverse: true},
+	}
+	for _, tt := range tests {
+		rr, err := dns.NewRR(tt.record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := throttleFor(rr) == reverseThrottle; got != tt.reverse {
+			t.Errorf("throttleFor(%s) is the reverse throttle %v, want %v", rr, got, tt.reverse)
+		}
+	}
+
+	// Using up the reverse limit does not delay forward records, and vice
+	// versa
+	done := make(chan bool)
+	go func() {
+		reverseThrottle.wait()
+		forwardThrottle.wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("an announcement was delayed by the limit of the other throttle")
+	}
+	if forwardThrottle.limiter.Allow() || reverseThrottle.limiter.Allow() {
+		t.Error("an announcement was allowed within the interval")
+	}
+}
+
+func TestEDNS0Query(t *testing.T) {
+	c, group := testConnector(t, testZone(t, "web.local. 120 IN A 10.0.0.10"))
+	client := listenLoopback(t)
+	defer client.Close()
+
+	tests := []struct {
+		name  string
+		edns0 bool
+	}{
+		{name: "EDNS0", edns0: true},
+		{name: "plain", edns0: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := new(dns.Msg)
+			query.Question = []dns.Question{{Name: "web.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}}
+			if tt.edns0 {
+				query.SetEdns0(1232, false)
+			}
+			buf, err := query.Pack()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := client.WriteToUDP(buf, c.LocalAddr().(*net.UDPAddr)); err != nil {
+				t.Fatal(err)
+			}
+
+			msg := readResponse(t, group, 5*time.Second)
+			if msg == nil {
+				t.Fatal("no response")
+			}
+			if msg.Rcode != dns.RcodeSuccess || len(msg.Answer) != 1 {
+				t.Errorf("got %s with answers %v, want the address", dns.RcodeToString[msg.Rcode], msg.Answer)
+			}
+			opt := msg.IsEdns0()
+			if (opt != nil) != tt.edns0 {
+				t.Fatalf("response carries OPT record %v, want %v", opt, tt.edns0)
+			}
+			if opt != nil && opt.UDPSize() != maxMessageSize {
+				t.Errorf("response advertises UDP size %d, want %d", opt.UDPSize(), maxMessageSize)
+			}
+		})
+	}
+}
+
+func TestWithdrawnNSEC(t *testing.T) {
+	oldNSEC := withdrawnNSEC
+	t.Cleanup(func() { SetWithdrawnNSEC(oldNSEC) })
+	rr, err := dns.NewRR("web.local. 120 IN A 10.0.0.10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	question := dns.Question{Name: "web.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	tests := []struct {
+		name      string
+		duration  time.Duration
+		wait      time.Duration
+		republish bool
+		want      []string
+	}{
+		{name: "recently withdrawn", duration: time.Minute, want: []string{"web.local.\t120\tIN\tNSEC\tweb.local."}},
+		{name: "disabled", duration: 0, want: nil},
+		{name: "expired", duration: 20 * time.Millisecond, wait: 50 * time.Millisecond, want: nil},
+		{name: "published again", duration: time.Minute, republish: true, want: []string{rr.String()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			SetWithdrawnNSEC(tt.duration)
+			z := testZone(t, rr.String())
+			z.op <- operation{"del", &entry{dns.Copy(rr)}, nil}
+			if tt.republish {
+				z.op <- operation{"add", &entry{dns.Copy(rr)}, nil}
+			}
+			time.Sleep(tt.wait)
+
+			var got []string
+			for _, e := range z.query(question) {
+				got = append(got, e.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("answered %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnicastResponses(t *testing.T) {
+	oldUnicast := unicastResponses
+	SetUnicastResponses(true)
+	t.Cleanup(func() { SetUnicastResponses(oldUnicast) })
+	c, group := testConnector(t, testZone(t,
+		"web.local. 120 IN A 10.0.0.10",
+		"api.local. 120 IN A 10.0.0.11",
+	))
+	client := listenLoopback(t)
+	defer client.Close()
+
+	qu := uint16(dns.ClassINET | 0x8000)
+	tests := []struct {
+		name      string
+		questions []dns.Question
+		unicast   bool
+	}{
+		{
+			name:      "QU",
+			questions: []dns.Question{{Name: "web.local.", Qtype: dns.TypeA, Qclass: qu}},
+			unicast:   true,
+		},
+		{
+			name:      "QM",
+			questions: []dns.Question{{Name: "web.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}},
+			unicast:   false,
+		},
+		{
+			name: "QU and QM",
+			questions: []dns.Question{
+				{Name: "web.local.", Qtype: dns.TypeA, Qclass: qu},
+				{Name: "api.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET},
+			},
+			unicast: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ask(t, client, c, tt.questions...)
+			answered, silent := group, client
+			if tt.unicast {
+				answered, silent = client, group
+			}
+			msg := readResponse(t, answered, 5*time.Second)
+			if msg == nil || len(msg.Answer) != len(tt.questions) {
+				t.Fatalf("got response %v, want an answer to each question", msg)
+			}
+			if msg := readResponse(t, silent, 200*time.Millisecond); msg != nil {
+				t.Errorf("also got response %v on %s", msg, silent.LocalAddr())
+			}
+		})
+	}
+}
+
+func TestResponseDelay(t *testing.T) {
+	oldDelay := responseDelay
+	SetResponseDelay(200 * time.Millisecond)
+	t.Cleanup(func() { SetResponseDelay(oldDelay) })
+	c, group := testConnector(t, testZone(t, "web.local. 120 IN A 10.0.0.10"))
+	client := listenLoopback(t)
+	defer client.Close()
+
+	question := dns.Question{Name: "web.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	for i := 0; i < 3; i++ {
+		ask(t, client, c, question)
+	}
+
+	msg := readResponse(t, group, 5*time.Second)
+	if msg == nil || len(msg.Answer) != 1 {
+		t.Fatalf("got response %v, want the address once", msg)
+	}
+	if msg := readResponse(t, group, 500*time.Millisecond); msg != nil {
+		t.Errorf("got another response %v to the burst", msg)
+	}
+}
+
+func TestCoalescedUnicastResponses(t *testing.T) {
+	oldUnicast, oldDelay := unicastResponses, responseDelay
+	SetUnicastResponses(true)
+	SetResponseDelay(200 * time.Millisecond)
+	t.Cleanup(func() {
+		SetUnicastResponses(oldUnicast)
+		SetResponseDelay(oldDelay)
+	})
+	c, group := testConnector(t, testZone(t, "web.local. 120 IN A 10.0.0.10"))
+	first, second := listenLoopback(t), listenLoopback(t)
+	defer first.Close()
+	defer second.Close()
+	question := dns.Question{Name: "web.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET | 0x8000}
+
+	// QU queries of a single querier are still answered by unicast
+	ask(t, first, c, question)
+	ask(t, first, c, question)
+	if msg := readResponse(t, first, 5*time.Second); msg == nil {
+		t.Fatal("no unicast response")
+	}
+	if msg := readResponse(t, group, 500*time.Millisecond); msg != nil {
+		t.Errorf("also got multicast response %v", msg)
+	}
+
+	// Both queriers must receive the answer to their coalesced queries
+	ask(t, first, c, question)
+	ask(t, second, c, question)
+	if msg := readResponse(t, group, 5*time.Second); msg == nil || len(msg.Answer) != 1 {
+		t.Fatalf("got multicast response %v, want the address", msg)
+	}
+	for _, querier := range []*net.UDPConn{first, second} {
+		if msg := readResponse(t, querier, 200*time.Millisecond); msg != nil {
+			t.Errorf("got unicast response %v at %s", msg, querier.LocalAddr())
+		}
+	}
+}
+
+func TestSuppressRecent(t *testing.T) {
+	oldSuppress, oldUnicast := suppressRecent, unicastResponses
+	SetSuppressRecent(true)
+	SetUnicastResponses(true)
+	t.Cleanup(func() {
+		SetSuppressRecent(oldSuppress)
+		SetUnicastResponses(oldUnicast)
+	})
+	// The record is suppressed for a quarter of its TTL
+	c, group := testConnector(t, testZone(t, "web.local. 1 IN A 10.0.0.10"))
+	client := listenLoopback(t)
+	defer client.Close()
+	qm := dns.Question{Name: "web.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+	qu := dns.Question{Name: "web.local.", Qtype: dns.TypeA, Qclass: dns.ClassINET | 0x8000}
+
+	ask(t, client, c, qm)
+	if msg := readResponse(t, group, 5*time.Second); msg == nil {
+		t.Fatal("no response")
+	}
+
+	ask(t, client, c, qm)
+	if msg := readResponse(t, group, 100*time.Millisecond); msg != nil {
+		t.Errorf("got response %v within the suppression window", msg)
+	}
+	// Unicast responses are not suppressed
+	ask(t, client, c, qu)
+	if msg := readResponse(t, client, 5*time.Second); msg == nil || len(msg.Answer) != 1 {
+		t.Errorf("got unicast response %v within the suppression window, want the address", msg)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	ask(t, client, c, qm)
+	if msg := readResponse(t, group, 5*time.Second); msg == nil || len(msg.Answer) != 1 {
+		t.Errorf("got response %v after the suppression window, want the address", msg)
+	}
+}
+
+func TestWildcardQuery(t *testing.T) {
+	z := testZone(t,
+		"*.web.local. 120 IN A 10.0.0.10",
+		"web.local. 120 IN A 10.0.0.10",
+		"admin.web.local. 120 IN A 10.0.0.11",
+	)
+
+	tests := []struct {
+		name string
+		want []string
+	}{
+		{name: "api.web.local.", want: []string{"api.web.local.\t120\tIN\tA\t10.0.0.10"}},
+		{name: "v1.api.web.local.", want: []string{"v1.api.web.local.\t120\tIN\tA\t10.0.0.10"}},
+		{name: "admin.web.local.", want: []string{"admin.web.local.\t120\tIN\tA\t10.0.0.11"}},
+		{name: "web.local.", want: []string{"web.local.\t120\tIN\tA\t10.0.0.10"}},
+		{name: "api.other.local.", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, e := range z.query(dns.Question{Name: tt.name, Qtype: dns.TypeA, Qclass: dns.ClassINET}) {
+				got = append(got, e.String())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("answered %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestANYQuery(t *testing.T) {
+	c, group := testConnector(t, testZone(t,
+		"web.local. 120 IN A 10.0.0.10",
+		"web.local. 120 IN AAAA fd00::10",
+		`web.local. 120 IN TXT "path=/"`,
+		"api.local. 120 IN A 10.0.0.11",
+	))
+	client := listenLoopback(t)
+	defer client.Close()
+
+	tests := []struct {
+		name   string
+		qclass uint16
+	}{
+		{name: "IN", qclass: dns.ClassINET},
+		{name: "ANY", qclass: dns.ClassANY},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ask(t, client, c, dns.Question{Name: "web.local.", Qtype: dns.TypeANY, Qclass: tt.qclass})
+			msg := readResponse(t, group, 5*time.Second)
+			if msg == nil {
+				t.Fatal("no response")
+			}
+			types := map[uint16]bool{}
+			for _, rr := range msg.Answer {
+				if rr.Header().Name != "web.local." {
+					t.Errorf("answered with %s of another name", rr)
+				}
+				types[rr.Header().Rrtype] = true
+			}
+			if want := map[uint16]bool{dns.TypeA: true, dns.TypeAAAA: true, dns.TypeTXT: true}; !reflect.DeepEqual(types, want) {
+				t.Errorf("answered with %v, want all records of the name", msg.Answer)
+			}
+		})
+	}
+}
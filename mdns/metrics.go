@@ -0,0 +1,25 @@
+package mdns
+
+import (
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	queriesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "external_mdns_queries_received_total",
+		Help: "Number of mDNS questions received, by query type.",
+	}, []string{"qtype"})
+
+	responsesSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "external_mdns_responses_sent_total",
+		Help: "Number of mDNS questions answered, by query type.",
+	}, []string{"qtype"})
+)
+
+func countQuestions(counter *prometheus.CounterVec, questions []dns.Question) {
+	for _, q := range questions {
+		counter.WithLabelValues(dns.Type(q.Qtype).String()).Inc()
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"log"
+	"sync"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/miekg/dns"
+)
+
+const (
+	avahiService         = "org.freedesktop.Avahi"
+	avahiServerInterface = "org.freedesktop.Avahi.Server"
+	avahiGroupInterface  = "org.freedesktop.Avahi.EntryGroup"
+	avahiInterfaceUnspec = int32(-1)
+	avahiProtocolUnspec  = int32(-1)
+)
+
+// Bus is the part of a D-Bus connection the Avahi publisher uses, implemented
+// by *dbus.Conn
+type Bus interface {
+	Object(dest string, path dbus.ObjectPath) dbus.BusObject
+}
+
+// avahiGroup is an Avahi entry group holding a single record
+type avahiGroup struct {
+	path dbus.ObjectPath
+	refs int
+}
+
+// Avahi publishes records through the D-Bus API of a running Avahi daemon,
+// one entry group per record, so that they can be withdrawn individually.
+type Avahi struct {
+	conn   Bus
+	groups map[string]*avahiGroup // by the string representation of the record
+	mutex  sync.Mutex
+}
+
+// NewAvahi creates an Avahi publisher using the system bus
+func NewAvahi() (*Avahi, error) {
+	conn, err := dbus.SystemBus()
+	if err != nil {
+		return nil, err
+	}
+	return NewAvahiWithConn(conn), nil
+}
+
+// NewAvahiWithConn creates an Avahi publisher using the given D-Bus connection
+func NewAvahiWithConn(conn Bus) *Avahi {
+	return &Avahi{
+		conn:   conn,
+		groups: make(map[string]*avahiGroup),
+	}
+}
+
+// Publish registers rr with Avahi in a new entry group
+func (a *Avahi) Publish(rr dns.RR) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	key := rr.String()
+	if group, ok := a.groups[key]; ok {
+		group.refs++
+		return nil
+	}
+
+	rdata, err := packRdata(rr)
+	if err != nil {
+		return err
+	}
+
+	var path dbus.ObjectPath
+	server := a.conn.Object(avahiService, "/")
+	if err := server.Call(avahiServerInterface+".EntryGroupNew", 0).Store(&path); err != nil {
+		return err
+	}
+	group := a.conn.Object(avahiService, path)
+	hdr := rr.Header()
+	err = group.Call(avahiGroupInterface+".AddRecord", 0,
+		avahiInterfaceUnspec, avahiProtocolUnspec, uint32(0),
+		dns.CanonicalName(hdr.Name), hdr.Class&^0x8000, hdr.Rrtype, hdr.Ttl, rdata).Err
+	if err == nil {
+		err = group.Call(avahiGroupInterface+".Commit", 0).Err
+	}
+	if err != nil {
+		if freeErr := group.Call(avahiGroupInterface+".Free", 0).Err; freeErr != nil {
+			log.Printf("Failed to free Avahi entry group %s: %v", path, freeErr)
+		}
+		return err
+	}
+
+	a.groups[key] = &avahiGroup{path: path, refs: 1}
+	return nil
+}
+
+// UnPublish frees the entry group of rr once it has been withdrawn as often
+// as it was published
+func (a *Avahi) UnPublish(rr dns.RR) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	key := rr.String()
+	group, ok := a.groups[key]
+	if !ok {
+		return nil
+	}
+	if group.refs--; group.refs > 0 {
+		return nil
+	}
+	delete(a.groups, key)
+	return a.conn.Object(avahiService, group.path).Call(avahiGroupInterface+".Free", 0).Err
+}
+
+// packRdata returns the wire format of the data of rr, without its header
+func packRdata(rr dns.RR) ([]byte, error) {
+	buf := make([]byte, dns.Len(rr))
+	off, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	return buf[off-int(rr.Header().Rdlength) : off], nil
+}
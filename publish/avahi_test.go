@@ -0,0 +1,137 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/miekg/dns"
+)
+
+// mockBus records the methods called on the objects of the Avahi daemon,
+// failing the ones in fail
+type mockBus struct {
+	calls  []string // method and object path
+	groups int
+	fail   map[string]bool
+}
+
+func (b *mockBus) Object(dest string, path dbus.ObjectPath) dbus.BusObject {
+	return &mockObject{bus: b, path: path}
+}
+
+// mockObject implements the methods of dbus.BusObject the publisher uses
+type mockObject struct {
+	dbus.BusObject
+	bus  *mockBus
+	path dbus.ObjectPath
+}
+
+func (o *mockObject) Call(method string, flags dbus.Flags, args ...interface{}) *dbus.Call {
+	o.bus.calls = append(o.bus.calls, fmt.Sprintf("%s %s", method, o.path))
+	if o.bus.fail[method] {
+		return &dbus.Call{Err: errors.New("access denied")}
+	}
+	if method == avahiServerInterface+".EntryGroupNew" {
+		o.bus.groups++
+		return &dbus.Call{Body: []interface{}{dbus.ObjectPath(fmt.Sprintf("/Client1/EntryGroup%d", o.bus.groups))}}
+	}
+	return &dbus.Call{}
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	t.Helper()
+	rr, err := dns.NewRR(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rr
+}
+
+func TestAvahiRefcount(t *testing.T) {
+	bus := &mockBus{}
+	a := NewAvahiWithConn(bus)
+	rr := mustRR(t, "web.local. 120 IN A 10.0.0.10")
+
+	steps := []struct {
+		name    string
+		publish bool
+		want    []string // calls made by the step
+	}{
+		{
+			name:    "publish",
+			publish: true,
+			want: []string{
+				"org.freedesktop.Avahi.Server.EntryGroupNew /",
+				"org.freedesktop.Avahi.EntryGroup.AddRecord /Client1/EntryGroup1",
+				"org.freedesktop.Avahi.EntryGroup.Commit /Client1/EntryGroup1",
+			},
+		},
+		// The record published by a second object shares the entry group
+		{name: "publish again", publish: true, want: nil},
+		{name: "withdraw once", publish: false, want: nil},
+		{name: "withdraw again", publish: false, want: []string{"org.freedesktop.Avahi.EntryGroup.Free /Client1/EntryGroup1"}},
+		{name: "withdraw unknown", publish: false, want: nil},
+	}
+
+	for _, step := range steps {
+		bus.calls = nil
+		var err error
+		if step.publish {
+			err = a.Publish(rr)
+		} else {
+			err = a.UnPublish(rr)
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if !reflect.DeepEqual(bus.calls, step.want) {
+			t.Errorf("%s called %v, want %v", step.name, bus.calls, step.want)
+		}
+	}
+}
+
+func TestAvahiPublishFailure(t *testing.T) {
+	bus := &mockBus{fail: map[string]bool{avahiGroupInterface + ".Commit": true}}
+	a := NewAvahiWithConn(bus)
+	rr := mustRR(t, "web.local. 120 IN A 10.0.0.10")
+
+	if err := a.Publish(rr); err == nil {
+		t.Fatal("Publish() succeeded although the commit failed")
+	}
+	want := []string{
+		"org.freedesktop.Avahi.Server.EntryGroupNew /",
+		"org.freedesktop.Avahi.EntryGroup.AddRecord /Client1/EntryGroup1",
+		"org.freedesktop.Avahi.EntryGroup.Commit /Client1/EntryGroup1",
+		"org.freedesktop.Avahi.EntryGroup.Free /Client1/EntryGroup1",
+	}
+	if !reflect.DeepEqual(bus.calls, want) {
+		t.Errorf("called %v, want the entry group freed: %v", bus.calls, want)
+	}
+
+	// The failed record is not tracked, so publishing it again retries
+	bus.calls = nil
+	bus.fail = nil
+	if err := a.Publish(rr); err != nil {
+		t.Fatal(err)
+	}
+	if len(bus.calls) != 3 {
+		t.Errorf("called %v, want a new entry group", bus.calls)
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"log"
+
+	"github.com/blake/external-mdns/mdns"
+	"github.com/miekg/dns"
+)
+
+// Native publishes records with the built-in mDNS responder
+type Native struct {
+	// Announce announces new records and sends goodbyes for withdrawn ones,
+	// logging send failures
+	Announce bool
+}
+
+// Publish adds rr to the records the responder answers with
+func (n *Native) Publish(rr dns.RR) error {
+	if n.Announce {
+		go logSendResults("announce", rr, mdns.PublishAsync(rr))
+	} else {
+		mdns.Publish(rr)
+	}
+	return nil
+}
+
+// UnPublish removes rr from the records the responder answers with
+func (n *Native) UnPublish(rr dns.RR) error {
+	if n.Announce {
+		go logSendResults("goodbye", rr, mdns.UnPublishAsync(rr))
+	} else {
+		mdns.UnPublish(rr)
+	}
+	return nil
+}
+
+func logSendResults(kind string, record dns.RR, results <-chan mdns.SendResult) {
+	for result := range results {
+		if result.Err != nil {
+			log.Printf("Failed to send %s for %s on %s: %v", kind, record, result.Addr, result.Err)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package publish provides the backends records are published with: the
+// built-in mDNS responder, or an Avahi daemon running on the host.
+package publish
+
+import (
+	"github.com/miekg/dns"
+)
+
+// Publisher publishes and withdraws single records. A record published
+// several times stays published until it has been withdrawn as often.
+type Publisher interface {
+	Publish(rr dns.RR) error
+	UnPublish(rr dns.RR) error
+}
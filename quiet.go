@@ -0,0 +1,142 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/blake/external-mdns/resource"
+	"github.com/miekg/dns"
+)
+
+// quietHours is a daily window of local time, given as HH:MM-HH:MM, during
+// which new records are not published. The window may span midnight.
+type quietHours struct {
+	start, end time.Duration // since midnight
+	set        bool
+}
+
+func (q *quietHours) String() string {
+	if !q.set {
+		return ""
+	}
+	return fmt.Sprintf("%s-%s", clockTime(q.start), clockTime(q.end))
+}
+
+func (q *quietHours) Set(value string) error {
+	parts := strings.SplitN(value, "-", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("expected HH:MM-HH:MM, got %q", value)
+	}
+	var bounds [2]time.Duration
+	for n, part := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return fmt.Errorf("expected HH:MM-HH:MM, got %q", value)
+		}
+		bounds[n] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if bounds[0] == bounds[1] {
+		return fmt.Errorf("quiet hours %q are empty", value)
+	}
+	q.start, q.end, q.set = bounds[0], bounds[1], true
+	return nil
+}
+
+// active reports whether t is within the quiet hours
+func (q *quietHours) active(t time.Time) bool {
+	if !q.set {
+		return false
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	now := t.Sub(midnight)
+	if q.start < q.end {
+		return now >= q.start && now < q.end
+	}
+	return now >= q.start || now < q.end
+}
+
+func clockTime(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+}
+
+// deferral holds back added records during quiet hours. Withdrawals are
+// applied right away, unless they withdraw records still held back.
+type deferral struct {
+	hours    *quietHours
+	deferred []resource.Resource
+}
+
+// handle advertises res, or holds it back if it adds records during the quiet
+// hours at now
+func (d *deferral) handle(res resource.Resource, now time.Time) {
+	if !d.hours.active(now) && len(d.deferred) > 0 {
+		d.flush()
+	}
+	switch {
+	case res.Action == resource.Added && d.hours.active(now):
+		d.deferred = append(d.deferred, res)
+		return
+	case res.Action == resource.Deleted:
+		res.Records = d.cancel(res.Records)
+		if len(res.Records) == 0 {
+			return
+		}
+	}
+	advertise(res)
+}
+
+// cancel drops the records held back that records withdraws, returning the
+// records which were published already
+func (d *deferral) cancel(records []dns.RR) []dns.RR {
+	var published []dns.RR
+	for _, rr := range records {
+		found := false
+		for n := 0; n < len(d.deferred) && !found; n++ {
+			held := d.deferred[n].Records
+			for m, other := range held {
+				if dns.IsDuplicate(rr, other) {
+					d.deferred[n].Records = append(append([]dns.RR{}, held[:m]...), held[m+1:]...)
+					found = true
+					break
+				}
+			}
+		}
+		if !found {
+			published = append(published, rr)
+		}
+	}
+	return published
+}
+
+// tick publishes the records held back once the quiet hours at now are over
+func (d *deferral) tick(now time.Time) {
+	if !d.hours.active(now) && len(d.deferred) > 0 {
+		d.flush()
+	}
+}
+
+func (d *deferral) flush() {
+	log.Printf("Quiet hours over, publishing %d deferred changes", len(d.deferred))
+	for _, res := range d.deferred {
+		if len(res.Records) > 0 {
+			advertise(res)
+		}
+	}
+	d.deferred = nil
+}
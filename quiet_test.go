@@ -0,0 +1,135 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blake/external-mdns/resource"
+	"github.com/miekg/dns"
+)
+
+func TestQuietHoursSet(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{value: "22:00-06:30", want: "22:00-06:30"},
+		{value: "9:05 - 17:00", want: "09:05-17:00"},
+		{value: "22:00", wantErr: true},
+		{value: "22:00-25:00", wantErr: true},
+		{value: "08:00-08:00", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			var q quietHours
+			err := q.Set(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Set(%q) = %v, want error %v", tt.value, err, tt.wantErr)
+			}
+			if got := q.String(); got != tt.want {
+				t.Errorf("String() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuietHoursActive(t *testing.T) {
+	at := func(clock string) time.Time {
+		t, _ := time.ParseInLocation("2006-01-02 15:04", "2023-06-01 "+clock, time.Local)
+		return t
+	}
+	tests := []struct {
+		hours string
+		clock string
+		want  bool
+	}{
+		{hours: "09:00-17:00", clock: "08:59", want: false},
+		{hours: "09:00-17:00", clock: "09:00", want: true},
+		{hours: "09:00-17:00", clock: "16:59", want: true},
+		{hours: "09:00-17:00", clock: "17:00", want: false},
+		{hours: "22:00-06:00", clock: "23:30", want: true},
+		{hours: "22:00-06:00", clock: "03:00", want: true},
+		{hours: "22:00-06:00", clock: "06:00", want: false},
+		{hours: "22:00-06:00", clock: "12:00", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hours+" at "+tt.clock, func(t *testing.T) {
+			var q quietHours
+			if err := q.Set(tt.hours); err != nil {
+				t.Fatal(err)
+			}
+			if got := q.active(at(tt.clock)); got != tt.want {
+				t.Errorf("active() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	var unset quietHours
+	if unset.active(at("12:00")) {
+		t.Error("active() = true without quiet hours")
+	}
+}
+
+func TestDeferral(t *testing.T) {
+	p := testPublisher(t)
+	var q quietHours
+	if err := q.Set("22:00-06:00"); err != nil {
+		t.Fatal(err)
+	}
+	d := &deferral{hours: &q}
+	night := time.Date(2023, 6, 1, 23, 0, 0, 0, time.Local)
+	morning := time.Date(2023, 6, 2, 7, 0, 0, 0, time.Local)
+
+	update := func(action string, s string, now time.Time) {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d.handle(resource.Resource{SourceType: "service", Action: action, Records: []dns.RR{rr}}, now)
+	}
+
+	// Added records are held back during the quiet hours
+	update(resource.Added, "a.local. A 10.0.0.1", night)
+	update(resource.Added, "b.local. A 10.0.0.2", night)
+	if len(p.published) != 0 {
+		t.Fatalf("published %v during the quiet hours", p.published)
+	}
+
+	// Withdrawing a record held back drops it without publishing anything
+	update(resource.Deleted, "b.local. A 10.0.0.2", night)
+	if len(p.withdrawn) != 0 {
+		t.Errorf("withdrew %v, want the record held back dropped", p.withdrawn)
+	}
+
+	d.tick(night.Add(time.Hour))
+	if len(p.published) != 0 {
+		t.Fatalf("published %v during the quiet hours", p.published)
+	}
+	d.tick(morning)
+	if len(p.published) != 1 {
+		t.Errorf("published %v after the quiet hours, want the remaining record", p.published)
+	}
+
+	// Outside the quiet hours, records are published right away
+	update(resource.Added, "c.local. A 10.0.0.3", morning)
+	if len(p.published) != 2 {
+		t.Errorf("published %v, want the record published right away", p.published)
+	}
+}
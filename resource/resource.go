@@ -28,5 +28,7 @@ const (
 type Resource struct {
 	SourceType string
 	Action     string
+	Namespace  string // namespace of the originating object, if any
+	Name       string // name of the originating object, if any
 	Records    []dns.RR
 }
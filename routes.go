@@ -0,0 +1,116 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// hostByteOrder is the byte order of the numbers the kernel prints to
+// /proc/net/route
+var hostByteOrder binary.ByteOrder = binary.LittleEndian
+
+func init() {
+	one := uint16(1)
+	if *(*byte)(unsafe.Pointer(&one)) == 0 {
+		hostByteOrder = binary.BigEndian
+	}
+}
+
+// routedSubnets returns the destinations of the routes in the Linux routing
+// tables other than the default routes, which are reachable from the host
+// through a gateway. Routes over the loopback interface are ignored.
+func routedSubnets() ([]*net.IPNet, error) {
+	ipv4, err := readRoutes("/proc/net/route", parseIPv4Route)
+	if err != nil {
+		return nil, err
+	}
+	ipv6, err := readRoutes("/proc/net/ipv6_route", parseIPv6Route)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return append(ipv4, ipv6...), nil
+}
+
+func readRoutes(path string, parse func(fields []string) (*net.IPNet, error)) ([]*net.IPNet, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var subnets []*net.IPNet
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		subnet, err := parse(strings.Fields(scanner.Text()))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if subnet != nil {
+			subnets = append(subnets, subnet)
+		}
+	}
+	return subnets, scanner.Err()
+}
+
+// parseIPv4Route parses a line of /proc/net/route, where addresses and masks
+// are hexadecimal numbers in host byte order
+func parseIPv4Route(fields []string) (*net.IPNet, error) {
+	if len(fields) < 8 || fields[0] == "Iface" || fields[0] == "lo" {
+		return nil, nil
+	}
+	var values [2]uint32
+	for n, field := range []string{fields[1], fields[7]} {
+		value, err := strconv.ParseUint(field, 16, 32)
+		if err != nil {
+			return nil, err
+		}
+		values[n] = uint32(value)
+	}
+	if values[1] == 0 {
+		return nil, nil
+	}
+	ip, mask := make(net.IP, net.IPv4len), make(net.IPMask, net.IPv4len)
+	hostByteOrder.PutUint32(ip, values[0])
+	hostByteOrder.PutUint32(mask, values[1])
+	return &net.IPNet{IP: ip, Mask: mask}, nil
+}
+
+// parseIPv6Route parses a line of /proc/net/ipv6_route
+func parseIPv6Route(fields []string) (*net.IPNet, error) {
+	if len(fields) < 10 || fields[9] == "lo" {
+		return nil, nil
+	}
+	ip, err := hex.DecodeString(fields[0])
+	if err != nil || len(ip) != net.IPv6len {
+		return nil, fmt.Errorf("invalid destination %q", fields[0])
+	}
+	ones, err := strconv.ParseUint(fields[1], 16, 8)
+	if err != nil || ones > 128 {
+		return nil, fmt.Errorf("invalid prefix length %q", fields[1])
+	}
+	if ones == 0 {
+		return nil, nil
+	}
+	return &net.IPNet{IP: net.IP(ip), Mask: net.CIDRMask(int(ones), 128)}, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// subnetStrings returns the subnets in CIDR notation
+func subnetStrings(subnets []*net.IPNet) []string {
+	var s []string
+	for _, subnet := range subnets {
+		s = append(s, subnet.String())
+	}
+	return s
+}
+
+func TestReadIPv4Routes(t *testing.T) {
+	tests := []struct {
+		name      string
+		byteOrder binary.ByteOrder
+		route     string
+	}{
+		{
+			name:      "little endian",
+			byteOrder: binary.LittleEndian,
+			route: `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	0101A8C0	0003	0	0	100	00000000	0	0	0
+eth0	0001A8C0	00000000	0001	0	0	100	00FFFFFF	0	0	0
+eth0	0000100A	0101A8C0	0003	0	0	100	0000F0FF	0	0	0
+lo	0000007F	00000000	0001	0	0	0	000000FF	0	0	0
+`,
+		},
+		{
+			name:      "big endian",
+			byteOrder: binary.BigEndian,
+			route: `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+eth0	00000000	C0A80101	0003	0	0	100	00000000	0	0	0
+eth0	C0A80100	00000000	0001	0	0	100	FFFFFF00	0	0	0
+eth0	0A100000	C0A80101	0003	0	0	100	FFF00000	0	0	0
+lo	7F000000	00000000	0001	0	0	0	FF000000	0	0	0
+`,
+		},
+	}
+
+	oldByteOrder := hostByteOrder
+	t.Cleanup(func() { hostByteOrder = oldByteOrder })
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hostByteOrder = tt.byteOrder
+			path := filepath.Join(t.TempDir(), "route")
+			if err := ioutil.WriteFile(path, []byte(tt.route), 0644); err != nil {
+				t.Fatal(err)
+			}
+			subnets, err := readRoutes(path, parseIPv4Route)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := []string{"192.168.1.0/24", "10.16.0.0/12"}
+			if got := subnetStrings(subnets); !reflect.DeepEqual(got, want) {
+				t.Errorf("routes = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseIPv6Route(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "routed prefix",
+			line: "fd000000000000000000000000000000 40 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003 eth0",
+			want: "fd00::/64",
+		},
+		{
+			name: "default route",
+			line: "00000000000000000000000000000000 00 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003 eth0",
+		},
+		{
+			name: "loopback",
+			line: "00000000000000000000000000000001 80 00000000000000000000000000000000 00 00000000000000000000000000000000 00000000 00000001 00000000 00000001 lo",
+		},
+		{
+			name:    "invalid destination",
+			line:    "fd00 40 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003 eth0",
+			wantErr: true,
+		},
+		{
+			name:    "invalid prefix length",
+			line:    "fd000000000000000000000000000000 81 00000000000000000000000000000000 00 fe800000000000000000000000000001 00000400 00000001 00000000 00000003 eth0",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subnet, err := parseIPv6Route(strings.Fields(tt.line))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseIPv6Route() error = %v, want error %v", err, tt.wantErr)
+			}
+			got := ""
+			if subnet != nil {
+				got = subnet.String()
+			}
+			if got != tt.want {
+				t.Errorf("parseIPv6Route() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"log"
+	"net"
+	"strings"
+	"text/template"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Values accepted for Config.LoadBalancerAddressType
+const (
+	AddressTypeAll      = "all"
+	AddressTypeExternal = "external"
+	AddressTypeInternal = "internal"
+)
+
+// Values accepted for Config.LoadBalancerHostnameMode
+const (
+	LoadBalancerHostnameSkip    = "skip"
+	LoadBalancerHostnameResolve = "resolve"
+	LoadBalancerHostnameCNAME   = "cname"
+)
+
+// Values accepted for Config.LoadBalancerHostnameFamily
+const (
+	AddressFamilyAny  = "any"
+	AddressFamilyIPv4 = "ipv4"
+	AddressFamilyIPv6 = "ipv6"
+)
+
+// Values accepted for Config.ExternalIPsPolicy
+const (
+	ExternalIPsPolicyClusterIP   = "clusterip"
+	ExternalIPsPolicyExternalIPs = "externalips"
+	ExternalIPsPolicyBoth        = "both"
+)
+
+// Values accepted for Config.ProtocolLabelCase
+const (
+	LabelCaseLower = "lower"
+	LabelCaseUpper = "upper"
+)
+
+// Values accepted for Config.ReachabilityCheck
+const (
+	ReachabilityOff  = "off"
+	ReachabilityWarn = "warn"
+	ReachabilitySkip = "skip"
+)
+
+// Values accepted for Config.IngressAddressPreference
+const (
+	IngressAddressIP       = "ip"
+	IngressAddressHostname = "hostname"
+)
+
+// Values accepted for Config.IngressInstanceName
+const (
+	IngressInstanceHost   = "host"
+	IngressInstanceObject = "object"
+)
+
+// Config holds the settings that control how records are built from
+// Kubernetes objects.
+type Config struct {
+	// Namespace limits sources to a single namespace (empty for all namespaces)
+	Namespace string
+	// PublishAll publishes services even if they carry no annotation
+	PublishAll bool
+	// OwnerID limits the service and endpoints sources to services whose
+	// owner-id annotation matches it, and adds it to their TXT records as
+	// owner=<id>; if empty, only services without the annotation are published
+	OwnerID string
+	// LoadBalancerAddressType selects which load balancer addresses are
+	// published (one of AddressTypeAll, AddressTypeExternal, AddressTypeInternal)
+	LoadBalancerAddressType string
+	// LoadBalancerHostnameMode selects how load balancers which only report
+	// a hostname are published (one of LoadBalancerHostnameSkip,
+	// LoadBalancerHostnameResolve, LoadBalancerHostnameCNAME)
+	LoadBalancerHostnameMode string
+	// LoadBalancerHostnameFamily limits the addresses published for resolved
+	// load balancer hostnames to one family (one of AddressFamilyAny,
+	// AddressFamilyIPv4, AddressFamilyIPv6)
+	LoadBalancerHostnameFamily string
+	// LoadBalancerHostnameRefresh caches resolved load balancer hostnames and
+	// resolves them and external names again at this interval (resolved only
+	// on rebuilds if 0)
+	LoadBalancerHostnameRefresh time.Duration
+	// ExternalIPsPolicy selects which addresses are published for services
+	// with both a cluster IP and external IPs in use (one of
+	// ExternalIPsPolicyClusterIP, ExternalIPsPolicyExternalIPs,
+	// ExternalIPsPolicyBoth)
+	ExternalIPsPolicy string
+	// AnnotationTXTPrefix turns every service annotation below this prefix
+	// into a TXT key=value pair (disabled if empty)
+	AnnotationTXTPrefix string
+	// LabelsToTXT lists the service labels whose values are published as TXT
+	// key=value pairs
+	LabelsToTXT []string
+	// StrictAnnotations rejects services whose annotations reference ports
+	// the service does not have, instead of silently ignoring the reference
+	StrictAnnotations bool
+	// LowercaseHostnames lowercases hostnames set by annotation and ingress hosts
+	LowercaseHostnames bool
+	// ServiceEnumeration publishes a _services._dns-sd._udp.local PTR to
+	// every advertised service type
+	ServiceEnumeration bool
+	// ProtocolLabelCase selects the casing of the DNS-SD protocol label, e.g.
+	// _tcp or _TCP (one of LabelCaseLower, LabelCaseUpper)
+	ProtocolLabelCase string
+	// TargetPortTXT adds the target port of each service port to its TXT
+	// record as targetPort=<port>
+	TargetPortTXT bool
+	// HostnameAliases maps fully qualified .local names to the name they
+	// refer to; hostnames set by annotation are resolved through it
+	HostnameAliases map[string]string
+	// ClusterName is inserted into default hostnames if set
+	ClusterName string
+	// NamespaceDomains maps namespaces to the fully qualified domain the
+	// default hostnames of their services are placed in
+	NamespaceDomains map[string]string
+	// WatchEndpoints makes the service source watch endpoints, which is
+	// required for the min-ready-endpoints annotation and ReadyPortsOnly
+	WatchEndpoints bool
+	// ReadyPortsOnly limits the SRV records of the service source to ports
+	// with at least one ready endpoint (requires WatchEndpoints)
+	ReadyPortsOnly bool
+	// InstanceConflict selects how DNS-SD service instance names used by more
+	// than one service are handled (one of InstanceConflictWarn,
+	// InstanceConflictSkip, InstanceConflictSuffix)
+	InstanceConflict string
+	// InstanceSeparator joins namespace and name in default DNS-SD service
+	// instance names ("/" if empty)
+	InstanceSeparator string
+	// InstanceTemplate derives the DNS-SD instance name of each port of a
+	// service from InstanceNameData, e.g. to include the port name (optional)
+	InstanceTemplate *template.Template
+	// ResolveExternalNames publishes the addresses of ExternalName services
+	// outside .local, resolved when their records are built, instead of a
+	// CNAME to the external name
+	ResolveExternalNames bool
+	// ServiceTypes limits the service source to services of these types (all
+	// types if empty)
+	ServiceTypes []string
+	// RequirePort limits the service and endpoints sources to services with
+	// a port of this name or number (optional)
+	RequirePort string
+	// ReachabilityCheck selects what happens to addresses outside of
+	// LocalSubnets (one of ReachabilityOff, ReachabilityWarn, ReachabilitySkip)
+	ReachabilityCheck string
+	// LocalSubnets are the subnets of the responder's network interfaces
+	LocalSubnets []*net.IPNet
+	// IngressRequireBackend skips ingress rules whose paths reference no
+	// existing backend service
+	IngressRequireBackend bool
+	// PodHostnames additionally publishes each endpoint of a headless service
+	// that has a stable hostname, such as a pod of a StatefulSet, under that
+	// hostname below the hostname of the service
+	PodHostnames bool
+	// IngressServiceRecords publishes DNS-SD records for the web server at
+	// every ingress host
+	IngressServiceRecords bool
+	// IngressInstanceName selects whether the DNS-SD instance name of ingress
+	// hosts is the first label of the host or namespace and name of the
+	// ingress (one of IngressInstanceHost, IngressInstanceObject)
+	IngressInstanceName string
+	// IngressRequireReady skips ingresses whose load balancer status reports
+	// port errors
+	IngressRequireReady bool
+	// IngressAddressPreference selects whether ingress hosts resolve to the
+	// load balancer IP or, as a CNAME, to its hostname if the status carries
+	// both (one of IngressAddressIP, IngressAddressHostname)
+	IngressAddressPreference string
+	// ReverseOnly publishes only the reverse PTR records of addresses, not
+	// the forward A/AAAA records
+	ReverseOnly bool
+	// SkipCGNAT skips addresses in the CGNAT range 100.64.0.0/10
+	SkipCGNAT bool
+	// NAT64Prefix, if set, adds an AAAA record synthesized from every IPv4
+	// address for IPv6-only clients
+	NAT64Prefix *net.IPNet
+	// ReverseConflict selects whether only the first object publishing an
+	// address gets its reverse PTR record, or all of them (one of
+	// ReverseConflictFirst, ReverseConflictAll)
+	ReverseConflict string
+	// SkipLocalIPv6Reverse omits reverse PTR records for IPv6 link-local and
+	// unique local addresses
+	SkipLocalIPv6Reverse bool
+	// Debounce delays publishing changes of an object until it has not
+	// changed for this long (disabled if 0)
+	Debounce time.Duration
+	// DeleteGrace delays withdrawing the records of an object, so that they
+	// survive if it is recreated within this period (disabled if 0)
+	DeleteGrace time.Duration
+	// Zone is the topology zone of the responder; load balancer addresses in
+	// this zone are preferred
+	Zone string
+}
+
+func (c Config) instanceSeparator() string {
+	if c.InstanceSeparator == "" {
+		return "/"
+	}
+	return c.InstanceSeparator
+}
+
+// InstanceNameData is passed to Config.InstanceTemplate
+type InstanceNameData struct {
+	Instance  string // instance name of the service, without the port
+	Namespace string
+	Name      string
+	Port      string // port name, empty for a single unnamed port
+}
+
+// portInstanceName returns the instance name of the port of the service with
+// the instance name instance, according to InstanceTemplate
+func (c Config) portInstanceName(instance string, service *corev1.Service, port string) string {
+	if c.InstanceTemplate == nil {
+		return instance
+	}
+	var name strings.Builder
+	data := InstanceNameData{Instance: instance, Namespace: service.Namespace, Name: service.Name, Port: port}
+	if err := c.InstanceTemplate.Execute(&name, data); err != nil {
+		log.Printf("Using instance name %s for port %q of service %s/%s: %v", instance, port, service.Namespace, service.Name, err)
+		return instance
+	}
+	if name.Len() == 0 || strings.ContainsAny(name.String(), ".\\\"") {
+		log.Printf("Using instance name %s for port %q of service %s/%s: invalid instance name %q", instance, port, service.Namespace, service.Name, name.String())
+		return instance
+	}
+	return name.String()
+}
+
+// acceptsServiceType reports whether services of type serviceType are
+// published according to ServiceTypes.
+func (c Config) acceptsServiceType(serviceType string) bool {
+	if len(c.ServiceTypes) == 0 {
+		return true
+	}
+	for _, t := range c.ServiceTypes {
+		if t == serviceType {
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsPorts reports whether the service is published according to
+// RequirePort.
+func (c Config) acceptsPorts(service *corev1.Service) bool {
+	if c.RequirePort == "" {
+		return true
+	}
+	_, err := resolvePort(service, c.RequirePort)
+	return err == nil
+}
+
+// acceptsAddressFamily reports whether ip belongs to the address family
+// selected by LoadBalancerHostnameFamily
+func (c Config) acceptsAddressFamily(ip net.IP) bool {
+	switch c.LoadBalancerHostnameFamily {
+	case AddressFamilyIPv4:
+		return ip.To4() != nil
+	case AddressFamilyIPv6:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// acceptsLoadBalancerAddress reports whether the load balancer address ip
+// should be published according to LoadBalancerAddressType.
+func (c Config) acceptsLoadBalancerAddress(ip net.IP) bool {
+	switch c.LoadBalancerAddressType {
+	case AddressTypeExternal:
+		return !isPrivateAddress(ip)
+	case AddressTypeInternal:
+		return isPrivateAddress(ip)
+	default:
+		return true
+	}
+}
+
+// publishReverse reports whether a reverse PTR record should be published for
+// the address ip according to SkipLocalIPv6Reverse.
+func (c Config) publishReverse(ip net.IP) bool {
+	return !c.SkipLocalIPv6Reverse || ip.To4() != nil || !containsAddress(localIPv6Networks, ip)
+}
+
+// checkReachable reports whether the address ip advertised for the object
+// should be published according to SkipCGNAT and ReachabilityCheck.
+func (c Config) checkReachable(ip net.IP, object string) bool {
+	if c.SkipCGNAT && containsAddress(cgnatNetworks, ip) {
+		log.Printf("Not publishing address %s of %s: in the CGNAT range", ip, object)
+		return false
+	}
+	if c.ReachabilityCheck == ReachabilityOff || c.ReachabilityCheck == "" || containsAddress(c.LocalSubnets, ip) {
+		return true
+	}
+
+	if c.ReachabilityCheck == ReachabilitySkip {
+		log.Printf("Not publishing address %s of %s: not in any local subnet", ip, object)
+		return false
+	}
+	log.Printf("Address %s of %s is not in any local subnet", ip, object)
+	return true
+}
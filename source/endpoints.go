@@ -0,0 +1,289 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/blake/external-mdns/resource"
+	"github.com/miekg/dns"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/informers"
+	listersv1 "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// EndpointsSource advertises the ready endpoints of headless services under
+// the service's hostname, one A/AAAA record per endpoint address.
+type EndpointsSource struct {
+	config          Config
+	sharedInformer  cache.SharedIndexInformer
+	serviceInformer cache.SharedIndexInformer
+	serviceLister   listersv1.ServiceLister
+	*recordSet
+}
+
+// Run waits for the shared informer caches to synchronize. The informers
+// themselves are started through the SharedInformerFactory they were created
+// from.
+func (e *EndpointsSource) Run(stopCh chan struct{}) error {
+	if !cache.WaitForCacheSync(stopCh, e.sharedInformer.HasSynced, e.serviceInformer.HasSynced) {
+		runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
+	}
+	return nil
+}
+
+func (e *EndpointsSource) onAdd(obj interface{}) {
+	e.sync(obj)
+}
+
+// onDelete withdraws the records published last for the endpoints, since the
+// owning service may already be gone and its hostname can not be rebuilt.
+func (e *EndpointsSource) onDelete(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	if e.isStale(key, obj) {
+		return
+	}
+
+	e.publish(key, nil)
+}
+
+func (e *EndpointsSource) onUpdate(oldObj interface{}, newObj interface{}) {
+	e.sync(newObj)
+}
+
+// onServiceChange re-evaluates the endpoints of the service, as its
+// annotations may have changed or it may be gone.
+func (e *EndpointsSource) onServiceChange(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	endpoints, exists, err := e.sharedInformer.GetIndexer().GetByKey(key)
+	if err != nil || !exists {
+		return
+	}
+	e.sync(endpoints)
+}
+
+func (e *EndpointsSource) sync(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	if e.isStale(key, obj) {
+		return
+	}
+
+	e.publish(key, e.buildRecords(obj))
+}
+
+// Reconcile rebuilds the records of all endpoints and publishes any
+// differences to the records published before.
+func (e *EndpointsSource) Reconcile() {
+	e.reconcile(e.sharedInformer.GetStore(), e.buildRecords)
+}
+
+func (e *EndpointsSource) buildRecords(obj interface{}) []dns.RR {
+	endpoints, ok := obj.(*corev1.Endpoints)
+	if !ok {
+		return nil
+	}
+
+	service, err := e.serviceLister.Services(endpoints.Namespace).Get(endpoints.Name)
+	if err != nil {
+		return nil
+	}
+
+	return transform(e.sourceType, endpoints, BuildEndpointsRecords(endpoints, service, e.config))
+}
+
+// BuildEndpointsRecords returns the records to advertise for the endpoints of
+// the given headless service. It does not depend on any informer state.
+func BuildEndpointsRecords(endpoints *corev1.Endpoints, service *corev1.Service, cfg Config) []dns.RR {
+	var records []dns.RR
+
+	if service.Spec.ClusterIP != corev1.ClusterIPNone || !isPublishable(service, cfg) || !cfg.acceptsPorts(service) || !hasReadyCondition(service) || !hasMinReadyEndpoints(service, endpoints) {
+		return records
+	}
+
+	if cfg.Namespace != "" && cfg.Namespace != service.Namespace {
+		return records
+	}
+	if cfg.StrictAnnotations {
+		if err := checkPortReferences(service); err != nil {
+			log.Printf("Not publishing endpoints of service %s/%s: %v", service.Namespace, service.Name, err)
+			return records
+		}
+	}
+
+	hostname := serviceHostname(service, cfg)
+	if hasEndpointWeights(service, cfg) {
+		records = append(records, endpointSRVRecords(endpoints, service, hostname, cfg)...)
+	}
+	for _, subset := range endpoints.Subsets {
+		for _, address := range subset.Addresses {
+			if ip := net.ParseIP(address.IP); ip != nil && cfg.checkReachable(ip, fmt.Sprintf("endpoints %s/%s", endpoints.Namespace, endpoints.Name)) {
+				records = append(records, buildAddressRecords(hostname, ip, !cfg.ReverseOnly, cfg.publishReverse(ip), cfg)...)
+				// The reverse record keeps pointing to the service
+				if cfg.PodHostnames && address.Hostname != "" && !cfg.ReverseOnly {
+					records = append(records, buildAddressRecords(address.Hostname+"."+hostname, ip, true, false, cfg)...)
+				}
+			}
+		}
+	}
+
+	return records
+}
+
+// hasEndpointWeights reports whether the service has its SRV records weighted
+// per endpoint, which requires stable endpoint hostnames to target
+func hasEndpointWeights(service *corev1.Service, cfg Config) bool {
+	_, ok := service.Annotations[endpointWeightsAnnotation]
+	return ok && cfg.PodHostnames && service.Spec.ClusterIP == corev1.ClusterIPNone
+}
+
+// endpointWeights parses the endpoint-weights annotation of the service, a
+// JSON object mapping endpoint hostnames or addresses to SRV weights.
+func endpointWeights(service *corev1.Service) (map[string]uint16, error) {
+	var weights map[string]uint16
+	if err := json.Unmarshal([]byte(service.Annotations[endpointWeightsAnnotation]), &weights); err != nil {
+		return nil, err
+	}
+	return weights, nil
+}
+
+// endpointSRVRecords returns DNS-SD records for every port of every ready
+// endpoint with a hostname, each SRV record targeting the endpoint and
+// weighted as set by the endpoint-weights annotation (0 if not listed). The
+// service instance is shared by all endpoints.
+func endpointSRVRecords(endpoints *corev1.Endpoints, service *corev1.Service, hostname string, cfg Config) []dns.RR {
+	var records []dns.RR
+	weights, err := endpointWeights(service)
+	ignoreInvalidAnnotation(service, endpointWeightsAnnotation, err)
+	svctxt, err := serviceTXT(service)
+	ignoreInvalidAnnotation(service, serviceTxtAnnotation, err)
+	selected, err := selectedPorts(service)
+	ignoreInvalidAnnotation(service, portsAnnotation, err)
+	instancename := serviceInstanceName(service, cfg)
+	annotationtxt := annotationTXT(service, cfg)
+
+	for _, subset := range endpoints.Subsets {
+		for _, address := range subset.Addresses {
+			if address.Hostname == "" {
+				continue
+			}
+			weight, ok := weights[address.Hostname]
+			if !ok {
+				weight = weights[address.IP]
+			}
+			for _, port := range subset.Ports {
+				if selected != nil && !selected[port.Name] {
+					continue
+				}
+				txt := append(append([]string{}, svctxt[port.Name]...), annotationtxt...)
+				for _, rr := range buildSRVRecord(cfg.portInstanceName(instancename, service, port.Name), port.Name, port.Protocol, address.Hostname+"."+hostname, uint16(port.Port), "", txt, cfg) {
+					if srv, ok := rr.(*dns.SRV); ok {
+						srv.Weight = weight
+					}
+					records = append(records, rr)
+				}
+			}
+		}
+	}
+	return records
+}
+
+// hasMinReadyEndpoints reports whether endpoints has at least as many ready
+// addresses as the min-ready-endpoints annotation of the service requires.
+// endpoints may be nil if the service has none.
+func hasMinReadyEndpoints(service *corev1.Service, endpoints *corev1.Endpoints) bool {
+	value, ok := service.Annotations[minReadyAnnotation]
+	if !ok {
+		return true
+	}
+
+	minReady, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		log.Printf("Not publishing service %s/%s: invalid annotation %s: %v", service.Namespace, service.Name, minReadyAnnotation, err)
+		return false
+	}
+
+	ready := 0
+	if endpoints != nil {
+		for _, subset := range endpoints.Subsets {
+			ready += len(subset.Addresses)
+		}
+	}
+	return ready >= minReady
+}
+
+// readyEndpointPorts returns the names of the ports served by at least one
+// ready address of endpoints, which may be nil if the service has none.
+func readyEndpointPorts(endpoints *corev1.Endpoints) map[string]bool {
+	ready := map[string]bool{}
+	if endpoints == nil {
+		return ready
+	}
+	for _, subset := range endpoints.Subsets {
+		if len(subset.Addresses) == 0 {
+			continue
+		}
+		for _, port := range subset.Ports {
+			ready[port.Name] = true
+		}
+	}
+	return ready
+}
+
+// NewEndpointsWatcher creates an EndpointsSource
+func NewEndpointsWatcher(factory informers.SharedInformerFactory, config Config, notifyChan chan<- resource.Resource) *EndpointsSource {
+	endpointsInformer := factory.Core().V1().Endpoints().Informer()
+	e := &EndpointsSource{
+		config:          config,
+		sharedInformer:  endpointsInformer,
+		serviceInformer: factory.Core().V1().Services().Informer(),
+		serviceLister:   factory.Core().V1().Services().Lister(),
+		recordSet:       newRecordSet("endpoints", notifyChan, config),
+	}
+
+	e.serviceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    e.onServiceChange,
+		DeleteFunc: e.onServiceChange,
+		UpdateFunc: func(oldObj interface{}, newObj interface{}) {
+			e.onServiceChange(newObj)
+		},
+	})
+	endpointsInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    e.onAdd,
+		DeleteFunc: e.onDelete,
+		UpdateFunc: e.onUpdate,
+	})
+
+	return e
+}
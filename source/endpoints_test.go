@@ -0,0 +1,423 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blake/external-mdns/resource"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testHeadlessService returns testService without a cluster IP
+func testHeadlessService() *corev1.Service {
+	service := testService()
+	service.Spec.ClusterIP = corev1.ClusterIPNone
+	service.Spec.ClusterIPs = []string{corev1.ClusterIPNone}
+	return service
+}
+
+// testEndpoints returns the endpoints of the service web in namespace default
+// with a ready address for each IP, serving the HTTP port
+func testEndpoints(ips ...string) *corev1.Endpoints {
+	subset := corev1.EndpointSubset{
+		Ports: []corev1.EndpointPort{{Name: "http", Port: 8080, Protocol: corev1.ProtocolTCP}},
+	}
+	for _, ip := range ips {
+		subset.Addresses = append(subset.Addresses, corev1.EndpointAddress{IP: ip})
+	}
+	return &corev1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Subsets:    []corev1.EndpointSubset{subset},
+	}
+}
+
+// statefulSetEndpoints returns testEndpoints with the stable hostnames the
+// pods of the StatefulSet web get, in the order of the IPs
+func statefulSetEndpoints(ips ...string) *corev1.Endpoints {
+	endpoints := testEndpoints(ips...)
+	for n := range endpoints.Subsets[0].Addresses {
+		endpoints.Subsets[0].Addresses[n].Hostname = fmt.Sprintf("web-%d", n)
+	}
+	return endpoints
+}
+
+// receive returns the next notification sent to notify, failing the test if
+// there is none within a few seconds
+func receive(t *testing.T, notify <-chan resource.Resource) resource.Resource {
+	t.Helper()
+	select {
+	case res := <-notify:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification received")
+		return resource.Resource{}
+	}
+}
+
+// expectNone fails the test if a notification is pending on notify
+func expectNone(t *testing.T, notify <-chan resource.Resource) {
+	t.Helper()
+	select {
+	case res := <-notify:
+		t.Errorf("unexpected notification %s of %v", res.Action, recordStrings(res.Records))
+	default:
+	}
+}
+
+func TestBuildEndpointsRecords(t *testing.T) {
+	tests := []struct {
+		name      string
+		service   *corev1.Service
+		endpoints *corev1.Endpoints
+		cfg       Config
+		want      []string
+	}{
+		{
+			name:      "ready endpoints",
+			service:   testHeadlessService(),
+			endpoints: testEndpoints("10.1.0.1", "10.1.0.2", "10.1.0.3"),
+			want: sortedStrings(
+				"web.default.local. A 10.1.0.1",
+				"web.default.local. A 10.1.0.2",
+				"web.default.local. A 10.1.0.3",
+				"1.0.1.10.in-addr.arpa. PTR web.default.local.",
+				"2.0.1.10.in-addr.arpa. PTR web.default.local.",
+				"3.0.1.10.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name:    "not ready endpoints",
+			service: testHeadlessService(),
+			endpoints: func() *corev1.Endpoints {
+				endpoints := testEndpoints("10.1.0.1")
+				endpoints.Subsets[0].NotReadyAddresses = []corev1.EndpointAddress{{IP: "10.1.0.2"}}
+				return endpoints
+			}(),
+			want: sortedStrings(
+				"web.default.local. A 10.1.0.1",
+				"1.0.1.10.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name:      "service with cluster IP",
+			service:   testService(),
+			endpoints: testEndpoints("10.1.0.1"),
+			want:      []string{},
+		},
+		{
+			name: "service not annotated",
+			service: func() *corev1.Service {
+				service := testHeadlessService()
+				service.Annotations = nil
+				return service
+			}(),
+			endpoints: testEndpoints("10.1.0.1"),
+			want:      []string{},
+		},
+		{
+			name:      "required port missing",
+			service:   testHeadlessService(),
+			endpoints: testEndpoints("10.1.0.1"),
+			cfg:       Config{RequirePort: "https"},
+			want:      []string{},
+		},
+		{
+			name:      "StatefulSet pods",
+			service:   testHeadlessService(),
+			endpoints: statefulSetEndpoints("10.1.0.1", "10.1.0.2"),
+			cfg:       Config{PodHostnames: true},
+			want: sortedStrings(
+				"web.default.local. A 10.1.0.1",
+				"web.default.local. A 10.1.0.2",
+				"web-0.web.default.local. A 10.1.0.1",
+				"web-1.web.default.local. A 10.1.0.2",
+				"1.0.1.10.in-addr.arpa. PTR web.default.local.",
+				"2.0.1.10.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "endpoint weights",
+			service: func() *corev1.Service {
+				service := testHeadlessService()
+				service.Annotations[endpointWeightsAnnotation] = `{"web-0": 10, "10.1.0.2": 30}`
+				return service
+			}(),
+			endpoints: statefulSetEndpoints("10.1.0.1", "10.1.0.2", "10.1.0.3"),
+			cfg:       Config{PodHostnames: true},
+			want: sortedStrings(
+				"web.default.local. A 10.1.0.1",
+				"web.default.local. A 10.1.0.2",
+				"web.default.local. A 10.1.0.3",
+				"web-0.web.default.local. A 10.1.0.1",
+				"web-1.web.default.local. A 10.1.0.2",
+				"web-2.web.default.local. A 10.1.0.3",
+				"1.0.1.10.in-addr.arpa. PTR web.default.local.",
+				"2.0.1.10.in-addr.arpa. PTR web.default.local.",
+				"3.0.1.10.in-addr.arpa. PTR web.default.local.",
+				"_http._tcp.local. PTR default/web._http._tcp.local.",
+				"default/web._http._tcp.local. SRV 0 10 8080 web-0.web.default.local.",
+				"default/web._http._tcp.local. SRV 0 30 8080 web-1.web.default.local.",
+				"default/web._http._tcp.local. SRV 0 0 8080 web-2.web.default.local.",
+				`default/web._http._tcp.local. TXT ""`,
+			),
+		},
+		{
+			name: "endpoint weights out of range",
+			service: func() *corev1.Service {
+				service := testHeadlessService()
+				service.Annotations[endpointWeightsAnnotation] = `{"web-0": 70000}`
+				return service
+			}(),
+			endpoints: statefulSetEndpoints("10.1.0.1"),
+			cfg:       Config{PodHostnames: true},
+			want: sortedStrings(
+				"web.default.local. A 10.1.0.1",
+				"web-0.web.default.local. A 10.1.0.1",
+				"1.0.1.10.in-addr.arpa. PTR web.default.local.",
+				"_http._tcp.local. PTR default/web._http._tcp.local.",
+				"default/web._http._tcp.local. SRV 0 0 8080 web-0.web.default.local.",
+				`default/web._http._tcp.local. TXT ""`,
+			),
+		},
+		{
+			name:      "StatefulSet pods without pod hostnames",
+			service:   testHeadlessService(),
+			endpoints: statefulSetEndpoints("10.1.0.1", "10.1.0.2"),
+			want: sortedStrings(
+				"web.default.local. A 10.1.0.1",
+				"web.default.local. A 10.1.0.2",
+				"1.0.1.10.in-addr.arpa. PTR web.default.local.",
+				"2.0.1.10.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Duplicates are left to the record set
+			got := recordStrings(uniqueRecords(BuildEndpointsRecords(tt.endpoints, tt.service, tt.cfg)))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("BuildEndpointsRecords() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestEndpointsRemoval(t *testing.T) {
+	cfg := Config{ReverseConflict: ReverseConflictAll}
+	notify := make(chan resource.Resource, 10)
+	r := newRecordSet("endpoints", notify, cfg)
+	service := testHeadlessService()
+
+	r.publish("default/web", BuildEndpointsRecords(testEndpoints("10.1.0.1", "10.1.0.2", "10.1.0.3"), service, cfg))
+	if res := receive(t, notify); res.Action != resource.Added || len(res.Records) != 6 {
+		t.Fatalf("got %s of %v, want the records of three endpoints added", res.Action, recordStrings(res.Records))
+	}
+
+	// Only the records of the departed endpoint are withdrawn
+	r.publish("default/web", BuildEndpointsRecords(testEndpoints("10.1.0.1", "10.1.0.3"), service, cfg))
+	res := receive(t, notify)
+	want := sortedStrings(
+		"web.default.local. A 10.1.0.2",
+		"2.0.1.10.in-addr.arpa. PTR web.default.local.",
+	)
+	if got := recordStrings(res.Records); res.Action != resource.Deleted || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s of %v, want %s of %v", res.Action, got, resource.Deleted, want)
+	}
+	expectNone(t, notify)
+}
+
+func TestEndpointsSourceServiceChange(t *testing.T) {
+	service := testHeadlessService()
+	client := fake.NewSimpleClientset(service, testEndpoints("10.1.0.1"))
+	factory := informers.NewSharedInformerFactory(client, 0)
+	notify := make(chan resource.Resource, 10)
+	e := NewEndpointsWatcher(factory, Config{ReverseConflict: ReverseConflictAll}, notify)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	e.Run(stop)
+
+	if res := receive(t, notify); res.Action != resource.Added {
+		t.Fatalf("got %s, want the records of the endpoints added", res.Action)
+	}
+
+	// Removing the annotation of the service withdraws the records, although
+	// the endpoints did not change
+	unannotated := service.DeepCopy()
+	unannotated.Annotations = nil
+	if _, err := client.CoreV1().Services(service.Namespace).Update(context.TODO(), unannotated, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if res := receive(t, notify); res.Action != resource.Deleted || len(res.Records) != 2 {
+		t.Errorf("got %s of %v, want the records of the endpoints withdrawn", res.Action, recordStrings(res.Records))
+	}
+}
+
+func TestHasMinReadyEndpoints(t *testing.T) {
+	tests := []struct {
+		name      string
+		minReady  string
+		endpoints *corev1.Endpoints
+		want      bool
+	}{
+		{name: "no annotation", endpoints: nil, want: true},
+		{name: "enough ready", minReady: "2", endpoints: testEndpoints("10.1.0.1", "10.1.0.2"), want: true},
+		{name: "too few ready", minReady: "3", endpoints: testEndpoints("10.1.0.1", "10.1.0.2"), want: false},
+		{name: "no endpoints", minReady: "1", endpoints: nil, want: false},
+		{name: "zero", minReady: "0", endpoints: nil, want: true},
+		{name: "invalid", minReady: "two", endpoints: testEndpoints("10.1.0.1", "10.1.0.2"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := testService()
+			if tt.minReady != "" {
+				service.Annotations[minReadyAnnotation] = tt.minReady
+			}
+			if got := hasMinReadyEndpoints(service, tt.endpoints); got != tt.want {
+				t.Errorf("hasMinReadyEndpoints() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMinReadyEndpointsThreshold(t *testing.T) {
+	service := testService()
+	service.Annotations[minReadyAnnotation] = "2"
+	client := fake.NewSimpleClientset(service, testEndpoints("10.1.0.1"))
+	factory := informers.NewSharedInformerFactory(client, 0)
+	notify := make(chan resource.Resource, 10)
+	s := NewServicesWatcher(factory, Config{ReverseConflict: ReverseConflictAll, WatchEndpoints: true}, notify)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	s.Run(stop)
+	expectNone(t, notify)
+
+	steps := []struct {
+		ips    []string
+		action string
+	}{
+		{ips: []string{"10.1.0.1", "10.1.0.2"}, action: resource.Added},
+		{ips: []string{"10.1.0.2"}, action: resource.Deleted},
+	}
+	for _, step := range steps {
+		if _, err := client.CoreV1().Endpoints("default").Update(context.TODO(), testEndpoints(step.ips...), metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		if res := receive(t, notify); res.Action != step.action {
+			t.Errorf("got %s with %d ready endpoints, want %s", res.Action, len(step.ips), step.action)
+		}
+	}
+}
+
+func TestMinReadyEndpointsWithoutEndpoints(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	service := testService()
+	service.Annotations[minReadyAnnotation] = "1"
+	client := fake.NewSimpleClientset(service, testEndpoints("10.1.0.1"))
+	factory := informers.NewSharedInformerFactory(client, 0)
+	notify := make(chan resource.Resource, 10)
+	s := NewServicesWatcher(factory, Config{ReverseConflict: ReverseConflictAll}, notify)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	s.Run(stop)
+	s.Reconcile()
+
+	// The readiness can not be checked, so the service is withheld
+	expectNone(t, notify)
+	if n := strings.Count(buf.String(), "requires -source=endpoints"); n != 1 {
+		t.Errorf("logged the missing endpoints source %d times, want once:\n%s", n, buf.String())
+	}
+}
+
+func TestReadyPortsOnly(t *testing.T) {
+	service := testService()
+	service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP})
+	// endpoints returns the endpoints of the service with the HTTPS port
+	// served by a ready or an unready address
+	endpoints := func(httpsReady bool) *corev1.Endpoints {
+		e := testEndpoints("10.1.0.1")
+		https := corev1.EndpointSubset{Ports: []corev1.EndpointPort{{Name: "https", Port: 8443, Protocol: corev1.ProtocolTCP}}}
+		if httpsReady {
+			https.Addresses = []corev1.EndpointAddress{{IP: "10.1.0.2"}}
+		} else {
+			https.NotReadyAddresses = []corev1.EndpointAddress{{IP: "10.1.0.2"}}
+		}
+		e.Subsets = append(e.Subsets, https)
+		return e
+	}
+	client := fake.NewSimpleClientset(service, endpoints(false))
+	factory := informers.NewSharedInformerFactory(client, 0)
+	notify := make(chan resource.Resource, 10)
+	s := NewServicesWatcher(factory, Config{ReverseConflict: ReverseConflictAll, WatchEndpoints: true, ReadyPortsOnly: true}, notify)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	s.Run(stop)
+	res := receive(t, notify)
+	if res.Action != resource.Added {
+		t.Fatalf("got %s, want the records of the service added", res.Action)
+	}
+	for _, rr := range recordStrings(res.Records) {
+		if strings.Contains(rr, "_https._tcp") {
+			t.Errorf("published %s of the unready port", rr)
+		}
+	}
+
+	https := []string{
+		"_https._tcp.local. PTR default/web._https._tcp.local.",
+		"default/web._https._tcp.local. SRV 0 0 443 web.default.local.",
+		`default/web._https._tcp.local. TXT ""`,
+	}
+	steps := []struct {
+		ready  bool
+		action string
+	}{
+		{ready: true, action: resource.Added},
+		{ready: false, action: resource.Deleted},
+	}
+	for _, step := range steps {
+		if _, err := client.CoreV1().Endpoints("default").Update(context.TODO(), endpoints(step.ready), metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		res := receive(t, notify)
+		if got := recordStrings(res.Records); res.Action != step.action || !reflect.DeepEqual(got, https) {
+			t.Errorf("got %s of %v with the port ready %v, want %s of %v", res.Action, got, step.ready, step.action, https)
+		}
+	}
+	expectNone(t, notify)
+}
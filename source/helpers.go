@@ -19,11 +19,58 @@ import (
 	"net"
 	"strings"
 
+	"github.com/blake/external-mdns/resource"
 	"github.com/miekg/dns"
 	corev1 "k8s.io/api/core/v1"
 )
 
-func buildARecord (name string, addr net.IP, addReverse bool) []dns.RR {
+var privateNetworks = parseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+)
+
+// localIPv6Networks are the IPv6 link-local and unique local ranges, which
+// are not meant to be reverse resolved on the LAN
+var localIPv6Networks = parseCIDRs(
+	"fe80::/10",
+	"fc00::/7",
+)
+
+// cgnatNetworks is the shared address space of carrier-grade NAT (RFC 6598),
+// also used by overlay networks such as Tailscale
+var cgnatNetworks = parseCIDRs(
+	"100.64.0.0/10",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func containsAddress(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPrivateAddress reports whether ip is an RFC 1918 or RFC 4193 address
+func isPrivateAddress(ip net.IP) bool {
+	return containsAddress(privateNetworks, ip)
+}
+
+func buildARecord (name string, addr net.IP, addForward bool, addReverse bool) []dns.RR {
 	var reverseIP strings.Builder
 	var reverse dns.RR
 	var forward dns.RR
@@ -58,18 +105,51 @@ func buildARecord (name string, addr net.IP, addReverse bool) []dns.RR {
 		}
 	}
 
+	var records []dns.RR
+	if addForward {
+		records = append(records, forward)
+	}
 	if addReverse {
-		return []dns.RR{forward, reverse}
-	} else {
-		return []dns.RR{forward}
+		records = append(records, reverse)
+	}
+	return records
+}
+
+// buildAddressRecords is buildARecord with the AAAA record synthesized from
+// an IPv4 address with the NAT64 prefix added, if configured.
+func buildAddressRecords(name string, addr net.IP, addForward bool, addReverse bool, cfg Config) []dns.RR {
+	records := buildARecord(name, addr, addForward, addReverse)
+	if cfg.NAT64Prefix != nil && addForward && addr.To4() != nil {
+		records = append(records, buildARecord(name, nat64Address(cfg.NAT64Prefix, addr), true, false)...)
+	}
+	return records
+}
+
+// nat64Address embeds the IPv4 address addr in the NAT64 prefix as described
+// in RFC 6052, section 2.2, skipping bits 64 to 71.
+func nat64Address(prefix *net.IPNet, addr net.IP) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, prefix.IP.To16())
+	ones, _ := prefix.Mask.Size()
+	pos := ones / 8
+	for _, b := range addr.To4() {
+		if pos == 8 {
+			pos++
+		}
+		ip[pos] = b
+		pos++
 	}
+	return ip
 }
 
-func buildSRVRecord (instancename string, servicename string, protocol corev1.Protocol, hostname string, port uint16, txt []string) []dns.RR {
+func buildSRVRecord (instancename string, servicename string, protocol corev1.Protocol, hostname string, port uint16, targetPort string, txt []string, cfg Config) []dns.RR {
 	if instancename == "" || servicename == "" || hostname == "" || port == 0 {
 		return []dns.RR{}
 	}
 
+	if cfg.TargetPortTXT && targetPort != "" {
+		txt = append(append([]string{}, txt...), fmt.Sprintf("targetPort=%s", targetPort))
+	}
 	if len(txt) == 0 {
 		txt = []string{""}
 	}
@@ -83,11 +163,14 @@ func buildSRVRecord (instancename string, servicename string, protocol corev1.Pr
 	default:
 		return []dns.RR{}
 	}
+	if cfg.ProtocolLabelCase == LabelCaseUpper {
+		proto = strings.ToUpper(proto)
+	}
 
         dnsservice := fmt.Sprintf("_%s._%s.local.", strings.ToLower(servicename), proto)
         dnsinstance := fmt.Sprintf("%s.%s", instancename, dnsservice)
 
-	return []dns.RR {
+	records := []dns.RR {
 		&dns.PTR{
 			Hdr: dns.RR_Header{Name: dnsservice, Rrtype: dns.TypePTR},
 			Ptr: dnsinstance,
@@ -104,4 +187,131 @@ func buildSRVRecord (instancename string, servicename string, protocol corev1.Pr
 	        	Txt: txt,
 	        },
 	}
+
+	if cfg.ServiceEnumeration {
+		// Service type enumeration, RFC 6763 section 9
+		records = append(records, &dns.PTR{
+			Hdr: dns.RR_Header{Name: "_services._dns-sd._udp.local.", Rrtype: dns.TypePTR},
+			Ptr: dnsservice,
+		})
+	}
+
+	return records
+}
+
+// BuildBrowsingDomainRecords returns the DNS-SD domain enumeration pointers
+// (RFC 6763, section 11) that let clients in the given subnet discover that
+// services are browsable in the "local." domain.
+func BuildBrowsingDomainRecords(subnet *net.IPNet) []dns.RR {
+	reverseZone, err := dns.ReverseAddr(subnet.IP.Mask(subnet.Mask).String())
+	if err != nil {
+		return []dns.RR{}
+	}
+
+	var records []dns.RR
+	for _, label := range []string{"b", "db", "lb"} {
+		records = append(records, &dns.PTR{
+			Hdr: dns.RR_Header{Name: fmt.Sprintf("%s._dns-sd._udp.%s", label, reverseZone), Rrtype: dns.TypePTR},
+			Ptr: "local.",
+		})
+	}
+
+	return records
+}
+
+// isLocalName reports whether name, fully qualified or not, is in the .local
+// domain. Domain names are case-insensitive, so is the check.
+func isLocalName(name string) bool {
+	return strings.HasSuffix(strings.ToLower(dns.Fqdn(name)), ".local.")
+}
+
+// BuildHostRecords returns the address records, including the reverse PTR, to
+// advertise ip under the given hostname in the .local domain.
+func BuildHostRecords(hostname string, ip net.IP, cfg Config) []dns.RR {
+	return buildAddressRecords(qualifyHostname(hostname), ip, !cfg.ReverseOnly, cfg.publishReverse(ip), cfg)
+}
+
+// QualifyHostname turns hostname into a fully qualified .local name
+func QualifyHostname(hostname string) string {
+	return qualifyHostname(hostname)
+}
+
+// BuildAliasRecords returns a CNAME in the alias domain for the name of every
+// A and AAAA record in the .local domain, e.g. x.home.local. for x.local. if
+// domain is home.local. Names shared by several records get one CNAME each.
+func BuildAliasRecords(records []dns.RR, domain string) []dns.RR {
+	var aliases []dns.RR
+	for _, rr := range records {
+		name := rr.Header().Name
+		if (rr.Header().Rrtype != dns.TypeA && rr.Header().Rrtype != dns.TypeAAAA) || !isLocalName(name) {
+			continue
+		}
+		aliases = append(aliases, &dns.CNAME{
+			Hdr:    dns.RR_Header{Name: name[:len(name)-len("local.")] + dns.Fqdn(domain), Rrtype: dns.TypeCNAME},
+			Target: name,
+		})
+	}
+	return aliases
+}
+
+// uniqueRecords returns records without duplicates, records with the same
+// name, type and data, keeping the first of each
+func uniqueRecords(records []dns.RR) []dns.RR {
+	var unique []dns.RR
+	for _, rr := range records {
+		if len(diffRecords([]dns.RR{rr}, unique)) > 0 {
+			unique = append(unique, rr)
+		}
+	}
+	return unique
+}
+
+// copyRecords returns deep copies of records
+func copyRecords(records []dns.RR) []dns.RR {
+	copies := make([]dns.RR, 0, len(records))
+	for _, rr := range records {
+		copies = append(copies, dns.Copy(rr))
+	}
+	return copies
+}
+
+// diffRecords returns the records of a which are not contained in b
+func diffRecords(a []dns.RR, b []dns.RR) []dns.RR {
+	var diff []dns.RR
+	for _, rr := range a {
+		found := false
+		for _, other := range b {
+			if dns.IsDuplicate(rr, other) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			diff = append(diff, rr)
+		}
+	}
+	return diff
+}
+
+// notifyUpdate withdraws the records which are no longer part of an object
+// and publishes the ones which were added, leaving unchanged records alone.
+func notifyUpdate(notifyChan chan<- resource.Resource, sourceType string, namespace string, name string, oldRecords []dns.RR, newRecords []dns.RR) {
+	if removed := diffRecords(oldRecords, newRecords); len(removed) > 0 {
+		notifyChan <- resource.Resource{
+			SourceType: sourceType,
+			Action:     resource.Deleted,
+			Namespace:  namespace,
+			Name:       name,
+			Records:    removed,
+		}
+	}
+	if added := diffRecords(newRecords, oldRecords); len(added) > 0 {
+		notifyChan <- resource.Resource{
+			SourceType: sourceType,
+			Action:     resource.Added,
+			Namespace:  namespace,
+			Name:       name,
+			Records:    added,
+		}
+	}
 }
@@ -0,0 +1,374 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/blake/external-mdns/resource"
+	"github.com/miekg/dns"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// parseRecords parses records in presentation format
+func parseRecords(t *testing.T, strs ...string) []dns.RR {
+	t.Helper()
+	var records []dns.RR
+	for _, s := range strs {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, rr)
+	}
+	return records
+}
+
+func TestDiffRecords(t *testing.T) {
+	tests := []struct {
+		name string
+		a    []string
+		b    []string
+		want []string
+	}{
+		{
+			name: "empty",
+			want: []string{},
+		},
+		{
+			name: "nothing to compare with",
+			a:    []string{"web.local. A 10.0.0.10", "web.local. A 10.0.0.11"},
+			want: []string{"web.local. A 10.0.0.10", "web.local. A 10.0.0.11"},
+		},
+		{
+			name: "equal",
+			a:    []string{"web.local. A 10.0.0.10", "web.local. A 10.0.0.11"},
+			b:    []string{"web.local. A 10.0.0.11", "web.local. A 10.0.0.10"},
+			want: []string{},
+		},
+		{
+			name: "changed address",
+			a:    []string{"web.local. A 10.0.0.10", "web.local. A 10.0.0.11"},
+			b:    []string{"web.local. A 10.0.0.10", "web.local. A 10.0.0.12"},
+			want: []string{"web.local. A 10.0.0.11"},
+		},
+		{
+			name: "changed port",
+			a:    []string{"web._http._tcp.local. SRV 0 0 80 web.local."},
+			b:    []string{"web._http._tcp.local. SRV 0 0 8080 web.local."},
+			want: []string{"web._http._tcp.local. SRV 0 0 80 web.local."},
+		},
+		{
+			name: "same data of another type",
+			a:    []string{"web.local. A 10.0.0.10"},
+			b:    []string{"web.local. AAAA ::ffff:10.0.0.10"},
+			want: []string{"web.local. A 10.0.0.10"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := recordStrings(diffRecords(parseRecords(t, tt.a...), parseRecords(t, tt.b...)))
+			if want := recordStrings(parseRecords(t, tt.want...)); !reflect.DeepEqual(got, want) {
+				t.Errorf("diffRecords() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestNotifyUpdate(t *testing.T) {
+	notify := make(chan resource.Resource, 2)
+	oldRecords := parseRecords(t, "web.local. A 10.0.0.10", "web._http._tcp.local. SRV 0 0 80 web.local.")
+	newRecords := parseRecords(t, "web.local. A 10.0.0.10", "web._http._tcp.local. SRV 0 0 8080 web.local.")
+
+	notifyUpdate(notify, "service", "default", "web", oldRecords, newRecords)
+	close(notify)
+
+	var got []resource.Resource
+	for res := range notify {
+		got = append(got, res)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d notifications, want 2", len(got))
+	}
+	if got[0].Action != resource.Deleted || !reflect.DeepEqual(recordStrings(got[0].Records), []string{"web._http._tcp.local. SRV 0 0 80 web.local."}) {
+		t.Errorf("got %s of %v, want the old SRV record deleted", got[0].Action, recordStrings(got[0].Records))
+	}
+	if got[1].Action != resource.Added || !reflect.DeepEqual(recordStrings(got[1].Records), []string{"web._http._tcp.local. SRV 0 0 8080 web.local."}) {
+		t.Errorf("got %s of %v, want the new SRV record added", got[1].Action, recordStrings(got[1].Records))
+	}
+}
+
+func TestNotifyUpdateUnchanged(t *testing.T) {
+	notify := make(chan resource.Resource, 2)
+	records := parseRecords(t, "web.local. A 10.0.0.10")
+
+	notifyUpdate(notify, "service", "default", "web", records, parseRecords(t, "web.local. A 10.0.0.10"))
+	expectNone(t, notify)
+}
+
+func TestUniqueRecords(t *testing.T) {
+	records := parseRecords(t,
+		"_http._tcp.local. PTR web._http._tcp.local.",
+		"web.local. A 10.0.0.10",
+		"_http._tcp.local. PTR web._http._tcp.local.",
+		"web.local. A 10.0.0.11",
+		"web.local. A 10.0.0.10",
+	)
+	want := []string{
+		"_http._tcp.local. PTR web._http._tcp.local.",
+		"web.local. A 10.0.0.10",
+		"web.local. A 10.0.0.11",
+	}
+	if got := recordStrings(uniqueRecords(records)); !reflect.DeepEqual(got, want) {
+		t.Errorf("uniqueRecords() = %v, want %v", got, want)
+	}
+}
+
+func TestRecordSetDuplicates(t *testing.T) {
+	notify := make(chan resource.Resource, 10)
+	r := newRecordSet("endpoints", notify, Config{ReverseConflict: ReverseConflictAll})
+
+	// The PTR record shared by two SRV records is published once
+	records := parseRecords(t,
+		"_http._tcp.local. PTR web._http._tcp.local.",
+		"_http._tcp.local. PTR web._http._tcp.local.",
+	)
+	r.publish("default/web", records)
+	if res := receive(t, notify); len(res.Records) != 1 {
+		t.Errorf("published %v, want the shared record once", recordStrings(res.Records))
+	}
+
+	r.publish("default/web", nil)
+	if res := receive(t, notify); res.Action != resource.Deleted || len(res.Records) != 1 {
+		t.Errorf("got %s of %v, want the shared record withdrawn once", res.Action, recordStrings(res.Records))
+	}
+}
+
+func TestBuildBrowsingDomainRecords(t *testing.T) {
+	tests := []struct {
+		subnet string
+		want   []string
+	}{
+		{
+			subnet: "192.168.1.0/24",
+			want: sortedStrings(
+				"b._dns-sd._udp.0.1.168.192.in-addr.arpa. PTR local.",
+				"db._dns-sd._udp.0.1.168.192.in-addr.arpa. PTR local.",
+				"lb._dns-sd._udp.0.1.168.192.in-addr.arpa. PTR local.",
+			),
+		},
+		{
+			// The network address is used for hosts within the subnet
+			subnet: "10.1.2.3/8",
+			want: sortedStrings(
+				"b._dns-sd._udp.0.0.0.10.in-addr.arpa. PTR local.",
+				"db._dns-sd._udp.0.0.0.10.in-addr.arpa. PTR local.",
+				"lb._dns-sd._udp.0.0.0.10.in-addr.arpa. PTR local.",
+			),
+		},
+		{
+			subnet: "fd00::/64",
+			want: sortedStrings(
+				"b._dns-sd._udp.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa. PTR local.",
+				"db._dns-sd._udp.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa. PTR local.",
+				"lb._dns-sd._udp.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa. PTR local.",
+			),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.subnet, func(t *testing.T) {
+			_, subnet, err := net.ParseCIDR(tt.subnet)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := recordStrings(BuildBrowsingDomainRecords(subnet)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("BuildBrowsingDomainRecords() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProtocolLabelCase(t *testing.T) {
+	tests := []struct {
+		labelCase string
+		protocol  corev1.Protocol
+		want      []string
+	}{
+		{
+			labelCase: "",
+			protocol:  corev1.ProtocolTCP,
+			want: sortedStrings(
+				"_http._tcp.local. PTR web._http._tcp.local.",
+				"web._http._tcp.local. SRV 0 0 80 web.local.",
+				`web._http._tcp.local. TXT ""`,
+			),
+		},
+		{
+			labelCase: LabelCaseLower,
+			protocol:  corev1.ProtocolUDP,
+			want: sortedStrings(
+				"_http._udp.local. PTR web._http._udp.local.",
+				"web._http._udp.local. SRV 0 0 80 web.local.",
+				`web._http._udp.local. TXT ""`,
+			),
+		},
+		{
+			labelCase: LabelCaseUpper,
+			protocol:  corev1.ProtocolTCP,
+			want: sortedStrings(
+				"_http._TCP.local. PTR web._http._TCP.local.",
+				"web._http._TCP.local. SRV 0 0 80 web.local.",
+				`web._http._TCP.local. TXT ""`,
+			),
+		},
+		{
+			labelCase: LabelCaseUpper,
+			protocol:  corev1.ProtocolUDP,
+			want: sortedStrings(
+				"_http._UDP.local. PTR web._http._UDP.local.",
+				"web._http._UDP.local. SRV 0 0 80 web.local.",
+				`web._http._UDP.local. TXT ""`,
+			),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.labelCase+" "+string(tt.protocol), func(t *testing.T) {
+			records := buildSRVRecord("web", "http", tt.protocol, "web.local.", 80, "", nil, Config{ProtocolLabelCase: tt.labelCase})
+			if got := recordStrings(records); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("buildSRVRecord() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildAliasRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		records []string
+		domain  string
+		want    []string
+	}{
+		{
+			name:    "address records",
+			records: []string{"web.default.local. A 10.0.0.10", "db.local. AAAA fd00::10"},
+			domain:  "home.local",
+			want: sortedStrings(
+				"web.default.home.local. CNAME web.default.local.",
+				"db.home.local. CNAME db.local.",
+			),
+		},
+		{
+			name: "other records",
+			records: []string{
+				"_http._tcp.local. PTR web._http._tcp.local.",
+				"web._http._tcp.local. SRV 0 0 80 web.local.",
+				`web._http._tcp.local. TXT "path=/"`,
+				"10.0.0.10.in-addr.arpa. PTR web.local.",
+			},
+			domain: "home.local.",
+			want:   []string{},
+		},
+		{
+			name:    "outside .local",
+			records: []string{"web.example.com. A 10.0.0.10"},
+			domain:  "home.local.",
+			want:    []string{},
+		},
+		{
+			name:    "dual-stack name",
+			records: []string{"web.local. A 10.0.0.10", "web.local. AAAA fd00::10"},
+			domain:  "home.local.",
+			want:    []string{"web.home.local. CNAME web.local.", "web.home.local. CNAME web.local."},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := recordStrings(BuildAliasRecords(parseRecords(t, tt.records...), tt.domain))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("BuildAliasRecords() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsLocalName(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "app.local", want: true},
+		{name: "app.local.", want: true},
+		{name: "App.LOCAL", want: true},
+		{name: "api.Local.", want: true},
+		{name: "app.example.com", want: false},
+		{name: "applocal", want: false},
+		{name: "app.local.example.com", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := isLocalName(tt.name); got != tt.want {
+			t.Errorf("isLocalName(%q) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	// Mixed-case .local names are not qualified a second time
+	if got := qualifyHostname("Printer.LOCAL"); got != "Printer.LOCAL." {
+		t.Errorf("qualifyHostname() = %q, want %q", got, "Printer.LOCAL.")
+	}
+}
+
+func TestNAT64(t *testing.T) {
+	tests := []struct {
+		prefix string
+		addr   string
+		want   string
+	}{
+		// Examples of RFC 6052, section 2.4
+		{prefix: "64:ff9b::/96", addr: "192.0.2.33", want: "64:ff9b::c000:221"},
+		{prefix: "2001:db8::/32", addr: "192.0.2.33", want: "2001:db8:c000:221::"},
+		{prefix: "2001:db8:100::/40", addr: "192.0.2.33", want: "2001:db8:1c0:2:21::"},
+		{prefix: "2001:db8:122::/48", addr: "192.0.2.33", want: "2001:db8:122:c000:2:2100::"},
+		{prefix: "2001:db8:122:300::/56", addr: "192.0.2.33", want: "2001:db8:122:3c0:0:221::"},
+		{prefix: "2001:db8:122:344::/64", addr: "192.0.2.33", want: "2001:db8:122:344:c0:2:2100:0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			_, prefix, err := net.ParseCIDR(tt.prefix)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := recordStrings(buildAddressRecords("web.local.", net.ParseIP(tt.addr), true, false, Config{NAT64Prefix: prefix}))
+			want := sortedStrings("web.local. A "+tt.addr, "web.local. AAAA "+tt.want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("buildAddressRecords() = %v, want %v", got, want)
+			}
+		})
+	}
+
+	// IPv6 addresses and reverse-only records are left alone
+	_, prefix, _ := net.ParseCIDR("64:ff9b::/96")
+	if got := recordStrings(buildAddressRecords("web.local.", net.ParseIP("fd00::10"), true, false, Config{NAT64Prefix: prefix})); !reflect.DeepEqual(got, []string{"web.local. AAAA fd00::10"}) {
+		t.Errorf("buildAddressRecords() of IPv6 address = %v, want it unchanged", got)
+	}
+	if got := recordStrings(buildAddressRecords("web.local.", net.ParseIP("192.0.2.33"), false, true, Config{NAT64Prefix: prefix})); !reflect.DeepEqual(got, []string{"33.2.0.192.in-addr.arpa. PTR web.local."}) {
+		t.Errorf("buildAddressRecords() of reverse record = %v, want no AAAA record", got)
+	}
+}
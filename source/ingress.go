@@ -16,11 +16,14 @@ package source
 
 import (
 	"fmt"
+	"log"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/blake/external-mdns/resource"
 	"github.com/miekg/dns"
+	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/api/networking/v1"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/informers"
@@ -29,83 +32,322 @@ import (
 
 // IngressSource handles adding, updating, or removing mDNS record advertisements
 type IngressSource struct {
-	namespace      string
-	notifyChan     chan<- resource.Resource
-	sharedInformer cache.SharedIndexInformer
+	config          Config
+	sharedInformer  cache.SharedIndexInformer
+	serviceInformer cache.SharedIndexInformer
+	*recordSet
 }
 
-// Run starts shared informers and waits for the shared informer cache to
-// synchronize.
+// Run waits for the shared informer cache to synchronize. The informer itself
+// is started through the SharedInformerFactory it was created from.
 func (i *IngressSource) Run(stopCh chan struct{}) error {
-	i.sharedInformer.Run(stopCh)
-	if !cache.WaitForCacheSync(stopCh, i.sharedInformer.HasSynced) {
+	synced := []cache.InformerSynced{i.sharedInformer.HasSynced}
+	if i.serviceInformer != nil {
+		synced = append(synced, i.serviceInformer.HasSynced)
+	}
+	if !cache.WaitForCacheSync(stopCh, synced...) {
 		runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
 	}
+	if i.config.LoadBalancerHostnameMode == LoadBalancerHostnameResolve && i.config.LoadBalancerHostnameRefresh > 0 {
+		go i.refreshResolvedHostnames(stopCh)
+	}
 	return nil
 }
 
-func (i *IngressSource) onAdd(obj interface{}) {
-	i.notifyChan <- resource.Resource {
-		SourceType: "ingress",
-		Action:     resource.Added,
-		Records:    i.buildRecords(obj),
+// refreshResolvedHostnames resolves the load balancer hostnames of all
+// ingresses again at every LoadBalancerHostnameRefresh, like the service
+// source does for services.
+func (i *IngressSource) refreshResolvedHostnames(stopCh chan struct{}) {
+	ticker := time.NewTicker(i.config.LoadBalancerHostnameRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			loadBalancerLookups.clear()
+			for _, obj := range i.sharedInformer.GetStore().List() {
+				if ingress, ok := obj.(*v1.Ingress); ok && hasLoadBalancerHostname(ingress) {
+					i.sync(ingress)
+				}
+			}
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// hasLoadBalancerHostname reports whether the load balancer of the ingress
+// reports a hostname
+func hasLoadBalancerHostname(ingress *v1.Ingress) bool {
+	for _, lb := range ingress.Status.LoadBalancer.Ingress {
+		if lb.Hostname != "" {
+			return true
+		}
 	}
+	return false
+}
+
+func (i *IngressSource) onAdd(obj interface{}) {
+	i.sync(obj)
 }
 
 func (i *IngressSource) onDelete(obj interface{}) {
-	i.notifyChan <- resource.Resource {
-		SourceType: "ingress",
-		Action:     resource.Deleted,
-		Records:    i.buildRecords(obj),
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	if i.isStale(key, obj) {
+		return
 	}
+
+	i.publish(key, nil)
 }
 
+// onUpdate only withdraws and publishes the records that changed
 func (i *IngressSource) onUpdate(oldObj interface{}, newObj interface{}) {
-	i.onDelete(oldObj)
-	i.onAdd(newObj)
+	i.sync(newObj)
 }
 
-func (i *IngressSource) buildRecords(obj interface{}) []dns.RR {
-	var records []dns.RR
+// onServiceChange re-evaluates all ingresses in the namespace of the service,
+// as their backends may have appeared or disappeared.
+func (i *IngressSource) onServiceChange(obj interface{}) {
+	namespace := ""
+	switch obj := obj.(type) {
+	case *corev1.Service:
+		namespace = obj.Namespace
+	case cache.DeletedFinalStateUnknown:
+		namespace, _, _ = cache.SplitMetaNamespaceKey(obj.Key)
+	}
 
+	ingresses, err := i.sharedInformer.GetIndexer().ByIndex(cache.NamespaceIndex, namespace)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	for _, ingress := range ingresses {
+		i.sync(ingress)
+	}
+}
+
+func (i *IngressSource) sync(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	if i.isStale(key, obj) {
+		return
+	}
+
+	i.publish(key, i.buildRecords(obj))
+}
+
+// Reconcile rebuilds the records of all ingresses and publishes any
+// differences to the records published before.
+func (i *IngressSource) Reconcile() {
+	i.reconcile(i.sharedInformer.GetStore(), i.buildRecords)
+}
+
+func (i *IngressSource) buildRecords(obj interface{}) []dns.RR {
 	ingress, ok := obj.(*v1.Ingress)
 	if !ok {
+		return nil
+	}
+
+	if i.serviceInformer != nil {
+		ingress = i.withoutMissingBackends(ingress)
+	}
+
+	return transform(i.sourceType, ingress, BuildIngressRecords(ingress, i.config))
+}
+
+// withoutMissingBackends returns a copy of the ingress without the rules
+// whose paths reference no existing backend service. TLS hosts of removed
+// rules are removed as well.
+func (i *IngressSource) withoutMissingBackends(ingress *v1.Ingress) *v1.Ingress {
+	filtered := ingress.DeepCopy()
+	filtered.Spec.Rules = nil
+
+	removed := map[string]bool{}
+	for _, rule := range ingress.Spec.Rules {
+		if i.hasBackend(ingress.Namespace, rule) {
+			filtered.Spec.Rules = append(filtered.Spec.Rules, rule)
+		} else {
+			removed[rule.Host] = true
+		}
+	}
+
+	for n, tls := range filtered.Spec.TLS {
+		var hosts []string
+		for _, host := range tls.Hosts {
+			if !removed[host] {
+				hosts = append(hosts, host)
+			}
+		}
+		filtered.Spec.TLS[n].Hosts = hosts
+	}
+
+	return filtered
+}
+
+// hasBackend reports whether any path of the rule references an existing
+// service.
+func (i *IngressSource) hasBackend(namespace string, rule v1.IngressRule) bool {
+	if rule.HTTP == nil {
+		return false
+	}
+	for _, path := range rule.HTTP.Paths {
+		if path.Backend.Service == nil {
+			continue
+		}
+		_, exists, err := i.serviceInformer.GetIndexer().GetByKey(namespace + "/" + path.Backend.Service.Name)
+		if err == nil && exists {
+			return true
+		}
+	}
+	return false
+}
+
+// isIngressReady reports whether the ingress controller has programmed the
+// load balancer of the ingress, i.e. whether none of its ports reports an
+// error. networking/v1 ingresses carry no status conditions, the port status
+// is the only readiness signal available.
+func isIngressReady(ingress *v1.Ingress) bool {
+	for _, lb := range ingress.Status.LoadBalancer.Ingress {
+		for _, port := range lb.Ports {
+			if port.Error != nil {
+				log.Printf("Not publishing ingress %s/%s: port %d/%s is not ready: %s", ingress.Namespace, ingress.Name, port.Port, port.Protocol, *port.Error)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// BuildIngressRecords returns the records to advertise for the given ingress.
+// It does not depend on any informer state.
+func BuildIngressRecords(ingress *v1.Ingress, cfg Config) []dns.RR {
+	var records []dns.RR
+
+	if cfg.IngressRequireReady && !isIngressReady(ingress) {
 		return records
 	}
 
 	var ip net.IP
+	var lbHostname string
 	for _, lb := range ingress.Status.LoadBalancer.Ingress {
-		if lb.IP != "" {
-			ip = net.ParseIP(lb.IP)
+		if lbIP := net.ParseIP(lb.IP); lbIP != nil && cfg.acceptsLoadBalancerAddress(lbIP) {
+			ip = lbIP
+		}
+		if lb.Hostname != "" {
+			lbHostname = dns.Fqdn(lb.Hostname)
 		}
 	}
 
-	if ip == nil {
+	if cfg.Namespace != "" && cfg.Namespace != ingress.Namespace {
 		return records
 	}
 
-        if i.namespace != "" && i.namespace != ingress.Namespace {
-                return records
-        }
+	// Ingress hosts only get forward records
+	if cfg.ReverseOnly {
+		return records
+	}
+
+	// Point the hosts to the load balancer hostname instead of its address if
+	// preferred. Without an address, the hostname is also used if load
+	// balancer hostnames are published as CNAMEs, or resolved if they are
+	// published by their addresses.
+	object := fmt.Sprintf("ingress %s/%s", ingress.Namespace, ingress.Name)
+	useHostname := cfg.IngressAddressPreference == IngressAddressHostname || (ip == nil && cfg.LoadBalancerHostnameMode == LoadBalancerHostnameCNAME)
+	var ips []net.IP
+	switch {
+	case lbHostname != "" && useHostname:
+		// The hosts become CNAMEs of lbHostname
+	case ip != nil:
+		if !cfg.checkReachable(ip, object) {
+			return records
+		}
+		ips, lbHostname = []net.IP{ip}, ""
+	case lbHostname != "" && cfg.LoadBalancerHostnameMode == LoadBalancerHostnameResolve:
+		ips, lbHostname = resolvedLoadBalancerAddresses(object, lbHostname, cfg), ""
+	default:
+		lbHostname = ""
+	}
+	if len(ips) == 0 && lbHostname == "" {
+		return records
+	}
 
-	// Advertise each hostname under this Ingress
+	// Advertise each hostname under this Ingress, including TLS (SNI) hosts,
+	// once even if several rules share it
+	var hosts []string
 	for _, rule := range ingress.Spec.Rules {
-		// Skip rules with no hostname or that do not use the .local TLD
-		if rule.Host != "" && strings.HasSuffix(rule.Host, ".local") {
-			records = append(records, buildARecord(fmt.Sprintf("%s.", rule.Host), ip, false)...)
+		hosts = append(hosts, rule.Host)
+	}
+	for _, tls := range ingress.Spec.TLS {
+		hosts = append(hosts, tls.Hosts...)
+	}
+
+	seen := map[string]bool{}
+	for _, host := range hosts {
+		if cfg.LowercaseHostnames {
+			host = strings.ToLower(host)
+		}
+		// Skip rules with no hostname or that do not use the .local TLD, in
+		// any casing
+		if host != "" && isLocalName(host) && !seen[strings.ToLower(host)] {
+			seen[strings.ToLower(host)] = true
+			if lbHostname != "" {
+				records = append(records, &dns.CNAME{
+					Hdr:    dns.RR_Header{Name: fmt.Sprintf("%s.", host), Rrtype: dns.TypeCNAME},
+					Target: lbHostname,
+				})
+				continue
+			}
+			for _, ip := range ips {
+				records = append(records, buildAddressRecords(fmt.Sprintf("%s.", host), ip, true, false, cfg)...)
+			}
+			if cfg.IngressServiceRecords {
+				records = append(records, ingressServiceRecords(ingress, host, cfg)...)
+			}
 		}
 	}
 
 	return records
 }
 
+// ingressServiceRecords returns the DNS-SD records of the web server at the
+// ingress host: _http._tcp, and _https._tcp if the host is in the TLS section.
+func ingressServiceRecords(ingress *v1.Ingress, host string, cfg Config) []dns.RR {
+	instancename := ingress.Namespace + cfg.instanceSeparator() + ingress.Name
+	if cfg.IngressInstanceName != IngressInstanceObject {
+		instancename, _ = splitInstanceName(dns.Fqdn(host))
+	}
+
+	records := buildSRVRecord(instancename, "http", corev1.ProtocolTCP, fmt.Sprintf("%s.", host), 80, "", nil, cfg)
+	for _, tls := range ingress.Spec.TLS {
+		for _, tlsHost := range tls.Hosts {
+			if strings.EqualFold(tlsHost, host) {
+				return append(records, buildSRVRecord(instancename, "https", corev1.ProtocolTCP, fmt.Sprintf("%s.", host), 443, "", nil, cfg)...)
+			}
+		}
+	}
+	return records
+}
+
 // NewIngressWatcher creates an IngressSource
-func NewIngressWatcher(factory informers.SharedInformerFactory, namespace string, notifyChan chan<- resource.Resource) IngressSource {
+func NewIngressWatcher(factory informers.SharedInformerFactory, config Config, notifyChan chan<- resource.Resource) *IngressSource {
 	ingressInformer := factory.Networking().V1().Ingresses().Informer()
 	i := &IngressSource{
-		namespace:      namespace,
-		notifyChan:     notifyChan,
+		config:         config,
 		sharedInformer: ingressInformer,
+		recordSet:      newRecordSet("ingress", notifyChan, config),
+	}
+	if config.IngressRequireBackend {
+		i.serviceInformer = factory.Core().V1().Services().Informer()
+		i.serviceInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    i.onServiceChange,
+			DeleteFunc: i.onServiceChange,
+		})
 	}
 
 	ingressInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
@@ -114,5 +356,5 @@ func NewIngressWatcher(factory informers.SharedInformerFactory, namespace string
 		UpdateFunc: i.onUpdate,
 	})
 
-	return *i
+	return i
 }
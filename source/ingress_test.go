@@ -0,0 +1,345 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/blake/external-mdns/resource"
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testIngress returns the ingress web in namespace default with a rule for
+// each host, served by a load balancer with an IP
+func testIngress(hosts ...string) *v1.Ingress {
+	ingress := &v1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+	}
+	for _, host := range hosts {
+		ingress.Spec.Rules = append(ingress.Spec.Rules, v1.IngressRule{Host: host})
+	}
+	ingress.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "192.168.1.20"}}
+	return ingress
+}
+
+func TestBuildIngressRecords(t *testing.T) {
+	portError := "Pending"
+	tests := []struct {
+		name    string
+		ingress *v1.Ingress
+		modify  func(ingress *v1.Ingress)
+		cfg     Config
+		want    []string
+	}{
+		{
+			name:    "local host",
+			ingress: testIngress("app.local"),
+			want:    []string{"app.local. A 192.168.1.20"},
+		},
+		{
+			name:    "IPv6 load balancer",
+			ingress: testIngress("app.local"),
+			modify: func(ingress *v1.Ingress) {
+				ingress.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "2001:db8::20"}}
+			},
+			want: []string{"app.local. AAAA 2001:db8::20"},
+		},
+		{
+			name:    "hosts outside .local and empty hosts",
+			ingress: testIngress("app.example.com", "", "app.local"),
+			want:    []string{"app.local. A 192.168.1.20"},
+		},
+		{
+			name:    "mixed-case hosts",
+			ingress: testIngress("App.LOCAL", "api.Local", "app.local"),
+			want: sortedStrings(
+				"App.LOCAL. A 192.168.1.20",
+				"api.Local. A 192.168.1.20",
+			),
+		},
+		{
+			name:    "mixed-case hosts lowercased",
+			ingress: testIngress("App.LOCAL", "api.Local"),
+			cfg:     Config{LowercaseHostnames: true},
+			want: sortedStrings(
+				"app.local. A 192.168.1.20",
+				"api.local. A 192.168.1.20",
+			),
+		},
+		{
+			name:    "host shared by several rules",
+			ingress: testIngress("app.local", "app.local", "api.local"),
+			want: sortedStrings(
+				"app.local. A 192.168.1.20",
+				"api.local. A 192.168.1.20",
+			),
+		},
+		{
+			name:    "TLS host",
+			ingress: testIngress("app.local"),
+			modify: func(ingress *v1.Ingress) {
+				ingress.Spec.TLS = []v1.IngressTLS{{Hosts: []string{"app.local", "secure.local"}}}
+			},
+			want: sortedStrings(
+				"app.local. A 192.168.1.20",
+				"secure.local. A 192.168.1.20",
+			),
+		},
+		{
+			name:    "no load balancer",
+			ingress: testIngress("app.local"),
+			modify: func(ingress *v1.Ingress) {
+				ingress.Status.LoadBalancer.Ingress = nil
+			},
+			want: []string{},
+		},
+		{
+			name:    "load balancer hostname",
+			ingress: testIngress("app.local"),
+			modify: func(ingress *v1.Ingress) {
+				ingress.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{Hostname: "lb.example.com"}}
+			},
+			want: []string{},
+		},
+		{
+			name:    "load balancer hostname preferred",
+			ingress: testIngress("app.local"),
+			modify: func(ingress *v1.Ingress) {
+				ingress.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{Hostname: "lb.example.com"}}
+			},
+			cfg:  Config{IngressAddressPreference: IngressAddressHostname},
+			want: []string{"app.local. CNAME lb.example.com."},
+		},
+		{
+			name:    "load balancer hostname as CNAME",
+			ingress: testIngress("app.local"),
+			modify: func(ingress *v1.Ingress) {
+				ingress.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{Hostname: "lb.example.com"}}
+			},
+			cfg:  Config{LoadBalancerHostnameMode: LoadBalancerHostnameCNAME},
+			want: []string{"app.local. CNAME lb.example.com."},
+		},
+		{
+			name:    "load balancer hostname resolved",
+			ingress: testIngress("app.local"),
+			modify: func(ingress *v1.Ingress) {
+				ingress.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{Hostname: "lb.example.com"}}
+			},
+			cfg: Config{LoadBalancerHostnameMode: LoadBalancerHostnameResolve},
+			want: sortedStrings(
+				"app.local. A 192.0.2.10",
+				"app.local. AAAA 2001:db8::10",
+			),
+		},
+		{
+			name:    "load balancer hostname resolved to IPv6",
+			ingress: testIngress("app.local"),
+			modify: func(ingress *v1.Ingress) {
+				ingress.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{Hostname: "lb.example.com"}}
+			},
+			cfg:  Config{LoadBalancerHostnameMode: LoadBalancerHostnameResolve, LoadBalancerHostnameFamily: AddressFamilyIPv6},
+			want: []string{"app.local. AAAA 2001:db8::10"},
+		},
+		{
+			name:    "load balancer hostname not resolving",
+			ingress: testIngress("app.local"),
+			modify: func(ingress *v1.Ingress) {
+				ingress.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{Hostname: "gone.example.com"}}
+			},
+			cfg:  Config{LoadBalancerHostnameMode: LoadBalancerHostnameResolve},
+			want: []string{},
+		},
+		{
+			name:    "IP and hostname resolved",
+			ingress: testIngress("app.local"),
+			modify: func(ingress *v1.Ingress) {
+				ingress.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "192.168.1.20", Hostname: "lb.example.com"}}
+			},
+			cfg:  Config{LoadBalancerHostnameMode: LoadBalancerHostnameResolve},
+			want: []string{"app.local. A 192.168.1.20"},
+		},
+		{
+			name:    "IP and hostname",
+			ingress: testIngress("app.local"),
+			modify: func(ingress *v1.Ingress) {
+				ingress.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "192.168.1.20", Hostname: "lb.example.com"}}
+			},
+			cfg:  Config{IngressAddressPreference: IngressAddressIP, LoadBalancerHostnameMode: LoadBalancerHostnameCNAME},
+			want: []string{"app.local. A 192.168.1.20"},
+		},
+		{
+			name:    "IP and hostname preferred",
+			ingress: testIngress("app.local"),
+			modify: func(ingress *v1.Ingress) {
+				ingress.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "192.168.1.20", Hostname: "lb.example.com"}}
+			},
+			cfg:  Config{IngressAddressPreference: IngressAddressHostname},
+			want: []string{"app.local. CNAME lb.example.com."},
+		},
+		{
+			name:    "other namespace",
+			ingress: testIngress("app.local"),
+			cfg:     Config{Namespace: "other"},
+			want:    []string{},
+		},
+		{
+			name:    "service records",
+			ingress: testIngress("app.local"),
+			modify: func(ingress *v1.Ingress) {
+				ingress.Spec.TLS = []v1.IngressTLS{{Hosts: []string{"app.local"}}}
+			},
+			cfg: Config{IngressServiceRecords: true},
+			want: sortedStrings(
+				"app.local. A 192.168.1.20",
+				"_http._tcp.local. PTR app._http._tcp.local.",
+				"app._http._tcp.local. SRV 0 0 80 app.local.",
+				`app._http._tcp.local. TXT ""`,
+				"_https._tcp.local. PTR app._https._tcp.local.",
+				"app._https._tcp.local. SRV 0 0 443 app.local.",
+				`app._https._tcp.local. TXT ""`,
+			),
+		},
+		{
+			name:    "service records of a subdomain host",
+			ingress: testIngress("myapp.office.local"),
+			cfg:     Config{IngressServiceRecords: true, IngressInstanceName: IngressInstanceHost},
+			want: sortedStrings(
+				"myapp.office.local. A 192.168.1.20",
+				"_http._tcp.local. PTR myapp._http._tcp.local.",
+				"myapp._http._tcp.local. SRV 0 0 80 myapp.office.local.",
+				`myapp._http._tcp.local. TXT ""`,
+			),
+		},
+		{
+			name:    "service records named after the ingress",
+			ingress: testIngress("myapp.local"),
+			cfg:     Config{IngressServiceRecords: true, IngressInstanceName: IngressInstanceObject},
+			want: sortedStrings(
+				"myapp.local. A 192.168.1.20",
+				"_http._tcp.local. PTR default/web._http._tcp.local.",
+				"default/web._http._tcp.local. SRV 0 0 80 myapp.local.",
+				`default/web._http._tcp.local. TXT ""`,
+			),
+		},
+		{
+			name:    "reverse only",
+			ingress: testIngress("app.local"),
+			cfg:     Config{ReverseOnly: true},
+			want:    []string{},
+		},
+		{
+			name:    "ready",
+			ingress: testIngress("app.local"),
+			modify: func(ingress *v1.Ingress) {
+				ingress.Status.LoadBalancer.Ingress[0].Ports = []corev1.PortStatus{{Port: 80, Protocol: corev1.ProtocolTCP}}
+			},
+			cfg:  Config{IngressRequireReady: true},
+			want: []string{"app.local. A 192.168.1.20"},
+		},
+		{
+			name:    "not ready",
+			ingress: testIngress("app.local"),
+			modify: func(ingress *v1.Ingress) {
+				ingress.Status.LoadBalancer.Ingress[0].Ports = []corev1.PortStatus{{Port: 80, Protocol: corev1.ProtocolTCP, Error: &portError}}
+			},
+			cfg:  Config{IngressRequireReady: true},
+			want: []string{},
+		},
+		{
+			name:    "not ready without the gate",
+			ingress: testIngress("app.local"),
+			modify: func(ingress *v1.Ingress) {
+				ingress.Status.LoadBalancer.Ingress[0].Ports = []corev1.PortStatus{{Port: 80, Protocol: corev1.ProtocolTCP, Error: &portError}}
+			},
+			want: []string{"app.local. A 192.168.1.20"},
+		},
+	}
+
+	oldLookupIP := lookupIP
+	lookupIP = func(host string) ([]net.IP, error) {
+		if host != "lb.example.com" {
+			return nil, fmt.Errorf("no such host %s", host)
+		}
+		return []net.IP{net.ParseIP("192.0.2.10"), net.ParseIP("2001:db8::10")}, nil
+	}
+	defer func() { lookupIP = oldLookupIP }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.modify != nil {
+				tt.modify(tt.ingress)
+			}
+			got := recordStrings(BuildIngressRecords(tt.ingress, tt.cfg))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("BuildIngressRecords() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+// withBackend makes the rule of host in ingress route to the service backend
+func withBackend(ingress *v1.Ingress, host string, backend string) *v1.Ingress {
+	for n, rule := range ingress.Spec.Rules {
+		if rule.Host == host {
+			ingress.Spec.Rules[n].HTTP = &v1.HTTPIngressRuleValue{
+				Paths: []v1.HTTPIngressPath{{
+					Path:    "/",
+					Backend: v1.IngressBackend{Service: &v1.IngressServiceBackend{Name: backend}},
+				}},
+			}
+		}
+	}
+	return ingress
+}
+
+func TestIngressSourceRequireBackend(t *testing.T) {
+	ingress := withBackend(withBackend(testIngress("app.local", "dead.local"), "app.local", "web"), "dead.local", "missing")
+	client := fake.NewSimpleClientset(testService(), ingress)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	notify := make(chan resource.Resource, 10)
+	i := NewIngressWatcher(factory, Config{IngressRequireBackend: true, ReverseConflict: ReverseConflictAll}, notify)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	i.Run(stop)
+
+	// The rule pointing at a nonexistent backend is skipped
+	res := receive(t, notify)
+	if got, want := recordStrings(res.Records), []string{"app.local. A 192.168.1.20"}; res.Action != resource.Added || !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %s of %v, want %s of %v", res.Action, got, resource.Added, want)
+	}
+
+	// and published once its backend is created
+	missing := testService()
+	missing.Name = "missing"
+	if _, err := client.CoreV1().Services(missing.Namespace).Create(context.TODO(), missing, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	res = receive(t, notify)
+	if got, want := recordStrings(res.Records), []string{"dead.local. A 192.168.1.20"}; res.Action != resource.Added || !reflect.DeepEqual(got, want) {
+		t.Errorf("got %s of %v, want %s of %v", res.Action, got, resource.Added, want)
+	}
+	expectNone(t, notify)
+}
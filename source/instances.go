@@ -0,0 +1,162 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Values accepted for Config.InstanceConflict
+const (
+	InstanceConflictWarn   = "warn"
+	InstanceConflictSkip   = "skip"
+	InstanceConflictSuffix = "suffix"
+)
+
+// instanceRegistry tracks which object owns each DNS-SD service instance name
+// and resolves conflicts between objects according to a policy.
+type instanceRegistry struct {
+	policy  string
+	owners  map[string]string          // instance name to object key
+	waiting map[string]map[string]bool // instance name to the keys of objects which lost it
+	// retry is called, without blocking, with the key of an object which lost
+	// an instance name once its owner released it
+	retry func(key string)
+}
+
+func newInstanceRegistry(policy string, retry func(key string)) *instanceRegistry {
+	return &instanceRegistry{
+		policy:  policy,
+		owners:  make(map[string]string),
+		waiting: make(map[string]map[string]bool),
+		retry:   retry,
+	}
+}
+
+// resolve claims the instance names used by records for the object key,
+// releasing the ones it no longer uses. Instances already owned by another
+// object are renamed, dropped or just logged, depending on the policy. Objects
+// which lost a released instance name are retried. The returned records must
+// be used instead of records.
+func (r *instanceRegistry) resolve(key string, records []dns.RR) []dns.RR {
+	var released []string
+	for instance, owner := range r.owners {
+		if owner == key {
+			delete(r.owners, instance)
+			released = append(released, instance)
+		}
+	}
+	for instance, losers := range r.waiting {
+		if delete(losers, key); len(losers) == 0 {
+			delete(r.waiting, instance)
+		}
+	}
+	defer r.handOver(released)
+
+	renamed := map[string]string{}
+	for _, rr := range records {
+		srv, ok := rr.(*dns.SRV)
+		if !ok {
+			continue
+		}
+		instance := srv.Hdr.Name
+		owner, taken := r.owners[instance]
+		if !taken || owner == key {
+			r.owners[instance] = key
+			continue
+		}
+		if r.waiting[instance] == nil {
+			r.waiting[instance] = make(map[string]bool)
+		}
+		r.waiting[instance][key] = true
+
+		switch r.policy {
+		case InstanceConflictSkip:
+			log.Printf("Not publishing service instance %s of %s: already used by %s", instance, key, owner)
+			renamed[instance] = ""
+		case InstanceConflictSuffix:
+			unique := uniqueName(instance, key)
+			log.Printf("Publishing service instance %s of %s as %s: already used by %s", instance, key, unique, owner)
+			r.owners[unique] = key
+			renamed[instance] = unique
+		default:
+			log.Printf("Service instance %s of %s is already used by %s", instance, key, owner)
+		}
+	}
+
+	if len(renamed) == 0 {
+		return records
+	}
+
+	var resolved []dns.RR
+	for _, rr := range records {
+		name := rr.Header().Name
+		if ptr, ok := rr.(*dns.PTR); ok {
+			name = ptr.Ptr
+		}
+		unique, ok := renamed[name]
+		switch {
+		case !ok:
+		case unique == "":
+			continue
+		case name == rr.Header().Name:
+			rr.Header().Name = unique
+		default:
+			rr.(*dns.PTR).Ptr = unique
+		}
+		resolved = append(resolved, rr)
+	}
+	return resolved
+}
+
+// handOver retries the objects which lost any of the released instance names
+// that have not been claimed again.
+func (r *instanceRegistry) handOver(released []string) {
+	for _, instance := range released {
+		if _, taken := r.owners[instance]; taken {
+			continue
+		}
+		for loser := range r.waiting[instance] {
+			if r.retry != nil {
+				go r.retry(loser)
+			}
+		}
+		delete(r.waiting, instance)
+	}
+}
+
+// uniqueName returns the instance name with a short hash of the object key
+// appended to its first label. The suffix is stable across restarts and
+// replicas.
+func uniqueName(instance string, key string) string {
+	label, service := splitInstanceName(instance)
+	hash := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%s-%x.%s", label, hash[:3], service)
+}
+
+// splitInstanceName splits a DNS-SD service instance name into the instance
+// label and the service type domain.
+func splitInstanceName(instance string) (string, string) {
+	labels := dns.SplitDomainName(instance)
+	if len(labels) == 0 {
+		return instance, ""
+	}
+	return labels[0], strings.Join(labels[1:], ".") + "."
+}
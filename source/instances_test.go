@@ -0,0 +1,119 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/blake/external-mdns/resource"
+)
+
+// instanceRecords returns the PTR and SRV records of the HTTP service
+// instance pointing to target
+func instanceRecords(instance string, target string) []string {
+	return sortedStrings(
+		"_http._tcp.local. PTR "+instance,
+		instance+" SRV 0 0 80 "+target,
+	)
+}
+
+// waitPublished waits until the records published for key are want, failing
+// the test if they are not within a few seconds
+func waitPublished(t *testing.T, r *recordSet, key string, want []string) {
+	t.Helper()
+	var got []string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		r.mutex.Lock()
+		got = recordStrings(r.published[key])
+		r.mutex.Unlock()
+		if reflect.DeepEqual(got, want) {
+			return
+		}
+	}
+	t.Errorf("published %v for %s, want %v", got, key, want)
+}
+
+func TestInstanceConflict(t *testing.T) {
+	const instance = "web._http._tcp.local."
+	suffixed := uniqueName(instance, "default/b")
+
+	tests := []struct {
+		policy string
+		before []string // records of b while a owns the instance
+	}{
+		{policy: InstanceConflictWarn, before: instanceRecords(instance, "b.local.")},
+		{policy: InstanceConflictSkip, before: []string{}},
+		{policy: InstanceConflictSuffix, before: instanceRecords(suffixed, "b.local.")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			notify := make(chan resource.Resource, 10)
+			r := newRecordSet("service", notify, Config{ReverseConflict: ReverseConflictAll})
+			r.transform = newInstanceRegistry(tt.policy, r.retry).resolve
+
+			r.publish("default/a", parseRecords(t, instanceRecords(instance, "a.local.")...))
+			r.publish("default/b", parseRecords(t, instanceRecords(instance, "b.local.")...))
+			waitPublished(t, r, "default/a", instanceRecords(instance, "a.local."))
+			waitPublished(t, r, "default/b", tt.before)
+
+			// Once a is gone, b takes over the instance name
+			r.publish("default/a", nil)
+			waitPublished(t, r, "default/b", instanceRecords(instance, "b.local."))
+		})
+	}
+}
+
+func TestUniqueName(t *testing.T) {
+	tests := []struct {
+		instance string
+		key      string
+		want     string
+	}{
+		{instance: "web._http._tcp.local.", key: "default/web", want: "web-82b3ad._http._tcp.local."},
+		{instance: "web._http._tcp.local.", key: "other/web", want: "web-666c9f._http._tcp.local."},
+		{instance: "web._ipp._tcp.local.", key: "default/web", want: "web-82b3ad._ipp._tcp.local."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.key+" "+tt.instance, func(t *testing.T) {
+			// The suffix only depends on the object, not on earlier calls
+			for i := 0; i < 3; i++ {
+				if got := uniqueName(tt.instance, tt.key); got != tt.want {
+					t.Errorf("uniqueName() = %s, want %s", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestInstanceSuffixStable(t *testing.T) {
+	const instance = "web._http._tcp.local."
+
+	// Every replica, or the same replica after a restart, renames the
+	// conflicting instance of b alike, whatever else it has seen before
+	for _, others := range [][]string{{"default/a"}, {"default/c", "default/a"}} {
+		registry := newInstanceRegistry(InstanceConflictSuffix, nil)
+		for _, key := range others {
+			registry.resolve(key, parseRecords(t, instanceRecords(instance, "a.local.")...))
+		}
+		got := recordStrings(registry.resolve("default/b", parseRecords(t, instanceRecords(instance, "b.local.")...)))
+		if want := instanceRecords("web-d2d9d3._http._tcp.local.", "b.local."); !reflect.DeepEqual(got, want) {
+			t.Errorf("resolve() = %v, want %v", got, want)
+		}
+	}
+}
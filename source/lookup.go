@@ -0,0 +1,73 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// lookupCache caches the addresses hostnames resolve to until it is cleared,
+// so that rebuilding the records of an object does not hit DNS every time.
+// Failed lookups are not cached.
+type lookupCache struct {
+	addresses map[string][]net.IP
+	mutex     sync.Mutex
+}
+
+var loadBalancerLookups = &lookupCache{addresses: make(map[string][]net.IP)}
+
+// lookupIP resolves hostnames, replaced by tests
+var lookupIP = net.LookupIP
+
+// lookup returns the addresses hostname resolves to, like lookupAddresses
+func (c *lookupCache) lookup(hostname string) ([]net.IP, error) {
+	c.mutex.Lock()
+	ips, ok := c.addresses[hostname]
+	c.mutex.Unlock()
+	if ok {
+		return ips, nil
+	}
+
+	ips, err := lookupAddresses(hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	c.addresses[hostname] = ips
+	c.mutex.Unlock()
+	return ips, nil
+}
+
+// clear drops all cached addresses, so that the next lookups resolve again
+func (c *lookupCache) clear() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.addresses = make(map[string][]net.IP)
+}
+
+// lookupAddresses returns the addresses hostname resolves to, sorted to keep
+// records comparable between updates.
+func lookupAddresses(hostname string) ([]net.IP, error) {
+	ips, err := lookupIP(strings.TrimSuffix(hostname, "."))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ips, func(a, b int) bool { return ips[a].String() < ips[b].String() })
+	return ips, nil
+}
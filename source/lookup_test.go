@@ -0,0 +1,68 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestLookupCache(t *testing.T) {
+	lookups := map[string]int{}
+	oldLookupIP := lookupIP
+	lookupIP = func(host string) ([]net.IP, error) {
+		lookups[host]++
+		if host == "gone.example.com" {
+			return nil, fmt.Errorf("no such host %s", host)
+		}
+		return []net.IP{net.ParseIP("192.0.2.11"), net.ParseIP("192.0.2.10")}, nil
+	}
+	defer func() { lookupIP = oldLookupIP }()
+	c := &lookupCache{addresses: make(map[string][]net.IP)}
+
+	for i := 0; i < 2; i++ {
+		ips, err := c.lookup("lb.example.com.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Sorted, so that records stay comparable
+		if want := []net.IP{net.ParseIP("192.0.2.10"), net.ParseIP("192.0.2.11")}; !reflect.DeepEqual(ips, want) {
+			t.Errorf("lookup() = %v, want %v", ips, want)
+		}
+	}
+	if lookups["lb.example.com"] != 1 {
+		t.Errorf("resolved %d times, want the addresses cached", lookups["lb.example.com"])
+	}
+
+	c.clear()
+	if _, err := c.lookup("lb.example.com."); err != nil {
+		t.Fatal(err)
+	}
+	if lookups["lb.example.com"] != 2 {
+		t.Errorf("resolved %d times, want it resolved again after clearing", lookups["lb.example.com"])
+	}
+
+	// Failures are retried on the next lookup
+	for i := 0; i < 2; i++ {
+		if ips, err := c.lookup("gone.example.com."); err == nil {
+			t.Errorf("lookup() = %v, want an error", ips)
+		}
+	}
+	if lookups["gone.example.com"] != 2 {
+		t.Errorf("resolved %d times, want failed lookups not cached", lookups["gone.example.com"])
+	}
+}
@@ -0,0 +1,53 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"log"
+	"sync"
+)
+
+// noticeRegistry remembers the notices logged about objects, so that
+// rebuilding the records of an object, e.g. on every endpoints change or
+// reconcile, does not repeat them. It is shared by all sources.
+type noticeRegistry struct {
+	logged map[string]bool // notice and object key
+	mutex  sync.Mutex
+}
+
+var notices = &noticeRegistry{logged: make(map[string]bool)}
+
+// logf logs a notice about object, unless it has already been logged and
+// not been cleared since.
+func (n *noticeRegistry) logf(notice string, object string, format string, v ...interface{}) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	key := notice + " " + object
+	if n.logged[key] {
+		return
+	}
+	n.logged[key] = true
+	log.Printf(format, v...)
+}
+
+// clear forgets a notice about object once its cause is gone, so that it is
+// logged again should the cause return.
+func (n *noticeRegistry) clear(notice string, object string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	delete(n.logged, notice+" "+object)
+}
@@ -0,0 +1,236 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/blake/external-mdns/resource"
+	"github.com/miekg/dns"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/tools/cache"
+)
+
+// recordSet tracks the records a source has published per object, keyed by
+// namespace/name, and notifies about changes to them.
+type recordSet struct {
+	sourceType string
+	notifyChan chan<- resource.Resource
+	published  map[string][]dns.RR
+	// wanted holds the records of each object before they were transformed
+	// and resolved, to publish them again once a conflict is gone
+	wanted map[string][]dns.RR
+	// transform is applied to the records of an object before they are
+	// published, with the record set locked (optional)
+	transform func(key string, records []dns.RR) []dns.RR
+	// reverse resolves conflicting reverse PTR records (optional)
+	reverse *reverseRegistry
+	// debounce and deleteGrace delay changes and withdrawals respectively
+	debounce    time.Duration
+	deleteGrace time.Duration
+	pending     map[string]*time.Timer
+	// versions holds the newest resource version seen per object
+	versions map[string]uint64
+	mutex    sync.Mutex
+}
+
+func newRecordSet(sourceType string, notifyChan chan<- resource.Resource, cfg Config) *recordSet {
+	r := &recordSet{
+		sourceType:  sourceType,
+		notifyChan:  notifyChan,
+		published:   make(map[string][]dns.RR),
+		wanted:      make(map[string][]dns.RR),
+		debounce:    cfg.Debounce,
+		deleteGrace: cfg.DeleteGrace,
+		pending:     make(map[string]*time.Timer),
+		versions:    make(map[string]uint64),
+	}
+	if cfg.ReverseConflict != ReverseConflictAll {
+		r.reverse = reverseOwners
+	}
+	return r
+}
+
+// publish withdraws and publishes the difference between the records last
+// published for the object key and records. The change is delayed if
+// debouncing or a delete grace period is configured; a later change of the
+// same object within the delay replaces it. Duplicate records, such as the
+// PTR record shared by the SRV records of several endpoints, are published
+// once.
+func (r *recordSet) publish(key string, records []dns.RR) {
+	records = uniqueRecords(records)
+	delay := r.debounce
+	if len(records) == 0 && r.deleteGrace > delay {
+		delay = r.deleteGrace
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// Skip objects which neither had nor get any records, such as load
+	// balancer services without an address, on every unrelated update
+	if _, ok := r.pending[key]; !ok && len(records) == 0 && len(r.published[key]) == 0 {
+		return
+	}
+
+	if timer, ok := r.pending[key]; ok {
+		timer.Stop()
+		delete(r.pending, key)
+	}
+	if delay == 0 {
+		r.apply(key, records)
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		// Skip if superseded by a later change
+		if r.pending[key] == timer {
+			delete(r.pending, key)
+			r.apply(key, records)
+		}
+	})
+	r.pending[key] = timer
+}
+
+// isStale reports whether obj, an event for the object key, is older than an
+// event seen before, remembering its resource version otherwise. This keeps a
+// delayed event from overriding a newer state during update storms.
+//
+// This is a best-effort heuristic: Kubernetes documents resource versions as
+// opaque, but the API server currently derives them from the increasing etcd
+// revision. Objects without a numeric resource version are never stale.
+func (r *recordSet) isStale(key string, obj interface{}) bool {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	accessor, err := meta.Accessor(obj)
+	if err != nil {
+		return false
+	}
+	version, err := strconv.ParseUint(accessor.GetResourceVersion(), 10, 64)
+	if err != nil {
+		return false
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if version < r.versions[key] {
+		log.Printf("Ignoring stale event for %s %s: resource version %d is older than %d", r.sourceType, key, version, r.versions[key])
+		return true
+	}
+	r.versions[key] = version
+	return false
+}
+
+// apply publishes records for the object key, with the record set locked
+func (r *recordSet) apply(key string, records []dns.RR) {
+	if len(records) > 0 {
+		// Keep copies, as transform renames records in place
+		r.wanted[key] = copyRecords(records)
+	} else {
+		delete(r.wanted, key)
+	}
+	if r.transform != nil {
+		records = r.transform(key, records)
+	}
+	if r.reverse != nil {
+		records = r.reverse.resolve(r.sourceType+" "+key, records, func() { r.retry(key) })
+	}
+	namespace, name, _ := cache.SplitMetaNamespaceKey(key)
+	notifyUpdate(r.notifyChan, r.sourceType, namespace, name, r.published[key], records)
+	if len(records) > 0 {
+		// Keep copies, as the notified records are handed on to the
+		// publishers, which set their TTL and class
+		r.published[key] = copyRecords(records)
+	} else {
+		delete(r.published, key)
+	}
+}
+
+// retry publishes the records of the object key again, once a conflict which
+// kept some of them from being published may be gone. Objects with a pending
+// change are skipped, as the change is published anyway.
+func (r *recordSet) retry(key string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	records, ok := r.wanted[key]
+	if _, pending := r.pending[key]; !ok || pending {
+		return
+	}
+	r.apply(key, copyRecords(records))
+}
+
+// reconcile rebuilds the records of every object in store and publishes the
+// differences, withdrawing the records of objects which no longer exist. This
+// corrects any drift caused by missed events. Objects changed by an event
+// since store was listed, and objects with a pending change, are left alone.
+func (r *recordSet) reconcile(store cache.Store, build func(obj interface{}) []dns.RR) {
+	existing := map[string]bool{}
+	for _, obj := range store.List() {
+		key, err := cache.MetaNamespaceKeyFunc(obj)
+		if err != nil {
+			runtime.HandleError(err)
+			continue
+		}
+		existing[key] = true
+		if r.isStale(key, obj) {
+			continue
+		}
+		if records := uniqueRecords(build(obj)); r.drifted(key, records) {
+			r.publish(key, records)
+		}
+	}
+
+	r.mutex.Lock()
+	var stale []string
+	for key := range r.published {
+		if !existing[key] {
+			stale = append(stale, key)
+		}
+	}
+	for key := range r.versions {
+		if !existing[key] {
+			delete(r.versions, key)
+		}
+	}
+	r.mutex.Unlock()
+
+	for _, key := range stale {
+		// The object may have been added since store was listed
+		if _, exists, err := store.GetByKey(key); err != nil || exists {
+			continue
+		}
+		r.publish(key, nil)
+	}
+}
+
+// drifted reports whether records differ from the records last published for
+// the object key, unless a change of it is pending, which is newer anyway.
+func (r *recordSet) drifted(key string, records []dns.RR) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, pending := r.pending[key]; pending {
+		return false
+	}
+	return len(diffRecords(records, r.wanted[key])) > 0 || len(diffRecords(r.wanted[key], records)) > 0
+}
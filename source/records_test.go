@@ -0,0 +1,227 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"testing"
+	"time"
+
+	"github.com/blake/external-mdns/resource"
+	"github.com/miekg/dns"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+// buildService builds the records of a service without informer state
+func buildService(obj interface{}) []dns.RR {
+	return BuildServiceRecords(obj.(*corev1.Service), Config{})
+}
+
+// versionedService returns testService with the cluster IP ip at resource
+// version
+func versionedService(version string, ip string) *corev1.Service {
+	service := testService()
+	service.ResourceVersion = version
+	service.Spec.ClusterIP = ip
+	service.Spec.ClusterIPs = []string{ip}
+	return service
+}
+
+// listedStore is a store listing the objects it held before the latest
+// events, like a store listed by a reconcile racing with them
+type listedStore struct {
+	cache.Store
+	listed []interface{}
+}
+
+func (s listedStore) List() []interface{} {
+	return s.listed
+}
+
+func TestRecordSetKeepsCopies(t *testing.T) {
+	notify := make(chan resource.Resource, 10)
+	r := newRecordSet("service", notify, Config{ReverseConflict: ReverseConflictAll})
+
+	r.publish("default/web", BuildServiceRecords(testService(), Config{}))
+	res := receive(t, notify)
+	if res.Action != resource.Added {
+		t.Fatalf("got %s, want the records of the service added", res.Action)
+	}
+
+	// Publishers set the TTL and class of the notified records, which must
+	// not leak into the records compared on the next update
+	for _, rr := range res.Records {
+		rr.Header().Ttl = 120
+		rr.Header().Class = dns.ClassINET
+	}
+
+	r.publish("default/web", BuildServiceRecords(testService(), Config{}))
+	expectNone(t, notify)
+}
+
+func TestRecordSetOrigin(t *testing.T) {
+	notify := make(chan resource.Resource, 10)
+	r := newRecordSet("ingress", notify, Config{ReverseConflict: ReverseConflictAll})
+
+	r.publish("shop/store", parseRecords(t, "store.local. A 10.0.0.20"))
+	r.publish("shop/store", nil)
+	for _, action := range []string{resource.Added, resource.Deleted} {
+		res := receive(t, notify)
+		if res.Action != action || res.SourceType != "ingress" || res.Namespace != "shop" || res.Name != "store" {
+			t.Errorf("got %s from %s %s/%s, want %s from ingress shop/store", res.Action, res.SourceType, res.Namespace, res.Name, action)
+		}
+	}
+}
+
+func TestReconcileDrift(t *testing.T) {
+	notify := make(chan resource.Resource, 10)
+	r := newRecordSet("service", notify, Config{ReverseConflict: ReverseConflictAll})
+	store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+
+	steps := []struct {
+		name    string
+		update  func() error
+		actions []string
+	}{
+		{
+			name:    "missed add",
+			update:  func() error { return store.Add(versionedService("1", "10.0.0.10")) },
+			actions: []string{resource.Added},
+		},
+		{
+			name:    "no drift",
+			update:  func() error { return nil },
+			actions: nil,
+		},
+		{
+			name:    "missed update",
+			update:  func() error { return store.Update(versionedService("2", "10.0.0.11")) },
+			actions: []string{resource.Deleted, resource.Added},
+		},
+		{
+			name:    "missed delete",
+			update:  func() error { return store.Delete(versionedService("3", "10.0.0.11")) },
+			actions: []string{resource.Deleted},
+		},
+	}
+
+	for _, step := range steps {
+		if err := step.update(); err != nil {
+			t.Fatal(err)
+		}
+		r.reconcile(store, buildService)
+		for _, action := range step.actions {
+			if res := receive(t, notify); res.Action != action {
+				t.Errorf("%s: got %s of %v, want %s", step.name, res.Action, recordStrings(res.Records), action)
+			}
+		}
+		expectNone(t, notify)
+	}
+}
+
+func TestReconcileRacingEvents(t *testing.T) {
+	t.Run("added since listed", func(t *testing.T) {
+		notify := make(chan resource.Resource, 10)
+		r := newRecordSet("service", notify, Config{ReverseConflict: ReverseConflictAll})
+		store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+
+		service := versionedService("1", "10.0.0.10")
+		if err := store.Add(service); err != nil {
+			t.Fatal(err)
+		}
+		r.publish("default/web", buildService(service))
+		receive(t, notify)
+
+		r.reconcile(listedStore{Store: store}, buildService)
+		expectNone(t, notify)
+	})
+
+	t.Run("updated since listed", func(t *testing.T) {
+		notify := make(chan resource.Resource, 10)
+		r := newRecordSet("service", notify, Config{ReverseConflict: ReverseConflictAll})
+		store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+
+		old := versionedService("1", "10.0.0.10")
+		updated := versionedService("2", "10.0.0.11")
+		if err := store.Add(updated); err != nil {
+			t.Fatal(err)
+		}
+		if r.isStale("default/web", updated) {
+			t.Fatal("the update is stale")
+		}
+		r.publish("default/web", buildService(updated))
+		receive(t, notify)
+
+		r.reconcile(listedStore{Store: store, listed: []interface{}{old}}, buildService)
+		expectNone(t, notify)
+	})
+
+	t.Run("pending change", func(t *testing.T) {
+		notify := make(chan resource.Resource, 10)
+		r := newRecordSet("service", notify, Config{ReverseConflict: ReverseConflictAll, Debounce: time.Hour})
+		store := cache.NewStore(cache.MetaNamespaceKeyFunc)
+
+		service := versionedService("1", "10.0.0.10")
+		if err := store.Add(service); err != nil {
+			t.Fatal(err)
+		}
+		r.publish("default/web", buildService(service))
+		r.mutex.Lock()
+		timer := r.pending["default/web"]
+		r.mutex.Unlock()
+
+		// Restarting the delay on every reconcile could postpone the
+		// change forever
+		r.reconcile(store, buildService)
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		if r.pending["default/web"] != timer {
+			t.Error("reconcile restarted the delay of the pending change")
+		}
+		timer.Stop()
+	})
+}
+
+func TestStaleEvents(t *testing.T) {
+	notify := make(chan resource.Resource, 10)
+	s := NewServicesWatcher(informers.NewSharedInformerFactory(fake.NewSimpleClientset(), 0), Config{ReverseConflict: ReverseConflictAll}, notify)
+
+	s.onAdd(versionedService("1", "10.0.0.10"))
+	s.onUpdate(versionedService("1", "10.0.0.10"), versionedService("3", "10.0.0.11"))
+	for _, action := range []string{resource.Added, resource.Deleted, resource.Added} {
+		if res := receive(t, notify); res.Action != action {
+			t.Fatalf("got %s of %v, want %s", res.Action, recordStrings(res.Records), action)
+		}
+	}
+
+	// Events delivered out of order do not override the newer state
+	s.onUpdate(versionedService("1", "10.0.0.10"), versionedService("2", "10.0.0.12"))
+	s.onDelete(cache.DeletedFinalStateUnknown{Key: "default/web", Obj: versionedService("2", "10.0.0.12")})
+	expectNone(t, notify)
+
+	// Resource versions are opaque, non-numeric ones are never stale
+	s.onUpdate(versionedService("3", "10.0.0.11"), versionedService("v4", "10.0.0.12"))
+	for _, action := range []string{resource.Deleted, resource.Added} {
+		if res := receive(t, notify); res.Action != action {
+			t.Errorf("got %s of %v, want %s", res.Action, recordStrings(res.Records), action)
+		}
+	}
+	s.onDelete(versionedService("4", "10.0.0.12"))
+	if res := receive(t, notify); res.Action != resource.Deleted {
+		t.Errorf("got %s of %v, want the records deleted", res.Action, recordStrings(res.Records))
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// Values accepted for Config.ReverseConflict
+const (
+	ReverseConflictFirst = "first"
+	ReverseConflictAll   = "all"
+)
+
+// reverseRegistry tracks which object owns the reverse PTR record of each
+// address, so that an address shared by several objects, e.g. a load
+// balancer IP, only points to one name. It is shared by all sources.
+type reverseRegistry struct {
+	owners map[string]string // reverse name to source type and object key
+	// waiting holds the objects whose PTR record of a reverse name was
+	// dropped as another object owned it, with the function publishing their
+	// records again once the owner released it
+	waiting map[string]map[string]func()
+	mutex   sync.Mutex
+}
+
+var reverseOwners = newReverseRegistry()
+
+func newReverseRegistry() *reverseRegistry {
+	return &reverseRegistry{
+		owners:  make(map[string]string),
+		waiting: make(map[string]map[string]func()),
+	}
+}
+
+// resolve claims the reverse PTR records in records for owner, releasing the
+// ones it no longer publishes, and drops those already owned by another
+// object. Owner is retried by calling retry once such a name is released.
+// The returned records must be used instead of records.
+func (r *reverseRegistry) resolve(owner string, records []dns.RR, retry func()) []dns.RR {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	var released []string
+	for name, o := range r.owners {
+		if o == owner {
+			delete(r.owners, name)
+			released = append(released, name)
+		}
+	}
+	for name, losers := range r.waiting {
+		if delete(losers, owner); len(losers) == 0 {
+			delete(r.waiting, name)
+		}
+	}
+	defer r.handOver(released)
+
+	var resolved []dns.RR
+	for _, rr := range records {
+		if name := rr.Header().Name; rr.Header().Rrtype == dns.TypePTR && isReverseName(name) {
+			if o, taken := r.owners[name]; taken && o != owner {
+				log.Printf("Not publishing %s of %s: address already points to a name of %s", rr, owner, o)
+				if r.waiting[name] == nil {
+					r.waiting[name] = make(map[string]func())
+				}
+				r.waiting[name][owner] = retry
+				continue
+			}
+			r.owners[name] = owner
+		}
+		resolved = append(resolved, rr)
+	}
+	return resolved
+}
+
+// handOver retries the objects which lost any of the released reverse names
+// that have not been claimed again.
+func (r *reverseRegistry) handOver(released []string) {
+	for _, name := range released {
+		if _, taken := r.owners[name]; taken {
+			continue
+		}
+		for _, retry := range r.waiting[name] {
+			if retry != nil {
+				go retry()
+			}
+		}
+		delete(r.waiting, name)
+	}
+}
+
+// isReverseName reports whether name is in the in-addr.arpa or ip6.arpa
+// reverse mapping domains.
+func isReverseName(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, ".in-addr.arpa.") || strings.HasSuffix(name, ".ip6.arpa.")
+}
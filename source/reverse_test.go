@@ -0,0 +1,49 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"testing"
+
+	"github.com/blake/external-mdns/resource"
+)
+
+func TestReverseConflict(t *testing.T) {
+	// Two objects of different sources behind the same load balancer IP
+	registry := newReverseRegistry()
+	notify := make(chan resource.Resource, 10)
+	services := newRecordSet("service", notify, Config{})
+	services.reverse = registry
+	ingresses := newRecordSet("ingress", notify, Config{})
+	ingresses.reverse = registry
+
+	web := sortedStrings("web.local. A 192.168.1.10", "10.1.168.192.in-addr.arpa. PTR web.local.")
+	app := sortedStrings("app.local. A 192.168.1.10", "10.1.168.192.in-addr.arpa. PTR app.local.")
+	services.publish("default/web", parseRecords(t, web...))
+	ingresses.publish("default/app", parseRecords(t, app...))
+
+	// The address points to the first name only, both forward records exist
+	waitPublished(t, services, "default/web", web)
+	waitPublished(t, ingresses, "default/app", []string{"app.local. A 192.168.1.10"})
+
+	// Once web is gone, the address points to app
+	services.publish("default/web", nil)
+	waitPublished(t, ingresses, "default/app", app)
+
+	// web does not get it back while app owns it
+	services.publish("default/web", parseRecords(t, web...))
+	waitPublished(t, services, "default/web", []string{"web.local. A 192.168.1.10"})
+	waitPublished(t, ingresses, "default/app", app)
+}
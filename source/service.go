@@ -17,130 +17,951 @@ package source
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/blake/external-mdns/resource"
 	"github.com/miekg/dns"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
 	"k8s.io/apimachinery/pkg/util/runtime"
 	"k8s.io/client-go/informers"
+	listersv1 "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
 )
 
+const (
+	hostnameAnnotation        = "external-mdns.blake.github.io/hostname"
+	serviceInstanceAnnotation = "external-mdns.blake.github.io/service-instance"
+	serviceTxtAnnotation      = "external-mdns.blake.github.io/service-txt"
+	publishAnnotation         = "external-mdns.blake.github.io/publish"
+	priorityAnnotation        = "external-mdns.blake.github.io/priority"
+	minReadyAnnotation        = "external-mdns.blake.github.io/min-ready-endpoints"
+	ptrTargetIPv4Annotation   = "external-mdns.blake.github.io/ptr-target-ipv4"
+	ptrTargetIPv6Annotation   = "external-mdns.blake.github.io/ptr-target-ipv6"
+	addressSourceAnnotation   = "external-mdns.blake.github.io/address-source"
+	addressZonesAnnotation    = "external-mdns.blake.github.io/address-zones"
+	srvTargetAnnotation       = "external-mdns.blake.github.io/srv-target"
+	urlAnnotation             = "external-mdns.blake.github.io/url"
+	srvPortAnnotation         = "external-mdns.blake.github.io/srv-port"
+	primaryPortAnnotation     = "external-mdns.blake.github.io/primary-port"
+	readyConditionAnnotation  = "external-mdns.blake.github.io/ready-condition"
+	endpointWeightsAnnotation = "external-mdns.blake.github.io/endpoint-weights"
+	portsAnnotation           = "external-mdns.blake.github.io/ports"
+	wildcardAnnotation        = "external-mdns.blake.github.io/wildcard"
+	ownerIDAnnotation         = "external-mdns.blake.github.io/owner-id"
+	useExternalIPsAnnotation  = "external-mdns.blake.github.io/use-external-ips"
+)
+
+// deviceTXTAnnotations maps convenience annotations to the TXT keys that
+// device browsers display, e.g. for printers (Bonjour Printing Specification)
+var deviceTXTAnnotations = map[string]string{
+	"external-mdns.blake.github.io/device-model":  "model",
+	"external-mdns.blake.github.io/device-type":   "ty",
+	"external-mdns.blake.github.io/device-note":   "note",
+	"external-mdns.blake.github.io/printer-queue": "rp",
+	"external-mdns.blake.github.io/admin-url":     "adminurl",
+}
+
+// Values accepted for the address-source annotation
+const (
+	addressSourceClusterIP    = "clusterip"
+	addressSourceLoadBalancer = "loadbalancer"
+	addressSourceBoth         = "both"
+)
+
 // ServiceSource handles adding, updating, or removing mDNS record advertisements
 type ServiceSource struct {
-	publishAll       bool
-	notifyChan       chan<- resource.Resource
-	sharedInformer   cache.SharedIndexInformer
+	config            Config
+	sharedInformer    cache.SharedIndexInformer
+	endpointsInformer cache.SharedIndexInformer
+	endpointsLister   listersv1.EndpointsLister
+	instances         *instanceRegistry
+	*recordSet
 }
 
-// Run starts shared informers and waits for the shared informer cache to
-// synchronize.
+// Run waits for the shared informer cache to synchronize. The informer itself
+// is started through the SharedInformerFactory it was created from.
 func (s *ServiceSource) Run(stopCh chan struct{}) error {
-	s.sharedInformer.Run(stopCh)
-	if !cache.WaitForCacheSync(stopCh, s.sharedInformer.HasSynced) {
+	synced := []cache.InformerSynced{s.sharedInformer.HasSynced}
+	if s.endpointsInformer != nil {
+		synced = append(synced, s.endpointsInformer.HasSynced)
+	}
+	if !cache.WaitForCacheSync(stopCh, synced...) {
 		runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
 	}
+	if (s.config.LoadBalancerHostnameMode == LoadBalancerHostnameResolve || s.config.ResolveExternalNames) && s.config.LoadBalancerHostnameRefresh > 0 {
+		go s.refreshResolvedHostnames(stopCh)
+	}
 	return nil
 }
 
-func (s *ServiceSource) onAdd(obj interface{}) {
-	s.notifyChan <- resource.Resource {
-		SourceType: "service",
-		Action:     resource.Added,
-		Records:    s.buildRecords(obj),
+// refreshResolvedHostnames resolves the load balancer hostnames and external
+// names of all services again at every LoadBalancerHostnameRefresh, so that
+// their records follow DNS changes although the services did not change.
+func (s *ServiceSource) refreshResolvedHostnames(stopCh chan struct{}) {
+	ticker := time.NewTicker(s.config.LoadBalancerHostnameRefresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			loadBalancerLookups.clear()
+			for _, obj := range s.sharedInformer.GetStore().List() {
+				if service, ok := obj.(*corev1.Service); ok && resolvesHostname(service, s.config) {
+					s.sync(service)
+				}
+			}
+		case <-stopCh:
+			return
+		}
 	}
 }
 
+func (s *ServiceSource) onAdd(obj interface{}) {
+	s.sync(obj)
+}
+
 func (s *ServiceSource) onDelete(obj interface{}) {
-	s.notifyChan <- resource.Resource {
-		SourceType: "service",
-		Action:     resource.Deleted,
-		Records:    s.buildRecords(obj),
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	if s.isStale(key, obj) {
+		return
 	}
+
+	s.publish(key, nil)
 }
 
+// onUpdate only withdraws and publishes the records that changed, e.g. the
+// A and PTR records when the address changes while SRV and TXT stay. A
+// service which becomes publishable, e.g. through kubectl annotate, has no
+// published records yet, so all of its records are added; one that stops
+// being publishable has all of them withdrawn.
 func (s *ServiceSource) onUpdate(oldObj interface{}, newObj interface{}) {
-	s.onDelete(oldObj)
-	s.onAdd(newObj)
+	s.sync(newObj)
 }
 
-func (s *ServiceSource) buildRecords(obj interface{}) []dns.RR {
-	var records []dns.RR
+// onEndpointsChange re-evaluates the service owning the endpoints, as its
+// readiness may have changed.
+func (s *ServiceSource) onEndpointsChange(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	service, exists, err := s.sharedInformer.GetIndexer().GetByKey(key)
+	if err != nil || !exists {
+		return
+	}
+	s.sync(service)
+}
+
+func (s *ServiceSource) sync(obj interface{}) {
+	key, err := cache.MetaNamespaceKeyFunc(obj)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	if s.isStale(key, obj) {
+		return
+	}
+
+	s.publish(key, s.buildRecords(obj))
+}
 
+// Reconcile rebuilds the records of all services and publishes any
+// differences to the records published before.
+func (s *ServiceSource) Reconcile() {
+	s.reconcile(s.sharedInformer.GetStore(), s.buildRecords)
+}
+
+func (s *ServiceSource) buildRecords(obj interface{}) []dns.RR {
 	service, ok := obj.(*corev1.Service)
 	if !ok {
+		return nil
+	}
+
+	var readyPorts map[string]bool
+	if s.endpointsLister != nil {
+		endpoints, err := s.endpointsLister.Endpoints(service.Namespace).Get(service.Name)
+		if err != nil {
+			endpoints = nil
+		}
+		if !hasMinReadyEndpoints(service, endpoints) {
+			return nil
+		}
+		if s.config.ReadyPortsOnly {
+			readyPorts = readyEndpointPorts(endpoints)
+		}
+	} else if _, ok := service.Annotations[minReadyAnnotation]; ok {
+		// Without endpoints, the readiness can not be checked
+		notices.logf("min ready", service.Namespace+"/"+service.Name, "Not publishing service %s/%s: annotation %s requires -source=endpoints", service.Namespace, service.Name, minReadyAnnotation)
+		return nil
+	} else {
+		notices.clear("min ready", service.Namespace+"/"+service.Name)
+	}
+
+	return transform(s.sourceType, service, buildServiceRecords(service, readyPorts, s.config))
+}
+
+// BuildServiceRecords returns the records to advertise for the given service.
+// It does not depend on any informer state.
+func BuildServiceRecords(service *corev1.Service, cfg Config) []dns.RR {
+	return buildServiceRecords(service, nil, cfg)
+}
+
+// buildServiceRecords returns the records to advertise for the given service,
+// limiting the SRV records to the port names in readyPorts unless it is nil.
+func buildServiceRecords(service *corev1.Service, readyPorts map[string]bool, cfg Config) []dns.RR {
+	var records []dns.RR
+
+	if !isPublishable(service, cfg) || !cfg.acceptsServiceType(string(service.Spec.Type)) || !cfg.acceptsPorts(service) || !hasReadyCondition(service) {
 		return records
 	}
 
-	hostname, hasHostname := service.Annotations["external-mdns.blake.github.io/hostname"]
-	if !hasHostname {
-		hostname = fmt.Sprintf("%s.%s.local.", service.Name, service.Namespace)
+	instancename := serviceInstanceName(service, cfg)
+
+	svctxt, err := serviceTXT(service)
+	ignoreInvalidAnnotation(service, serviceTxtAnnotation, err)
+
+	if cfg.StrictAnnotations {
+		if err := checkPortReferences(service); err != nil {
+			log.Printf("Not publishing service %s/%s: %v", service.Namespace, service.Name, err)
+			return records
+		}
+	}
+
+	annotationtxt := annotationTXT(service, cfg)
+
+	hostname := serviceHostname(service, cfg)
+	srvtarget := hostname
+	if service.Spec.Type == corev1.ServiceTypeExternalName {
+		var target string
+		records, target = externalNameRecords(service, hostname, cfg)
+		if len(records) == 0 {
+			return records
+		}
+		srvtarget = target
+	} else {
+		var ips []net.IP
+		for _, ip := range serviceAddresses(service, cfg) {
+			if cfg.checkReachable(ip, fmt.Sprintf("service %s/%s", service.Namespace, service.Name)) {
+				ips = append(ips, ip)
+			}
+		}
+
+		lbHostname := loadBalancerHostname(service)
+		if len(ips) == 0 && lbHostname != "" && cfg.LoadBalancerHostnameMode == LoadBalancerHostnameResolve {
+			ips = resolvedLoadBalancerAddresses(fmt.Sprintf("service %s/%s", service.Namespace, service.Name), lbHostname, cfg)
+		}
+		if len(ips) == 0 && lbHostname != "" && cfg.LoadBalancerHostnameMode == LoadBalancerHostnameCNAME {
+			records, srvtarget = aliasTargetRecords(service, hostname, lbHostname, false, cfg)
+			if len(records) == 0 {
+				return records
+			}
+		} else if len(ips) == 0 {
+			// Headless services are published by the endpoints source
+			if service.Spec.ClusterIP == corev1.ClusterIPNone && !cfg.WatchEndpoints {
+				notices.logf("headless", service.Namespace+"/"+service.Name, "Not publishing headless service %s/%s: it has no cluster IP, use -source=endpoints to publish the addresses of its endpoints", service.Namespace, service.Name)
+			}
+			return records
+		}
+		notices.clear("headless", service.Namespace+"/"+service.Name)
+
+		for _, ip := range ips {
+			if ptrTarget := reverseHostname(service, ip, hostname, cfg); ptrTarget != hostname {
+				// The PTR target gets its own forward record, so that reverse
+				// and forward lookups match
+				records = append(records, buildAddressRecords(hostname, ip, !cfg.ReverseOnly, false, cfg)...)
+				records = append(records, buildAddressRecords(ptrTarget, ip, !cfg.ReverseOnly, cfg.publishReverse(ip), cfg)...)
+			} else {
+				records = append(records, buildAddressRecords(hostname, ip, !cfg.ReverseOnly, cfg.publishReverse(ip), cfg)...)
+			}
+		}
+	}
+	if value, ok := service.Annotations[wildcardAnnotation]; ok {
+		wildcard, err := strconv.ParseBool(strings.TrimSpace(value))
+		ignoreInvalidAnnotation(service, wildcardAnnotation, err)
+		if err == nil && wildcard {
+			records = append(records, wildcardRecords(records, hostname)...)
+		}
+	}
+	if len(service.Spec.Ports) == 0 {
+		notices.logf("no ports", service.Namespace+"/"+service.Name, "Service %s/%s has no ports, publishing address records without DNS-SD service records", service.Namespace, service.Name)
+	} else {
+		notices.clear("no ports", service.Namespace+"/"+service.Name)
+	}
+	if value, ok := service.Annotations[srvTargetAnnotation]; ok {
+		target, err := parseDomainName(value)
+		ignoreInvalidAnnotation(service, srvTargetAnnotation, err)
+		if err == nil {
+			srvtarget = target
+		}
+	}
+	var srvport int32
+	if value, ok := service.Annotations[srvPortAnnotation]; ok {
+		port, err := resolvePort(service, value)
+		ignoreInvalidAnnotation(service, srvPortAnnotation, err)
+		srvport = port
+	}
+	var primaryport int32
+	if value, ok := service.Annotations[primaryPortAnnotation]; ok {
+		port, err := resolvePort(service, value)
+		ignoreInvalidAnnotation(service, primaryPortAnnotation, err)
+		primaryport = port
+	}
+	// The endpoints source publishes one SRV record per endpoint instead
+	if hasEndpointWeights(service, cfg) {
+		return records
+	}
+	selected, err := selectedPorts(service)
+	ignoreInvalidAnnotation(service, portsAnnotation, err)
+	for _, port := range service.Spec.Ports {
+		// Only the primary port is browsable if one is set
+		if primaryport != 0 && port.Port != primaryport {
+			continue
+		}
+		if selected != nil && !selected[port.Name] {
+			continue
+		}
+		if readyPorts != nil && !readyPorts[port.Name] {
+			continue
+		}
+		txt := append(append([]string{}, svctxt[port.Name]...), annotationtxt...)
+		portnumber := port.Port
+		if srvport != 0 {
+			portnumber = srvport
+		}
+		records = append(records, buildSRVRecord(cfg.portInstanceName(instancename, service, port.Name), port.Name, port.Protocol, srvtarget, uint16(portnumber), targetPort(port), txt, cfg)...)
+	}
+
+	return records
+}
+
+// serviceInstanceName returns the DNS-SD service instance name of the service
+func serviceInstanceName(service *corev1.Service, cfg Config) string {
+	if instancename, ok := service.Annotations[serviceInstanceAnnotation]; ok {
+		return normalizeAnnotation(service, serviceInstanceAnnotation, instancename, false)
+	}
+	return service.Namespace + cfg.instanceSeparator() + service.Name
+}
+
+// annotationTXT returns the TXT entries for all ports of the service taken
+// from its annotations and labels.
+func annotationTXT(service *corev1.Service, cfg Config) []string {
+	var annotationtxt []string
+	if cfg.AnnotationTXTPrefix != "" {
+		for k, v := range service.Annotations {
+			if key := strings.TrimPrefix(k, cfg.AnnotationTXTPrefix); key != k && key != "" {
+				annotationtxt = append(annotationtxt, fmt.Sprintf("%s=%s", key, v))
+			}
+		}
+		sort.Strings(annotationtxt)
+	}
+	var devicetxt []string
+	for annotation, key := range deviceTXTAnnotations {
+		if value, ok := service.Annotations[annotation]; ok {
+			devicetxt = append(devicetxt, fmt.Sprintf("%s=%s", key, strings.TrimSpace(value)))
+		}
+	}
+	sort.Strings(devicetxt)
+	annotationtxt = append(annotationtxt, devicetxt...)
+	for _, key := range cfg.LabelsToTXT {
+		if value, ok := service.Labels[key]; ok {
+			annotationtxt = append(annotationtxt, fmt.Sprintf("%s=%s", key, value))
+		}
+	}
+	if value, ok := service.Annotations[urlAnnotation]; ok {
+		entry, err := urlTXT(value)
+		ignoreInvalidAnnotation(service, urlAnnotation, err)
+		if err == nil {
+			annotationtxt = append(annotationtxt, entry)
+		}
 	}
+	if cfg.OwnerID != "" {
+		annotationtxt = append(annotationtxt, "owner="+cfg.OwnerID)
+	}
+	return annotationtxt
+}
+
+// resolvePort returns the number of the service port referenced by value,
+// which is either a port name or number.
+func resolvePort(service *corev1.Service, value string) (int32, error) {
+	value = strings.TrimSpace(value)
+	for _, port := range service.Spec.Ports {
+		if port.Name == value || fmt.Sprint(port.Port) == value {
+			return port.Port, nil
+		}
+	}
+	return 0, fmt.Errorf("service has no port %q", value)
+}
+
+// selectedPorts returns the names of the ports listed by the ports annotation
+// of the service, by name or number, or nil if the annotation is not set.
+// Unknown ports are left out and reported in the error.
+func selectedPorts(service *corev1.Service) (map[string]bool, error) {
+	value, ok := service.Annotations[portsAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	selected := map[string]bool{}
+	var unknown []string
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		found := false
+		for _, port := range service.Spec.Ports {
+			if port.Name == entry || fmt.Sprint(port.Port) == entry {
+				selected[port.Name] = true
+				found = true
+			}
+		}
+		if !found {
+			unknown = append(unknown, entry)
+		}
+	}
+	if len(unknown) > 0 {
+		return selected, fmt.Errorf("service has no ports %q", unknown)
+	}
+	return selected, nil
+}
 
-	instancename, hasInstancename := service.Annotations["external-mdns.blake.github.io/service-instance"]
-	if !hasInstancename {
-		instancename = fmt.Sprintf("%s/%s", service.Namespace, service.Name)
+// targetPort returns the target port of the service port, which defaults to
+// the port itself, as a number or name.
+func targetPort(port corev1.ServicePort) string {
+	if port.TargetPort.IntVal == 0 && port.TargetPort.StrVal == "" {
+		return fmt.Sprint(port.Port)
 	}
+	return port.TargetPort.String()
+}
 
+// serviceTXT returns the TXT entries the service-txt annotation assigns to
+// each port name, sorted to keep records comparable between updates.
+func serviceTXT(service *corev1.Service) (map[string][]string, error) {
 	svctxt := map[string][]string{}
-	txtstr, hasTxt := service.Annotations["external-mdns.blake.github.io/service-txt"]
-	if txtstr != "" && hasTxt {
-		var txtmap map[string]map[string]string
-		if err := json.Unmarshal([]byte(txtstr), &txtmap); err == nil {
-			for svc, txt := range txtmap {
-				for k, v := range txt {
-					svctxt[svc] = append(svctxt[svc], fmt.Sprintf("%s=%s", k, v))
+	txtstr := service.Annotations[serviceTxtAnnotation]
+	if txtstr == "" {
+		return svctxt, nil
+	}
+
+	var txtmap map[string]map[string]string
+	if err := json.Unmarshal([]byte(txtstr), &txtmap); err != nil {
+		return svctxt, err
+	}
+	for svc, txt := range txtmap {
+		for k, v := range txt {
+			svctxt[svc] = append(svctxt[svc], fmt.Sprintf("%s=%s", k, v))
+		}
+		sort.Strings(svctxt[svc])
+	}
+	return svctxt, nil
+}
+
+// urlTXT returns the TXT entry for the url annotation value, which is either
+// a path (path=/admin) or an absolute URL (url=https://...).
+func urlTXT(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if strings.HasPrefix(value, "/") {
+		return "path=" + value, nil
+	}
+	u, err := url.Parse(value)
+	if err != nil {
+		return "", err
+	}
+	if !u.IsAbs() || u.Host == "" {
+		return "", fmt.Errorf("%q is neither a path nor an absolute URL", value)
+	}
+	return "url=" + value, nil
+}
+
+// parseDomainName returns the fully qualified form of the domain name given
+// in an annotation value.
+func parseDomainName(value string) (string, error) {
+	name := strings.TrimSpace(value)
+	if _, valid := dns.IsDomainName(name); !valid || name == "" {
+		return "", fmt.Errorf("%q is not a domain name", name)
+	}
+	return dns.Fqdn(name), nil
+}
+
+// externalNameRecords returns the records pointing the hostname of an
+// ExternalName service to its external name, and the name SRV records should
+// target. Names in .local get a CNAME; other names are resolved to A/AAAA
+// records if ResolveExternalNames is set, and get a CNAME otherwise.
+func externalNameRecords(service *corev1.Service, hostname string, cfg Config) ([]dns.RR, string) {
+	var records []dns.RR
+	target, err := parseDomainName(service.Spec.ExternalName)
+	if err != nil {
+		log.Printf("Not publishing service %s/%s: invalid external name: %v", service.Namespace, service.Name, err)
+		return records, ""
+	}
+	return aliasTargetRecords(service, hostname, target, !isLocalName(target) && cfg.ResolveExternalNames, cfg)
+}
+
+// aliasTargetRecords returns the records publishing hostname as an alias of
+// target, either as a CNAME or, if resolve is set, with the addresses target
+// resolves to, and the name SRV records have to point to.
+func aliasTargetRecords(service *corev1.Service, hostname string, target string, resolve bool, cfg Config) ([]dns.RR, string) {
+	var records []dns.RR
+	if cfg.ReverseOnly {
+		return records, ""
+	}
+
+	if resolve {
+		ips, err := lookupAddresses(target)
+		if err != nil {
+			log.Printf("Not publishing service %s/%s: failed to resolve %s: %v", service.Namespace, service.Name, target, err)
+			return records, ""
+		}
+		for _, ip := range ips {
+			records = append(records, buildAddressRecords(hostname, ip, true, false, cfg)...)
+		}
+		return records, hostname
+	}
+
+	// SRV records must not point to an alias, so they target the external
+	// name directly
+	records = append(records, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: hostname, Rrtype: dns.TypeCNAME},
+		Target: target,
+	})
+	return records, target
+}
+
+// wildcardRecords returns a copy of each address and CNAME record of hostname
+// in records for the wildcard name *.hostname, which the responder answers
+// queries for all names below hostname with.
+func wildcardRecords(records []dns.RR, hostname string) []dns.RR {
+	var wildcards []dns.RR
+	for _, rr := range records {
+		switch rr.Header().Rrtype {
+		case dns.TypeA, dns.TypeAAAA, dns.TypeCNAME:
+			if rr.Header().Name == hostname {
+				wildcard := dns.Copy(rr)
+				wildcard.Header().Name = "*." + hostname
+				wildcards = append(wildcards, wildcard)
+			}
+		}
+	}
+	return wildcards
+}
+
+// resolvesHostname reports whether the records of the service depend on
+// resolving a hostname, its load balancer hostname or external name.
+func resolvesHostname(service *corev1.Service, cfg Config) bool {
+	if service.Spec.Type == corev1.ServiceTypeExternalName {
+		target, err := parseDomainName(service.Spec.ExternalName)
+		return err == nil && !isLocalName(target) && cfg.ResolveExternalNames
+	}
+	return loadBalancerHostname(service) != "" && cfg.LoadBalancerHostnameMode == LoadBalancerHostnameResolve
+}
+
+// loadBalancerHostname returns the first hostname reported by the load
+// balancer of the service, fully qualified, or "" if there is none.
+func loadBalancerHostname(service *corev1.Service) string {
+	for _, lb := range service.Status.LoadBalancer.Ingress {
+		if lb.Hostname != "" {
+			return dns.Fqdn(lb.Hostname)
+		}
+	}
+	return ""
+}
+
+// resolvedLoadBalancerAddresses returns the addresses of the family selected
+// by LoadBalancerHostnameFamily that hostname, the load balancer hostname of
+// object, resolves to. Lookups are cached until the next refresh if
+// LoadBalancerHostnameRefresh is set.
+func resolvedLoadBalancerAddresses(object string, hostname string, cfg Config) []net.IP {
+	var resolved []net.IP
+	var err error
+	if cfg.LoadBalancerHostnameRefresh > 0 {
+		resolved, err = loadBalancerLookups.lookup(hostname)
+	} else {
+		resolved, err = lookupAddresses(hostname)
+	}
+	if err != nil {
+		log.Printf("Not publishing %s: failed to resolve %s: %v", object, hostname, err)
+		return nil
+	}
+
+	var ips []net.IP
+	for _, ip := range resolved {
+		if cfg.acceptsAddressFamily(ip) && cfg.acceptsLoadBalancerAddress(ip) && cfg.checkReachable(ip, object) {
+			ips = append(ips, ip)
+		}
+	}
+	return ips
+}
+
+// isPublishable reports whether the service carries any External-mDNS
+// annotation or all services are to be published. Services owned by another
+// instance, according to their owner-id annotation, are never publishable.
+func isPublishable(service *corev1.Service, cfg Config) bool {
+	if strings.TrimSpace(service.Annotations[ownerIDAnnotation]) != cfg.OwnerID {
+		return false
+	}
+	if cfg.PublishAll {
+		return true
+	}
+	for _, annotation := range []string{hostnameAnnotation, serviceInstanceAnnotation, serviceTxtAnnotation, publishAnnotation, ownerIDAnnotation} {
+		if _, ok := service.Annotations[annotation]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// serviceAddresses returns the addresses to advertise for the service. Which
+// of the cluster IP and the load balancer address are used depends on the
+// service type, unless overridden by the address-source annotation. The
+// external IPs of services of any type are added if the use-external-ips
+// annotation is set; ExternalIPsPolicy decides whether they replace or are
+// replaced by the cluster IP.
+func serviceAddresses(service *corev1.Service, cfg Config) []net.IP {
+	ips := addressSourceAddresses(service, cfg)
+	var externalIPs []net.IP
+	if value, ok := service.Annotations[useExternalIPsAnnotation]; ok {
+		use, err := strconv.ParseBool(strings.TrimSpace(value))
+		ignoreInvalidAnnotation(service, useExternalIPsAnnotation, err)
+		if err == nil && use {
+			externalIPs = externalIPAddresses(service)
+		}
+	}
+	if len(externalIPs) == 0 {
+		return ips
+	}
+
+	clusterIP := clusterIPAddress(service)
+	hasClusterIP := false
+	for _, ip := range ips {
+		if ip.Equal(clusterIP) {
+			hasClusterIP = true
+		}
+	}
+	if hasClusterIP {
+		switch cfg.ExternalIPsPolicy {
+		case ExternalIPsPolicyClusterIP:
+			return ips
+		case ExternalIPsPolicyExternalIPs:
+			var withoutClusterIP []net.IP
+			for _, ip := range ips {
+				if !ip.Equal(clusterIP) {
+					withoutClusterIP = append(withoutClusterIP, ip)
 				}
 			}
+			ips = withoutClusterIP
 		}
 	}
+	return append(ips, externalIPs...)
+}
 
-	if !s.publishAll && !hasHostname && !hasInstancename && !hasTxt {
-		_, hasPublish := service.Annotations["external-mdns.blake.github.io/publish"]
-		if !hasPublish {
-			return records
+// addressSourceAddresses returns the cluster IP and load balancer addresses
+// of the service selected by its type or address-source annotation.
+func addressSourceAddresses(service *corev1.Service, cfg Config) []net.IP {
+	addressSource, ok := service.Annotations[addressSourceAnnotation]
+	if ok {
+		addressSource = strings.ToLower(strings.TrimSpace(addressSource))
+	} else if service.Spec.Type == corev1.ServiceTypeClusterIP {
+		addressSource = addressSourceClusterIP
+	} else if service.Spec.Type == corev1.ServiceTypeLoadBalancer {
+		addressSource = addressSourceLoadBalancer
+	}
+
+	var ips []net.IP
+	switch addressSource {
+	case addressSourceClusterIP, addressSourceLoadBalancer, addressSourceBoth:
+	case "":
+		return ips
+	default:
+		log.Printf("Not publishing service %s/%s: invalid annotation %s: %q", service.Namespace, service.Name, addressSourceAnnotation, addressSource)
+		return ips
+	}
+
+	if addressSource != addressSourceLoadBalancer {
+		if ip := clusterIPAddress(service); ip != nil {
+			ips = append(ips, ip)
+		}
+	}
+	if addressSource != addressSourceClusterIP {
+		ips = append(ips, loadBalancerAddresses(service, cfg)...)
+	}
+	return ips
+}
+
+// externalIPAddresses returns the valid external IPs of the service
+func externalIPAddresses(service *corev1.Service) []net.IP {
+	var ips []net.IP
+	for _, externalIP := range service.Spec.ExternalIPs {
+		if ip := net.ParseIP(strings.TrimSpace(externalIP)); ip != nil {
+			ips = append(ips, ip)
+		} else {
+			log.Printf("Ignoring invalid external IP %q of service %s/%s", externalIP, service.Namespace, service.Name)
+		}
+	}
+	return ips
+}
+
+// clusterIPAddress returns the cluster IP of the service, considering the
+// priority annotation for dual-stack services.
+func clusterIPAddress(service *corev1.Service) net.IP {
+	var candidates []net.IP
+	for _, clusterIP := range service.Spec.ClusterIPs {
+		if candidate := net.ParseIP(clusterIP); candidate != nil {
+			candidates = append(candidates, candidate)
 		}
 	}
 
-	var ip net.IP
-	if service.Spec.Type == "ClusterIP" {
-		ip = net.ParseIP(service.Spec.ClusterIP)
-	} else if service.Spec.Type == "LoadBalancer" {
-		for _, lb := range service.Status.LoadBalancer.Ingress {
-			if lb.IP != "" {
-				ip = net.ParseIP(lb.IP)
+	if preferred := selectAddress(candidates, service.Annotations[priorityAnnotation]); preferred != nil {
+		return preferred
+	}
+	return net.ParseIP(service.Spec.ClusterIP)
+}
+
+// loadBalancerAddresses returns the load balancer addresses of the service.
+// All ingress IPs are returned unless the priority annotation selects one of
+// them.
+func loadBalancerAddresses(service *corev1.Service, cfg Config) []net.IP {
+	var candidates []net.IP
+	for _, lb := range service.Status.LoadBalancer.Ingress {
+		if lbIP := net.ParseIP(lb.IP); lbIP != nil && cfg.acceptsLoadBalancerAddress(lbIP) {
+			candidates = append(candidates, lbIP)
+		}
+	}
+
+	// Prefer the addresses in the responder's own zone, if any
+	if local := zoneAddresses(service, candidates, cfg.Zone); len(local) > 0 {
+		candidates = local
+	}
+
+	if preferred := selectAddress(candidates, service.Annotations[priorityAnnotation]); preferred != nil {
+		return []net.IP{preferred}
+	}
+	return candidates
+}
+
+// zoneAddresses returns the candidates which the address-zones annotation of
+// the service assigns to zone.
+func zoneAddresses(service *corev1.Service, candidates []net.IP, zone string) []net.IP {
+	value, ok := service.Annotations[addressZonesAnnotation]
+	if zone == "" || !ok {
+		return nil
+	}
+
+	var zones map[string]string
+	err := json.Unmarshal([]byte(value), &zones)
+	ignoreInvalidAnnotation(service, addressZonesAnnotation, err)
+	if err != nil {
+		return nil
+	}
+
+	var local []net.IP
+	for address, addressZone := range zones {
+		ip := net.ParseIP(address)
+		if ip == nil || addressZone != zone {
+			continue
+		}
+		for _, candidate := range candidates {
+			if candidate.Equal(ip) {
+				local = append(local, candidate)
 			}
 		}
 	}
+	sort.Slice(local, func(a, b int) bool { return local[a].String() < local[b].String() })
+	return local
+}
 
-	if ip == nil {
-		return records
+// selectAddress returns the first candidate matching priority, which is either
+// an IP address or an address family ("ipv4" or "ipv6"). It returns nil if no
+// candidate matches.
+func selectAddress(candidates []net.IP, priority string) net.IP {
+	if priority == "" {
+		return nil
 	}
 
-        if !strings.HasSuffix(hostname, ".") {
-        	hostname = hostname + "."
-        }
-        if !strings.HasSuffix(hostname, ".local.") {
-        	hostname = hostname + "local."
-        }
+	preferred := net.ParseIP(priority)
+	for _, candidate := range candidates {
+		isIPv4 := candidate.To4() != nil
+		switch {
+		case preferred != nil && preferred.Equal(candidate),
+			priority == "ipv4" && isIPv4,
+			priority == "ipv6" && !isIPv4:
+			return candidate
+		}
+	}
+	return nil
+}
 
-	records = buildARecord(hostname, ip, true)
-	for _, port := range service.Spec.Ports {
-		records = append(records, buildSRVRecord(instancename, port.Name, port.Protocol, hostname, uint16(port.Port), svctxt[port.Name])...)
+// hasReadyCondition reports whether the status condition named by the
+// ready-condition annotation of the service is true, e.g. one set by an
+// operator once the service is usable. Services without the annotation are
+// always ready.
+func hasReadyCondition(service *corev1.Service) bool {
+	value, ok := service.Annotations[readyConditionAnnotation]
+	if !ok {
+		return true
 	}
+	return meta.IsStatusConditionTrue(service.Status.Conditions, strings.TrimSpace(value))
+}
 
-	return records
+// checkPortReferences returns an error for the first annotation of the
+// service that references a port the service does not have, checking the
+// service-txt, srv-port, primary-port and ports annotations.
+func checkPortReferences(service *corev1.Service) error {
+	svctxt, _ := serviceTXT(service)
+	var txtports []string
+	for port := range svctxt {
+		txtports = append(txtports, port)
+	}
+	if unknown := unknownPorts(service, txtports); len(unknown) > 0 {
+		return fmt.Errorf("annotation %s references unknown ports %v", serviceTxtAnnotation, unknown)
+	}
+	for _, annotation := range []string{srvPortAnnotation, primaryPortAnnotation} {
+		if value, ok := service.Annotations[annotation]; ok {
+			if _, err := resolvePort(service, value); err != nil {
+				return fmt.Errorf("annotation %s references an unknown port: %v", annotation, err)
+			}
+		}
+	}
+	if _, err := selectedPorts(service); err != nil {
+		return fmt.Errorf("annotation %s references unknown ports: %v", portsAnnotation, err)
+	}
+	return nil
+}
+
+// unknownPorts returns the sorted subset of names which do not match the name
+// of any port of the service.
+func unknownPorts(service *corev1.Service, names []string) []string {
+	var unknown []string
+	for _, name := range names {
+		found := false
+		for _, port := range service.Spec.Ports {
+			if port.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, name)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// normalizeAnnotation trims surrounding whitespace from an annotation value and
+// optionally lowercases it, logging if the value was changed.
+func normalizeAnnotation(service *corev1.Service, annotation string, value string, lowercase bool) string {
+	normalized := strings.TrimSpace(value)
+	if lowercase {
+		normalized = strings.ToLower(normalized)
+	}
+	if normalized != value {
+		log.Printf("Normalized annotation %s of service %s/%s from %q to %q", annotation, service.Namespace, service.Name, value, normalized)
+	}
+	return normalized
+}
+
+// ignoreInvalidAnnotation logs that the annotation of the service is ignored
+// as it is invalid, reported by err. This is logged once until err is nil.
+func ignoreInvalidAnnotation(service *corev1.Service, annotation string, err error) {
+	object := service.Namespace + "/" + service.Name
+	if err == nil {
+		notices.clear("invalid "+annotation, object)
+		return
+	}
+	notices.logf("invalid "+annotation, object, "Ignoring invalid annotation %s of service %s: %v", annotation, object, err)
+}
+
+// serviceHostname returns the fully qualified .local hostname for the service
+func serviceHostname(service *corev1.Service, cfg Config) string {
+	hostname, hasHostname := service.Annotations[hostnameAnnotation]
+	if hasHostname {
+		hostname = normalizeAnnotation(service, hostnameAnnotation, hostname, cfg.LowercaseHostnames)
+		if len(cfg.HostnameAliases) > 0 {
+			hostname = resolveHostname(service, qualifyHostname(hostname), cfg.HostnameAliases)
+		}
+	} else if domain, ok := cfg.NamespaceDomains[service.Namespace]; ok {
+		hostname = fmt.Sprintf("%s.%s", service.Name, domain)
+	} else if cfg.ClusterName != "" {
+		hostname = fmt.Sprintf("%s.%s.%s.local.", service.Name, service.Namespace, cfg.ClusterName)
+	} else {
+		hostname = fmt.Sprintf("%s.%s.local.", service.Name, service.Namespace)
+	}
+
+	return qualifyHostname(hostname)
+}
+
+// resolveHostname follows the chain of aliases starting at hostname and
+// returns its final target. On a loop, hostname is returned unchanged.
+func resolveHostname(service *corev1.Service, hostname string, aliases map[string]string) string {
+	target := hostname
+	seen := map[string]bool{}
+	for {
+		next, ok := aliases[target]
+		if !ok {
+			return target
+		}
+		if seen[target] {
+			log.Printf("Not resolving hostname %s of service %s/%s: alias loop at %s", hostname, service.Namespace, service.Name, target)
+			return hostname
+		}
+		seen[target] = true
+		target = next
+	}
+}
+
+// qualifyHostname turns hostname into a fully qualified .local name
+func qualifyHostname(hostname string) string {
+	if !strings.HasSuffix(hostname, ".") {
+		hostname = hostname + "."
+	}
+	if !isLocalName(hostname) {
+		hostname = hostname + "local."
+	}
+
+	return hostname
+}
+
+// reverseHostname returns the name the reverse PTR for ip should point to,
+// which may be overridden per address family by annotation.
+func reverseHostname(service *corev1.Service, ip net.IP, hostname string, cfg Config) string {
+	annotation := ptrTargetIPv6Annotation
+	if ip.To4() != nil {
+		annotation = ptrTargetIPv4Annotation
+	}
+	if target, ok := service.Annotations[annotation]; ok {
+		return qualifyHostname(normalizeAnnotation(service, annotation, target, cfg.LowercaseHostnames))
+	}
+	return hostname
 }
 
 // NewServicesWatcher creates an ServiceSource
-func NewServicesWatcher(factory informers.SharedInformerFactory, publishAll bool, notifyChan chan<- resource.Resource) ServiceSource {
+func NewServicesWatcher(factory informers.SharedInformerFactory, config Config, notifyChan chan<- resource.Resource) *ServiceSource {
 	servicesInformer := factory.Core().V1().Services().Informer()
 	s := &ServiceSource{
-		publishAll:      publishAll,
-		notifyChan:      notifyChan,
-		sharedInformer:  servicesInformer,
+		config:         config,
+		sharedInformer: servicesInformer,
+		recordSet:      newRecordSet("service", notifyChan, config),
+	}
+	s.instances = newInstanceRegistry(config.InstanceConflict, s.retry)
+	s.transform = s.instances.resolve
+	if config.WatchEndpoints {
+		s.endpointsInformer = factory.Core().V1().Endpoints().Informer()
+		s.endpointsLister = factory.Core().V1().Endpoints().Lister()
+		s.endpointsInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    s.onEndpointsChange,
+			DeleteFunc: s.onEndpointsChange,
+			UpdateFunc: func(oldObj interface{}, newObj interface{}) {
+				s.onEndpointsChange(newObj)
+			},
+		})
 	}
 	servicesInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
 		AddFunc:    s.onAdd,
@@ -148,5 +969,5 @@ func NewServicesWatcher(factory informers.SharedInformerFactory, publishAll bool
 		UpdateFunc: s.onUpdate,
 	})
 
-	return *s
+	return s
 }
@@ -0,0 +1,1747 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/blake/external-mdns/resource"
+	"github.com/miekg/dns"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// recordStrings returns records in presentation format without TTL and
+// class, which are set by main, sorted for comparison
+func recordStrings(records []dns.RR) []string {
+	strs := []string{}
+	for _, rr := range records {
+		fields := strings.Fields(rr.String())
+		strs = append(strs, fields[0]+" "+strings.Join(fields[3:], " "))
+	}
+	sort.Strings(strs)
+	return strs
+}
+
+// sortedStrings returns a sorted copy of strs, never nil
+func sortedStrings(strs ...string) []string {
+	sorted := append([]string{}, strs...)
+	sort.Strings(sorted)
+	return sorted
+}
+
+// testService returns the annotated ClusterIP service web in namespace
+// default with a single HTTP port
+func testService() *corev1.Service {
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        "web",
+			Namespace:   "default",
+			Annotations: map[string]string{publishAnnotation: "true"},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:       corev1.ServiceTypeClusterIP,
+			ClusterIP:  "10.0.0.10",
+			ClusterIPs: []string{"10.0.0.10"},
+			Ports: []corev1.ServicePort{
+				{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP},
+			},
+		},
+	}
+}
+
+// webRecords are the records of testService, with the address records of
+// addresses added
+func webRecords(addresses ...string) []string {
+	records := []string{
+		"_http._tcp.local. PTR default/web._http._tcp.local.",
+		"default/web._http._tcp.local. SRV 0 0 80 web.default.local.",
+		`default/web._http._tcp.local. TXT ""`,
+	}
+	return sortedStrings(append(records, addresses...)...)
+}
+
+func TestBuildServiceRecords(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(service *corev1.Service)
+		cfg    Config
+		want   []string
+	}{
+		{
+			name: "cluster IP",
+			want: webRecords(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "IPv6 cluster IP",
+			modify: func(service *corev1.Service) {
+				service.Spec.ClusterIP = "fd00::a"
+				service.Spec.ClusterIPs = []string{"fd00::a"}
+			},
+			want: webRecords(
+				"web.default.local. AAAA fd00::a",
+				"a.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "not annotated",
+			modify: func(service *corev1.Service) {
+				service.Annotations = nil
+			},
+			want: []string{},
+		},
+		{
+			name: "not annotated with publish all",
+			modify: func(service *corev1.Service) {
+				service.Annotations = nil
+			},
+			cfg: Config{PublishAll: true},
+			want: webRecords(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "namespace domain",
+			cfg:  Config{NamespaceDomains: map[string]string{"default": "prod.local.", "dev": "dev.local."}},
+			want: sortedStrings(
+				"web.prod.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.prod.local.",
+				"_http._tcp.local. PTR default/web._http._tcp.local.",
+				"default/web._http._tcp.local. SRV 0 0 80 web.prod.local.",
+				`default/web._http._tcp.local. TXT ""`,
+			),
+		},
+		{
+			name: "domain of another namespace",
+			cfg:  Config{NamespaceDomains: map[string]string{"dev": "dev.local."}},
+			want: webRecords(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "hostname annotation",
+			modify: func(service *corev1.Service) {
+				service.Annotations = map[string]string{hostnameAnnotation: "printer"}
+			},
+			want: sortedStrings(
+				"printer.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR printer.local.",
+				"_http._tcp.local. PTR default/web._http._tcp.local.",
+				"default/web._http._tcp.local. SRV 0 0 80 printer.local.",
+				`default/web._http._tcp.local. TXT ""`,
+			),
+		},
+		{
+			name: "service instance annotation",
+			modify: func(service *corev1.Service) {
+				service.Annotations = map[string]string{serviceInstanceAnnotation: "frontend"}
+			},
+			want: sortedStrings(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+				"_http._tcp.local. PTR frontend._http._tcp.local.",
+				"frontend._http._tcp.local. SRV 0 0 80 web.default.local.",
+				`frontend._http._tcp.local. TXT ""`,
+			),
+		},
+		{
+			name: "service txt annotation",
+			modify: func(service *corev1.Service) {
+				service.Annotations = map[string]string{serviceTxtAnnotation: `{"http": {"path": "/", "version": "2"}}`}
+			},
+			want: sortedStrings(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+				"_http._tcp.local. PTR default/web._http._tcp.local.",
+				"default/web._http._tcp.local. SRV 0 0 80 web.default.local.",
+				`default/web._http._tcp.local. TXT "path=/" "version=2"`,
+			),
+		},
+		{
+			name: "annotation TXT prefix",
+			modify: func(service *corev1.Service) {
+				service.Annotations["mdns-txt.example.com/version"] = "2"
+				service.Annotations["mdns-txt.example.com/team"] = "web"
+				service.Annotations["mdns-txt.example.com/"] = "empty key"
+				service.Annotations["other.example.com/version"] = "3"
+			},
+			cfg: Config{AnnotationTXTPrefix: "mdns-txt.example.com/"},
+			want: sortedStrings(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+				"_http._tcp.local. PTR default/web._http._tcp.local.",
+				"default/web._http._tcp.local. SRV 0 0 80 web.default.local.",
+				`default/web._http._tcp.local. TXT "team=web" "version=2"`,
+			),
+		},
+		{
+			name: "labels to TXT",
+			modify: func(service *corev1.Service) {
+				service.Labels = map[string]string{"version": "2", "team": "web", "tier": "frontend"}
+			},
+			cfg: Config{LabelsToTXT: []string{"team", "version", "owner"}},
+			want: sortedStrings(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+				"_http._tcp.local. PTR default/web._http._tcp.local.",
+				"default/web._http._tcp.local. SRV 0 0 80 web.default.local.",
+				`default/web._http._tcp.local. TXT "team=web" "version=2"`,
+			),
+		},
+		{
+			name: "device annotations",
+			modify: func(service *corev1.Service) {
+				service.Annotations["external-mdns.blake.github.io/device-model"] = "LaserJet 4000"
+				service.Annotations["external-mdns.blake.github.io/device-type"] = "HP LaserJet"
+				service.Annotations["external-mdns.blake.github.io/device-note"] = " 2nd floor "
+				service.Annotations["external-mdns.blake.github.io/printer-queue"] = "queue1"
+				service.Annotations["external-mdns.blake.github.io/admin-url"] = "http://printer.local/"
+			},
+			want: sortedStrings(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+				"_http._tcp.local. PTR default/web._http._tcp.local.",
+				"default/web._http._tcp.local. SRV 0 0 80 web.default.local.",
+				`default/web._http._tcp.local. TXT "adminurl=http://printer.local/" "model=LaserJet 4000" "note=2nd floor" "rp=queue1" "ty=HP LaserJet"`,
+			),
+		},
+		{
+			name: "several ports",
+			modify: func(service *corev1.Service) {
+				service.Spec.Ports = append(service.Spec.Ports,
+					corev1.ServicePort{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+					corev1.ServicePort{Name: "sctp", Port: 9, Protocol: corev1.ProtocolSCTP},
+				)
+			},
+			want: webRecords(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+				"_dns._udp.local. PTR default/web._dns._udp.local.",
+				"default/web._dns._udp.local. SRV 0 0 53 web.default.local.",
+				`default/web._dns._udp.local. TXT ""`,
+			),
+		},
+		{
+			name: "primary port",
+			modify: func(service *corev1.Service) {
+				service.Spec.Ports = append(service.Spec.Ports,
+					corev1.ServicePort{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP},
+					corev1.ServicePort{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+				)
+				service.Annotations[primaryPortAnnotation] = "https"
+			},
+			want: sortedStrings(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+				"_https._tcp.local. PTR default/web._https._tcp.local.",
+				"default/web._https._tcp.local. SRV 0 0 443 web.default.local.",
+				`default/web._https._tcp.local. TXT ""`,
+			),
+		},
+		{
+			name: "CGNAT address",
+			modify: func(service *corev1.Service) {
+				service.Spec.ClusterIP = "100.100.1.10"
+				service.Spec.ClusterIPs = []string{"100.100.1.10"}
+			},
+			want: webRecords(
+				"web.default.local. A 100.100.1.10",
+				"10.1.100.100.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "CGNAT address skipped",
+			modify: func(service *corev1.Service) {
+				service.Spec.ClusterIP = "100.100.1.10"
+				service.Spec.ClusterIPs = []string{"100.100.1.10"}
+			},
+			cfg:  Config{SkipCGNAT: true},
+			want: []string{},
+		},
+		{
+			name: "address outside the CGNAT range",
+			modify: func(service *corev1.Service) {
+				service.Spec.ClusterIP = "100.128.0.10"
+				service.Spec.ClusterIPs = []string{"100.128.0.10"}
+			},
+			cfg: Config{SkipCGNAT: true},
+			want: webRecords(
+				"web.default.local. A 100.128.0.10",
+				"10.0.128.100.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "required port by name",
+			cfg:  Config{RequirePort: "http"},
+			want: webRecords(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "required port by number",
+			cfg:  Config{RequirePort: "80"},
+			want: webRecords(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "required port missing",
+			cfg:  Config{RequirePort: "https"},
+			want: []string{},
+		},
+		{
+			name: "instance template with port names",
+			modify: func(service *corev1.Service) {
+				service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP})
+			},
+			cfg: Config{InstanceTemplate: template.Must(template.New("instance").Parse("{{.Name}}-{{.Port}}"))},
+			want: sortedStrings(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+				"_http._tcp.local. PTR web-http._http._tcp.local.",
+				"web-http._http._tcp.local. SRV 0 0 80 web.default.local.",
+				`web-http._http._tcp.local. TXT ""`,
+				"_https._tcp.local. PTR web-https._https._tcp.local.",
+				"web-https._https._tcp.local. SRV 0 0 443 web.default.local.",
+				`web-https._https._tcp.local. TXT ""`,
+			),
+		},
+		{
+			name: "instance template producing an invalid name",
+			cfg:  Config{InstanceTemplate: template.Must(template.New("instance").Parse("{{.Name}}.{{.Port}}"))},
+			want: webRecords(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "wildcard annotation",
+			modify: func(service *corev1.Service) {
+				service.Annotations[wildcardAnnotation] = "true"
+			},
+			want: webRecords(
+				"web.default.local. A 10.0.0.10",
+				"*.web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "wildcard annotation disabled",
+			modify: func(service *corev1.Service) {
+				service.Annotations[wildcardAnnotation] = "false"
+			},
+			want: webRecords(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "ports annotation",
+			modify: func(service *corev1.Service) {
+				service.Spec.Ports = append(service.Spec.Ports,
+					corev1.ServicePort{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP},
+					corev1.ServicePort{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+				)
+				service.Annotations[portsAnnotation] = "443"
+			},
+			want: sortedStrings(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+				"_https._tcp.local. PTR default/web._https._tcp.local.",
+				"default/web._https._tcp.local. SRV 0 0 443 web.default.local.",
+				`default/web._https._tcp.local. TXT ""`,
+			),
+		},
+		{
+			name: "ports annotation by name with an unknown port",
+			modify: func(service *corev1.Service) {
+				service.Spec.Ports = append(service.Spec.Ports,
+					corev1.ServicePort{Name: "https", Port: 443, Protocol: corev1.ProtocolTCP},
+					corev1.ServicePort{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP},
+				)
+				service.Annotations[portsAnnotation] = "dns, ssh"
+			},
+			want: sortedStrings(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+				"_dns._udp.local. PTR default/web._dns._udp.local.",
+				"default/web._dns._udp.local. SRV 0 0 53 web.default.local.",
+				`default/web._dns._udp.local. TXT ""`,
+			),
+		},
+		{
+			name: "no ports",
+			modify: func(service *corev1.Service) {
+				service.Spec.Ports = nil
+			},
+			want: sortedStrings(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "load balancer",
+			modify: func(service *corev1.Service) {
+				service.Spec.Type = corev1.ServiceTypeLoadBalancer
+				service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "192.168.1.10"}}
+			},
+			want: webRecords(
+				"web.default.local. A 192.168.1.10",
+				"10.1.168.192.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "load balancer with several addresses",
+			modify: func(service *corev1.Service) {
+				service.Spec.Type = corev1.ServiceTypeLoadBalancer
+				service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{
+					{IP: "192.168.1.10"},
+					{IP: "192.168.1.11"},
+					{Hostname: "lb.example.com"},
+					{IP: "fd00::10"},
+				}
+			},
+			want: webRecords(
+				"web.default.local. A 192.168.1.10",
+				"web.default.local. A 192.168.1.11",
+				"web.default.local. AAAA fd00::10",
+				"10.1.168.192.in-addr.arpa. PTR web.default.local.",
+				"11.1.168.192.in-addr.arpa. PTR web.default.local.",
+				"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "load balancer without address",
+			modify: func(service *corev1.Service) {
+				service.Spec.Type = corev1.ServiceTypeLoadBalancer
+			},
+			want: []string{},
+		},
+		{
+			name: "external IPs",
+			modify: func(service *corev1.Service) {
+				service.Annotations[useExternalIPsAnnotation] = "true"
+				service.Spec.ExternalIPs = []string{"192.168.1.20", "fd00::20"}
+			},
+			want: webRecords(
+				"web.default.local. A 10.0.0.10",
+				"web.default.local. A 192.168.1.20",
+				"web.default.local. AAAA fd00::20",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+				"20.1.168.192.in-addr.arpa. PTR web.default.local.",
+				"0.2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.ip6.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "external IPs not annotated",
+			modify: func(service *corev1.Service) {
+				service.Spec.ExternalIPs = []string{"192.168.1.20"}
+			},
+			want: webRecords(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "external IPs annotation disabled",
+			modify: func(service *corev1.Service) {
+				service.Annotations[useExternalIPsAnnotation] = "false"
+				service.Spec.ExternalIPs = []string{"192.168.1.20"}
+			},
+			want: webRecords(
+				"web.default.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "invalid external IP",
+			modify: func(service *corev1.Service) {
+				service.Annotations[useExternalIPsAnnotation] = "true"
+				service.Spec.ExternalIPs = []string{"192.168.1", " 192.168.1.20 "}
+			},
+			want: webRecords(
+				"web.default.local. A 10.0.0.10",
+				"web.default.local. A 192.168.1.20",
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+				"20.1.168.192.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "external name",
+			modify: func(service *corev1.Service) {
+				service.Spec.Type = corev1.ServiceTypeExternalName
+				service.Spec.ClusterIP = ""
+				service.Spec.ClusterIPs = nil
+				service.Spec.ExternalName = "nas.example.com"
+			},
+			want: sortedStrings(
+				"web.default.local. CNAME nas.example.com.",
+				"_http._tcp.local. PTR default/web._http._tcp.local.",
+				"default/web._http._tcp.local. SRV 0 0 80 nas.example.com.",
+				`default/web._http._tcp.local. TXT ""`,
+			),
+		},
+		{
+			name: "headless",
+			modify: func(service *corev1.Service) {
+				service.Spec.ClusterIP = corev1.ClusterIPNone
+				service.Spec.ClusterIPs = []string{corev1.ClusterIPNone}
+			},
+			cfg:  Config{WatchEndpoints: true},
+			want: []string{},
+		},
+		{
+			name: "reverse only",
+			cfg:  Config{ReverseOnly: true},
+			want: webRecords(
+				"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := testService()
+			if tt.modify != nil {
+				tt.modify(service)
+			}
+			got := recordStrings(BuildServiceRecords(service, tt.cfg))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("BuildServiceRecords() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestNoPortsLoggedOnce(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	notices.clear("no ports", "default/web")
+
+	portless := testService()
+	portless.Spec.Ports = nil
+	for i := 0; i < 3; i++ {
+		BuildServiceRecords(portless, Config{})
+	}
+	if n := strings.Count(buf.String(), "has no ports"); n != 1 {
+		t.Errorf("logged %d times on rebuilds, want once:\n%s", n, buf.String())
+	}
+
+	// Logged again once the service got ports and lost them again
+	buf.Reset()
+	BuildServiceRecords(testService(), Config{})
+	BuildServiceRecords(portless, Config{})
+	if n := strings.Count(buf.String(), "has no ports"); n != 1 {
+		t.Errorf("logged %d times after the ports were removed again, want once:\n%s", n, buf.String())
+	}
+}
+
+func TestHeadlessLoggedOnce(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	notices.clear("headless", "default/web")
+
+	headless := testService()
+	headless.Spec.ClusterIP = corev1.ClusterIPNone
+	headless.Spec.ClusterIPs = []string{corev1.ClusterIPNone}
+	for i := 0; i < 3; i++ {
+		BuildServiceRecords(headless, Config{})
+	}
+	if n := strings.Count(buf.String(), "Not publishing headless service"); n != 1 {
+		t.Errorf("warned %d times on rebuilds, want once:\n%s", n, buf.String())
+	}
+
+	// Not logged if the endpoints source publishes the service
+	buf.Reset()
+	notices.clear("headless", "default/web")
+	BuildServiceRecords(headless, Config{WatchEndpoints: true})
+	if buf.Len() != 0 {
+		t.Errorf("warned with the endpoints source enabled:\n%s", buf.String())
+	}
+}
+
+func TestInvalidAnnotationLoggedOnce(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	notices.clear("invalid "+srvPortAnnotation, "default/web")
+
+	invalid := testService()
+	invalid.Annotations[srvPortAnnotation] = "https"
+	for i := 0; i < 3; i++ {
+		BuildServiceRecords(invalid, Config{})
+	}
+	if n := strings.Count(buf.String(), "Ignoring invalid annotation"); n != 1 {
+		t.Errorf("logged %d times on rebuilds, want once:\n%s", n, buf.String())
+	}
+
+	// Logged again once the annotation was fixed and broken again
+	buf.Reset()
+	valid := testService()
+	valid.Annotations[srvPortAnnotation] = "http"
+	BuildServiceRecords(valid, Config{})
+	BuildServiceRecords(invalid, Config{})
+	if n := strings.Count(buf.String(), "Ignoring invalid annotation"); n != 1 {
+		t.Errorf("logged %d times after the annotation was broken again, want once:\n%s", n, buf.String())
+	}
+}
+
+func TestSRVPortAnnotation(t *testing.T) {
+	tests := []struct {
+		name  string
+		value string
+		want  uint16
+	}{
+		{name: "named port", value: "https", want: 8443},
+		{name: "port number", value: "8443", want: 8443},
+		{name: "spaces", value: " https ", want: 8443},
+		{name: "unknown port", value: "grpc", want: 80},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := testService()
+			service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{Name: "https", Port: 8443, Protocol: corev1.ProtocolTCP})
+			service.Annotations[srvPortAnnotation] = tt.value
+			service.Annotations[primaryPortAnnotation] = "http"
+
+			var ports []uint16
+			for _, rr := range BuildServiceRecords(service, Config{}) {
+				if srv, ok := rr.(*dns.SRV); ok {
+					ports = append(ports, srv.Port)
+				}
+			}
+			if want := []uint16{tt.want}; !reflect.DeepEqual(ports, want) {
+				t.Errorf("SRV ports = %v, want %v", ports, want)
+			}
+		})
+	}
+}
+
+func TestLoadBalancerAddressType(t *testing.T) {
+	tests := []struct {
+		addressType string
+		want        []string
+	}{
+		{
+			addressType: AddressTypeAll,
+			want: webRecords(
+				"web.default.local. A 192.168.1.10",
+				"web.default.local. A 203.0.113.10",
+				"10.1.168.192.in-addr.arpa. PTR web.default.local.",
+				"10.113.0.203.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			addressType: AddressTypeExternal,
+			want: webRecords(
+				"web.default.local. A 203.0.113.10",
+				"10.113.0.203.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			addressType: AddressTypeInternal,
+			want: webRecords(
+				"web.default.local. A 192.168.1.10",
+				"10.1.168.192.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addressType, func(t *testing.T) {
+			service := testService()
+			service.Spec.Type = corev1.ServiceTypeLoadBalancer
+			service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "192.168.1.10"}, {IP: "203.0.113.10"}}
+			got := recordStrings(BuildServiceRecords(service, Config{LoadBalancerAddressType: tt.addressType}))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("BuildServiceRecords() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestStrictAnnotations(t *testing.T) {
+	published := webRecords(
+		"web.default.local. A 10.0.0.10",
+		"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+	)
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		lenient     []string
+		strict      []string
+	}{
+		{
+			name:        "valid references",
+			annotations: map[string]string{srvPortAnnotation: "http", primaryPortAnnotation: "80", portsAnnotation: "http"},
+			lenient:     published,
+			strict:      published,
+		},
+		{
+			name:        "service-txt",
+			annotations: map[string]string{serviceTxtAnnotation: `{"htp": {"path": "/"}}`},
+			lenient:     published,
+			strict:      []string{},
+		},
+		{
+			name:        "srv-port",
+			annotations: map[string]string{srvPortAnnotation: "8080"},
+			lenient:     published,
+			strict:      []string{},
+		},
+		{
+			name:        "primary-port",
+			annotations: map[string]string{primaryPortAnnotation: "https"},
+			lenient:     published,
+			strict:      []string{},
+		},
+		{
+			name:        "ports",
+			annotations: map[string]string{portsAnnotation: "http, https"},
+			lenient:     published,
+			strict:      []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := testService()
+			for k, v := range tt.annotations {
+				service.Annotations[k] = v
+			}
+			if got := recordStrings(BuildServiceRecords(service, Config{})); !reflect.DeepEqual(got, tt.lenient) {
+				t.Errorf("lenient BuildServiceRecords() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.lenient, "\n"))
+			}
+			if got := recordStrings(BuildServiceRecords(service, Config{StrictAnnotations: true})); !reflect.DeepEqual(got, tt.strict) {
+				t.Errorf("strict BuildServiceRecords() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.strict, "\n"))
+			}
+		})
+	}
+}
+
+func TestPriorityAnnotation(t *testing.T) {
+	tests := []struct {
+		name     string
+		priority string
+		lb       bool
+		want     string
+	}{
+		{name: "dual-stack cluster IP by family", priority: "ipv6", want: "web.default.local. AAAA fd00::a"},
+		{name: "dual-stack cluster IP by address", priority: "10.0.0.10", want: "web.default.local. A 10.0.0.10"},
+		{name: "load balancer by address", priority: "192.168.1.12", lb: true, want: "web.default.local. A 192.168.1.12"},
+		{name: "load balancer by family", priority: "ipv6", lb: true, want: "web.default.local. AAAA 2001:db8::10"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := testService()
+			service.Spec.ClusterIPs = []string{"10.0.0.10", "fd00::a"}
+			if tt.lb {
+				service.Spec.Type = corev1.ServiceTypeLoadBalancer
+				service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "192.168.1.10"}, {IP: "192.168.1.12"}, {IP: "2001:db8::10"}}
+			}
+			service.Annotations[priorityAnnotation] = tt.priority
+
+			var got []string
+			for _, rr := range recordStrings(BuildServiceRecords(service, Config{})) {
+				if strings.HasPrefix(rr, "web.default.local. A") {
+					got = append(got, rr)
+				}
+			}
+			if want := []string{tt.want}; !reflect.DeepEqual(got, want) {
+				t.Errorf("address records = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestAnnotationNormalization(t *testing.T) {
+	tests := []struct {
+		name      string
+		hostname  string
+		instance  string
+		lowercase bool
+		want      []string
+		logged    bool
+	}{
+		{
+			name:     "clean values",
+			hostname: "printer",
+			instance: "Frontend",
+			want: sortedStrings(
+				"printer.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR printer.local.",
+				"_http._tcp.local. PTR Frontend._http._tcp.local.",
+				"Frontend._http._tcp.local. SRV 0 0 80 printer.local.",
+				`Frontend._http._tcp.local. TXT ""`,
+			),
+		},
+		{
+			name:     "surrounding spaces",
+			hostname: " printer\n",
+			instance: "  Frontend ",
+			want: sortedStrings(
+				"printer.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR printer.local.",
+				"_http._tcp.local. PTR Frontend._http._tcp.local.",
+				"Frontend._http._tcp.local. SRV 0 0 80 printer.local.",
+				`Frontend._http._tcp.local. TXT ""`,
+			),
+			logged: true,
+		},
+		{
+			name:     "mixed case kept",
+			hostname: "Printer",
+			instance: "Frontend",
+			want: sortedStrings(
+				"Printer.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR Printer.local.",
+				"_http._tcp.local. PTR Frontend._http._tcp.local.",
+				"Frontend._http._tcp.local. SRV 0 0 80 Printer.local.",
+				`Frontend._http._tcp.local. TXT ""`,
+			),
+		},
+		{
+			// Instance names are meant for display and keep their case
+			name:      "mixed case lowercased",
+			hostname:  " Printer",
+			instance:  "Frontend",
+			lowercase: true,
+			want: sortedStrings(
+				"printer.local. A 10.0.0.10",
+				"10.0.0.10.in-addr.arpa. PTR printer.local.",
+				"_http._tcp.local. PTR Frontend._http._tcp.local.",
+				"Frontend._http._tcp.local. SRV 0 0 80 printer.local.",
+				`Frontend._http._tcp.local. TXT ""`,
+			),
+			logged: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			log.SetOutput(&buf)
+			defer log.SetOutput(os.Stderr)
+
+			service := testService()
+			service.Annotations = map[string]string{hostnameAnnotation: tt.hostname, serviceInstanceAnnotation: tt.instance}
+			got := recordStrings(BuildServiceRecords(service, Config{LowercaseHostnames: tt.lowercase}))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("BuildServiceRecords() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if logged := strings.Contains(buf.String(), "Normalized annotation"); logged != tt.logged {
+				t.Errorf("normalization logged = %v, want %v:\n%s", logged, tt.logged, buf.String())
+			}
+		})
+	}
+}
+
+func TestServiceEnumeration(t *testing.T) {
+	service := testService()
+	service.Spec.Ports = append(service.Spec.Ports, corev1.ServicePort{Name: "dns", Port: 53, Protocol: corev1.ProtocolUDP})
+	records := BuildServiceRecords(service, Config{ServiceEnumeration: true})
+
+	// Follow the chain from the enumeration domain down to the address of
+	// every instance
+	byName := map[string][]dns.RR{}
+	for _, rr := range records {
+		byName[rr.Header().Name] = append(byName[rr.Header().Name], rr)
+	}
+	var types []string
+	for _, rr := range byName["_services._dns-sd._udp.local."] {
+		serviceType := rr.(*dns.PTR).Ptr
+		types = append(types, serviceType)
+		instances := byName[serviceType]
+		if len(instances) != 1 {
+			t.Fatalf("%s has %d instances, want 1", serviceType, len(instances))
+		}
+		instance := instances[0].(*dns.PTR).Ptr
+		var target string
+		hasTXT := false
+		for _, rr := range byName[instance] {
+			switch rr := rr.(type) {
+			case *dns.SRV:
+				target = rr.Target
+			case *dns.TXT:
+				hasTXT = true
+			}
+		}
+		if target == "" || !hasTXT {
+			t.Errorf("instance %s has no SRV or TXT record", instance)
+		}
+		if len(byName[target]) == 0 {
+			t.Errorf("target %s of instance %s has no address record", target, instance)
+		}
+	}
+	sort.Strings(types)
+	if want := []string{"_dns._udp.local.", "_http._tcp.local."}; !reflect.DeepEqual(types, want) {
+		t.Errorf("enumerated service types %v, want %v", types, want)
+	}
+
+	for _, rr := range BuildServiceRecords(service, Config{}) {
+		if rr.Header().Name == "_services._dns-sd._udp.local." {
+			t.Errorf("published %s without ServiceEnumeration", rr)
+		}
+	}
+}
+
+func TestClusterName(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostname string
+		cfg      Config
+		want     string
+	}{
+		{name: "no cluster name", want: "web.default.local."},
+		{name: "cluster name", cfg: Config{ClusterName: "cluster1"}, want: "web.default.cluster1.local."},
+		{name: "hostname annotation", hostname: "www", cfg: Config{ClusterName: "cluster1"}, want: "www.local."},
+		{name: "namespace domain", cfg: Config{ClusterName: "cluster1", NamespaceDomains: map[string]string{"default": "example.local."}}, want: "web.example.local."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := testService()
+			if tt.hostname != "" {
+				service.Annotations[hostnameAnnotation] = tt.hostname
+			}
+			got := recordStrings(BuildServiceRecords(service, tt.cfg))
+			want := tt.want + " A 10.0.0.10"
+			for _, rr := range got {
+				if rr == want {
+					return
+				}
+			}
+			t.Errorf("BuildServiceRecords() = %v, want %s", got, want)
+		})
+	}
+}
+
+func TestServiceTypes(t *testing.T) {
+	tests := []struct {
+		serviceType  corev1.ServiceType
+		serviceTypes []string
+		want         bool
+	}{
+		{serviceType: corev1.ServiceTypeClusterIP, want: true},
+		{serviceType: corev1.ServiceTypeLoadBalancer, want: true},
+		{serviceType: corev1.ServiceTypeClusterIP, serviceTypes: []string{"LoadBalancer"}, want: false},
+		{serviceType: corev1.ServiceTypeLoadBalancer, serviceTypes: []string{"LoadBalancer"}, want: true},
+		{serviceType: corev1.ServiceTypeLoadBalancer, serviceTypes: []string{"ClusterIP"}, want: false},
+		{serviceType: corev1.ServiceTypeClusterIP, serviceTypes: []string{"LoadBalancer", "ClusterIP"}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.serviceType)+" "+strings.Join(tt.serviceTypes, ","), func(t *testing.T) {
+			service := testService()
+			service.Spec.Type = tt.serviceType
+			if tt.serviceType == corev1.ServiceTypeLoadBalancer {
+				service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "192.168.1.10"}}
+			}
+			records := BuildServiceRecords(service, Config{ServiceTypes: tt.serviceTypes})
+			if got := len(records) > 0; got != tt.want {
+				t.Errorf("published %v, want published %v", recordStrings(records), tt.want)
+			}
+		})
+	}
+}
+
+func TestPTRTargetPerFamily(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        []string
+	}{
+		{
+			name: "default",
+			want: sortedStrings(
+				"10.1.168.192.in-addr.arpa. PTR web.default.local.",
+				"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name:        "IPv4 only",
+			annotations: map[string]string{ptrTargetIPv4Annotation: "web-v4"},
+			want: sortedStrings(
+				"10.1.168.192.in-addr.arpa. PTR web-v4.local.",
+				"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name:        "both families",
+			annotations: map[string]string{ptrTargetIPv4Annotation: "web-v4", ptrTargetIPv6Annotation: "web-v6"},
+			want: sortedStrings(
+				"10.1.168.192.in-addr.arpa. PTR web-v4.local.",
+				"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa. PTR web-v6.local.",
+			),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := testService()
+			service.Spec.Type = corev1.ServiceTypeLoadBalancer
+			service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "192.168.1.10"}, {IP: "2001:db8::10"}}
+			for annotation, value := range tt.annotations {
+				service.Annotations[annotation] = value
+			}
+
+			got := []string{}
+			for _, rr := range BuildServiceRecords(service, Config{}) {
+				if isReverseName(rr.Header().Name) {
+					got = append(got, recordStrings([]dns.RR{rr})...)
+				}
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("reverse records = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReachabilityCheck(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("192.168.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		address string
+		check   string
+		want    bool
+		wantLog string
+	}{
+		{name: "local off", address: "192.168.1.10", check: ReachabilityOff, want: true},
+		{name: "local warn", address: "192.168.1.10", check: ReachabilityWarn, want: true},
+		{name: "local skip", address: "192.168.1.10", check: ReachabilitySkip, want: true},
+		{name: "remote off", address: "203.0.113.10", check: ReachabilityOff, want: true},
+		{name: "remote warn", address: "203.0.113.10", check: ReachabilityWarn, want: true, wantLog: "Address 203.0.113.10 of service default/web is not in any local subnet"},
+		{name: "remote skip", address: "203.0.113.10", check: ReachabilitySkip, want: false, wantLog: "Not publishing address 203.0.113.10 of service default/web: not in any local subnet"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			log.SetOutput(&buf)
+			defer log.SetOutput(os.Stderr)
+
+			service := testService()
+			service.Spec.Type = corev1.ServiceTypeLoadBalancer
+			service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: tt.address}}
+			cfg := Config{ReachabilityCheck: tt.check, LocalSubnets: []*net.IPNet{subnet}}
+
+			got := false
+			for _, rr := range recordStrings(BuildServiceRecords(service, cfg)) {
+				if rr == "web.default.local. A "+tt.address {
+					got = true
+				}
+			}
+			if got != tt.want {
+				t.Errorf("published address %v, want %v", got, tt.want)
+			}
+			if logged := buf.String(); tt.wantLog == "" && logged != "" || !strings.Contains(logged, tt.wantLog) {
+				t.Errorf("logged %q, want %q", logged, tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestAddressSource(t *testing.T) {
+	tests := []struct {
+		name          string
+		serviceType   corev1.ServiceType
+		addressSource string
+		want          []string
+	}{
+		{name: "ClusterIP default", serviceType: corev1.ServiceTypeClusterIP, want: []string{"web.default.local. A 10.0.0.10"}},
+		{name: "LoadBalancer default", serviceType: corev1.ServiceTypeLoadBalancer, want: []string{"web.default.local. A 192.168.1.10"}},
+		{name: "clusterip", serviceType: corev1.ServiceTypeLoadBalancer, addressSource: "clusterip", want: []string{"web.default.local. A 10.0.0.10"}},
+		{name: "loadbalancer", serviceType: corev1.ServiceTypeLoadBalancer, addressSource: "loadbalancer", want: []string{"web.default.local. A 192.168.1.10"}},
+		{name: "both", serviceType: corev1.ServiceTypeLoadBalancer, addressSource: "both", want: []string{"web.default.local. A 10.0.0.10", "web.default.local. A 192.168.1.10"}},
+		{name: "case and space", serviceType: corev1.ServiceTypeLoadBalancer, addressSource: " ClusterIP ", want: []string{"web.default.local. A 10.0.0.10"}},
+		{name: "invalid", serviceType: corev1.ServiceTypeLoadBalancer, addressSource: "nodeport", want: []string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := testService()
+			service.Spec.Type = tt.serviceType
+			if tt.serviceType == corev1.ServiceTypeLoadBalancer {
+				service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "192.168.1.10"}}
+			}
+			if tt.addressSource != "" {
+				service.Annotations[addressSourceAnnotation] = tt.addressSource
+			}
+
+			got := []string{}
+			for _, rr := range recordStrings(BuildServiceRecords(service, Config{})) {
+				if strings.HasPrefix(rr, "web.default.local. A ") {
+					got = append(got, rr)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("address records = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestZoneAddresses(t *testing.T) {
+	const zones = `{"192.168.1.10": "zone-a", "192.168.2.10": "zone-b", "192.168.2.11": "zone-b"}`
+
+	tests := []struct {
+		name  string
+		zones string
+		zone  string
+		want  []string
+	}{
+		{name: "no zone", zones: zones, want: []string{"192.168.1.10", "192.168.2.10", "192.168.2.11", "192.168.3.10"}},
+		{name: "own zone", zones: zones, zone: "zone-a", want: []string{"192.168.1.10"}},
+		{name: "several in own zone", zones: zones, zone: "zone-b", want: []string{"192.168.2.10", "192.168.2.11"}},
+		{name: "no address in own zone", zones: zones, zone: "zone-c", want: []string{"192.168.1.10", "192.168.2.10", "192.168.2.11", "192.168.3.10"}},
+		{name: "no annotation", zone: "zone-a", want: []string{"192.168.1.10", "192.168.2.10", "192.168.2.11", "192.168.3.10"}},
+		{name: "invalid annotation", zones: "zone-a", zone: "zone-a", want: []string{"192.168.1.10", "192.168.2.10", "192.168.2.11", "192.168.3.10"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := testService()
+			service.Spec.Type = corev1.ServiceTypeLoadBalancer
+			for _, ip := range []string{"192.168.1.10", "192.168.2.10", "192.168.2.11", "192.168.3.10"} {
+				service.Status.LoadBalancer.Ingress = append(service.Status.LoadBalancer.Ingress, corev1.LoadBalancerIngress{IP: ip})
+			}
+			if tt.zones != "" {
+				service.Annotations[addressZonesAnnotation] = tt.zones
+			}
+
+			got := []string{}
+			for _, ip := range loadBalancerAddresses(service, Config{Zone: tt.zone}) {
+				got = append(got, ip.String())
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadBalancerAddresses() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostnameAliases(t *testing.T) {
+	tests := []struct {
+		name    string
+		aliases map[string]string
+		want    string
+	}{
+		{name: "no aliases", want: "printer.local."},
+		{
+			name:    "chain",
+			aliases: map[string]string{"printer.local.": "office.local.", "office.local.": "nas.local."},
+			want:    "nas.local.",
+		},
+		{
+			name:    "loop",
+			aliases: map[string]string{"printer.local.": "office.local.", "office.local.": "printer.local."},
+			want:    "printer.local.",
+		},
+	}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := testService()
+			service.Annotations[hostnameAnnotation] = "printer"
+
+			var addresses []string
+			for _, rr := range BuildServiceRecords(service, Config{HostnameAliases: tt.aliases}) {
+				if a, ok := rr.(*dns.A); ok {
+					addresses = append(addresses, a.Hdr.Name)
+				}
+			}
+			if want := []string{tt.want}; !reflect.DeepEqual(addresses, want) {
+				t.Errorf("address records of %v, want %v", addresses, want)
+			}
+		})
+	}
+	if !strings.Contains(buf.String(), "alias loop") {
+		t.Errorf("alias loop not logged:\n%s", buf.String())
+	}
+}
+
+func TestSRVTargetAnnotation(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		want   string
+	}{
+		{name: "external name", target: "proxy.example.com.", want: "proxy.example.com."},
+		{name: "not fully qualified", target: "proxy.example.com", want: "proxy.example.com."},
+		{name: "local name", target: "proxy.local.", want: "proxy.local."},
+		{name: "spaces", target: " proxy.example.com ", want: "proxy.example.com."},
+		{name: "invalid", target: "proxy..example.com", want: "web.default.local."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := testService()
+			service.Annotations[srvTargetAnnotation] = tt.target
+
+			var srv []string
+			var addresses []string
+			for _, rr := range BuildServiceRecords(service, Config{}) {
+				switch rr := rr.(type) {
+				case *dns.SRV:
+					srv = append(srv, rr.Target)
+				case *dns.A:
+					addresses = append(addresses, rr.Hdr.Name)
+				}
+			}
+			if want := []string{tt.want}; !reflect.DeepEqual(srv, want) {
+				t.Errorf("SRV targets = %v, want %v", srv, want)
+			}
+			// The address record stays with the hostname of the service
+			if want := []string{"web.default.local."}; !reflect.DeepEqual(addresses, want) {
+				t.Errorf("address records of %v, want %v", addresses, want)
+			}
+		})
+	}
+}
+
+func TestSkipLocalIPv6Reverse(t *testing.T) {
+	tests := []struct {
+		address     string
+		skip        bool
+		wantReverse bool
+	}{
+		{address: "fd00::10", skip: false, wantReverse: true},
+		{address: "fd00::10", skip: true, wantReverse: false},
+		{address: "fe80::10", skip: true, wantReverse: false},
+		{address: "2001:db8::10", skip: true, wantReverse: true},
+		{address: "192.168.1.10", skip: true, wantReverse: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s %v", tt.address, tt.skip), func(t *testing.T) {
+			service := testService()
+			service.Spec.Type = corev1.ServiceTypeLoadBalancer
+			service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: tt.address}}
+
+			forward, reverse := false, false
+			for _, rr := range BuildServiceRecords(service, Config{SkipLocalIPv6Reverse: tt.skip}) {
+				switch {
+				case isReverseName(rr.Header().Name):
+					reverse = true
+				case rr.Header().Rrtype == dns.TypeA || rr.Header().Rrtype == dns.TypeAAAA:
+					forward = true
+				}
+			}
+			if !forward {
+				t.Error("no address record published")
+			}
+			if reverse != tt.wantReverse {
+				t.Errorf("published reverse PTR record %v, want %v", reverse, tt.wantReverse)
+			}
+		})
+	}
+}
+
+func TestURLAnnotation(t *testing.T) {
+	tests := []struct {
+		name  string
+		url   string
+		other string // service-txt annotation
+		want  string
+	}{
+		{name: "path", url: "/admin", want: `"path=/admin"`},
+		{name: "absolute URL", url: "https://web.example.com/ui", want: `"url=https://web.example.com/ui"`},
+		{name: "spaces", url: " /admin ", want: `"path=/admin"`},
+		{name: "with service TXT", url: "/admin", other: `{"http": {"version": "2"}}`, want: `"version=2" "path=/admin"`},
+		{name: "relative URL", url: "admin", want: `""`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := testService()
+			service.Annotations[urlAnnotation] = tt.url
+			if tt.other != "" {
+				service.Annotations[serviceTxtAnnotation] = tt.other
+			}
+
+			var got []string
+			for _, rr := range recordStrings(BuildServiceRecords(service, Config{})) {
+				if strings.Contains(rr, " TXT ") {
+					got = append(got, rr)
+				}
+			}
+			if want := []string{"default/web._http._tcp.local. TXT " + tt.want}; !reflect.DeepEqual(got, want) {
+				t.Errorf("TXT records = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestTargetPortTXT(t *testing.T) {
+	tests := []struct {
+		name       string
+		targetPort intstr.IntOrString
+		enabled    bool
+		want       string
+	}{
+		{name: "disabled", targetPort: intstr.FromInt(8080), want: `""`},
+		{name: "number", targetPort: intstr.FromInt(8080), enabled: true, want: `"targetPort=8080"`},
+		{name: "name", targetPort: intstr.FromString("web"), enabled: true, want: `"targetPort=web"`},
+		{name: "same as port", enabled: true, want: `"targetPort=80"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := testService()
+			service.Spec.Ports[0].TargetPort = tt.targetPort
+
+			var got []string
+			for _, rr := range recordStrings(BuildServiceRecords(service, Config{TargetPortTXT: tt.enabled})) {
+				if strings.Contains(rr, " TXT ") {
+					got = append(got, rr)
+				}
+			}
+			if want := []string{"default/web._http._tcp.local. TXT " + tt.want}; !reflect.DeepEqual(got, want) {
+				t.Errorf("TXT records = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestInstanceSeparator(t *testing.T) {
+	tests := []struct {
+		separator string
+		want      string
+	}{
+		{separator: "", want: "default/web"},
+		{separator: "/", want: "default/web"},
+		{separator: "-", want: "default-web"},
+		{separator: " @ ", want: "default @ web"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.separator, func(t *testing.T) {
+			var instances []string
+			for _, rr := range BuildServiceRecords(testService(), Config{InstanceSeparator: tt.separator}) {
+				if srv, ok := rr.(*dns.SRV); ok {
+					if _, ok := dns.IsDomainName(srv.Hdr.Name); !ok {
+						t.Errorf("%q is not a valid domain name", srv.Hdr.Name)
+					}
+					// The instance name is a single label
+					labels := dns.SplitDomainName(srv.Hdr.Name)
+					if len(labels) != 4 {
+						t.Errorf("%q has %d labels, want 4", srv.Hdr.Name, len(labels))
+					}
+					instances = append(instances, labels[0])
+				}
+			}
+			if want := []string{tt.want}; !reflect.DeepEqual(instances, want) {
+				t.Errorf("instances = %q, want %q", instances, want)
+			}
+		})
+	}
+}
+
+func TestServiceAnnotatedAfterCreation(t *testing.T) {
+	unannotated := testService()
+	unannotated.Annotations = nil
+	client := fake.NewSimpleClientset(unannotated)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	notify := make(chan resource.Resource, 10)
+	s := NewServicesWatcher(factory, Config{ReverseConflict: ReverseConflictAll}, notify)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	s.Run(stop)
+	expectNone(t, notify)
+
+	steps := []struct {
+		name    string
+		service *corev1.Service
+		action  string
+	}{
+		{name: "annotated", service: testService(), action: resource.Added},
+		{name: "annotation removed", service: unannotated, action: resource.Deleted},
+		{name: "annotated again", service: testService(), action: resource.Added},
+	}
+	for _, step := range steps {
+		if _, err := client.CoreV1().Services("default").Update(context.TODO(), step.service, metav1.UpdateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		res := receive(t, notify)
+		if want := webRecords("web.default.local. A 10.0.0.10", "10.0.0.10.in-addr.arpa. PTR web.default.local."); res.Action != step.action || !reflect.DeepEqual(recordStrings(res.Records), want) {
+			t.Errorf("%s: got %s of %v, want %s of %v", step.name, res.Action, recordStrings(res.Records), step.action, want)
+		}
+		// Each transition is notified once
+		time.Sleep(100 * time.Millisecond)
+		expectNone(t, notify)
+	}
+}
+
+func TestResolvedHostnameRefresh(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(service *corev1.Service)
+		cfg    Config
+	}{
+		{
+			name: "external name",
+			modify: func(service *corev1.Service) {
+				service.Spec.Type = corev1.ServiceTypeExternalName
+				service.Spec.ClusterIP = ""
+				service.Spec.ClusterIPs = nil
+				service.Spec.ExternalName = "nas.example.com"
+			},
+			cfg: Config{ResolveExternalNames: true},
+		},
+		{
+			name: "load balancer hostname",
+			modify: func(service *corev1.Service) {
+				service.Spec.Type = corev1.ServiceTypeLoadBalancer
+				service.Spec.ClusterIP = ""
+				service.Spec.ClusterIPs = nil
+				service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{Hostname: "lb.example.com"}}
+			},
+			cfg: Config{LoadBalancerHostnameMode: LoadBalancerHostnameResolve},
+		},
+	}
+
+	var mutex sync.Mutex
+	address := net.ParseIP("192.0.2.10")
+	oldLookupIP := lookupIP
+	lookupIP = func(host string) ([]net.IP, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return []net.IP{address}, nil
+	}
+	defer func() { lookupIP = oldLookupIP }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mutex.Lock()
+			address = net.ParseIP("192.0.2.10")
+			mutex.Unlock()
+			service := testService()
+			tt.modify(service)
+			cfg := tt.cfg
+			cfg.ReverseConflict = ReverseConflictAll
+			cfg.LoadBalancerHostnameRefresh = 20 * time.Millisecond
+			client := fake.NewSimpleClientset(service)
+			factory := informers.NewSharedInformerFactory(client, 0)
+			notify := make(chan resource.Resource, 10)
+			s := NewServicesWatcher(factory, cfg, notify)
+
+			stop := make(chan struct{})
+			defer close(stop)
+			factory.Start(stop)
+			s.Run(stop)
+			if res := receive(t, notify); res.Action != resource.Added {
+				t.Fatalf("got %s, want the records of the service added", res.Action)
+			}
+
+			// The new address is published although the service did not change
+			mutex.Lock()
+			address = net.ParseIP("192.0.2.11")
+			mutex.Unlock()
+			want := map[string][]string{
+				resource.Deleted: {"web.default.local. A 192.0.2.10"},
+				resource.Added:   {"web.default.local. A 192.0.2.11"},
+			}
+			for len(want) > 0 {
+				res := receive(t, notify)
+				var addresses []string
+				for _, rr := range res.Records {
+					if rr.Header().Rrtype == dns.TypeA {
+						addresses = append(addresses, recordStrings([]dns.RR{rr})...)
+					}
+				}
+				if !reflect.DeepEqual(addresses, want[res.Action]) {
+					t.Fatalf("got %s of %v, want %s of %v", res.Action, addresses, res.Action, want[res.Action])
+				}
+				delete(want, res.Action)
+			}
+		})
+	}
+}
+
+func TestRecordsPersistWatchFailure(t *testing.T) {
+	client := fake.NewSimpleClientset(testService())
+	watcher := watch.NewFake()
+	client.PrependWatchReactor("services", k8stesting.DefaultWatchReactor(watcher, nil))
+	factory := informers.NewSharedInformerFactory(client, 0)
+	notify := make(chan resource.Resource, 10)
+	s := NewServicesWatcher(factory, Config{ReverseConflict: ReverseConflictAll}, notify)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	s.Run(stop)
+	if res := receive(t, notify); res.Action != resource.Added {
+		t.Fatalf("got %s, want the records of the service added", res.Action)
+	}
+
+	// The API server goes away: the watch fails, and so do all further
+	// lists and watches
+	unavailable := apierrors.NewServiceUnavailable("connection lost")
+	client.PrependReactor("list", "services", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, unavailable
+	})
+	client.PrependWatchReactor("services", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		return true, nil, unavailable
+	})
+	watcher.Error(&unavailable.ErrStatus)
+	watcher.Stop()
+	time.Sleep(200 * time.Millisecond)
+	s.Reconcile()
+	expectNone(t, notify)
+}
+
+func TestReadyCondition(t *testing.T) {
+	service := testService()
+	service.Annotations[readyConditionAnnotation] = "Programmed"
+	client := fake.NewSimpleClientset(service)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	notify := make(chan resource.Resource, 10)
+	s := NewServicesWatcher(factory, Config{ReverseConflict: ReverseConflictAll}, notify)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	s.Run(stop)
+	expectNone(t, notify)
+
+	steps := []struct {
+		status metav1.ConditionStatus
+		action string
+	}{
+		{status: metav1.ConditionTrue, action: resource.Added},
+		{status: metav1.ConditionFalse, action: resource.Deleted},
+		{status: metav1.ConditionTrue, action: resource.Added},
+	}
+	for _, step := range steps {
+		service.Status.Conditions = []metav1.Condition{{Type: "Programmed", Status: step.status, Reason: "Test"}}
+		updated, err := client.CoreV1().Services(service.Namespace).UpdateStatus(context.TODO(), service, metav1.UpdateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		service = updated
+		if res := receive(t, notify); res.Action != step.action {
+			t.Errorf("got %s with condition %s, want %s", res.Action, step.status, step.action)
+		}
+	}
+}
+
+func TestLoadBalancerHostnameMode(t *testing.T) {
+	oldLookupIP := lookupIP
+	lookupIP = func(host string) ([]net.IP, error) {
+		if host != "lb.example.com" {
+			return nil, fmt.Errorf("no such host %s", host)
+		}
+		return []net.IP{net.ParseIP("192.0.2.10"), net.ParseIP("2001:db8::10")}, nil
+	}
+	defer func() { lookupIP = oldLookupIP }()
+
+	tests := []struct {
+		name     string
+		hostname string
+		cfg      Config
+		want     []string
+	}{
+		{
+			name:     "resolve failing",
+			hostname: "gone.example.com",
+			cfg:      Config{LoadBalancerHostnameMode: LoadBalancerHostnameResolve},
+			want:     []string{},
+		},
+		{
+			name: "skip",
+			cfg:  Config{LoadBalancerHostnameMode: LoadBalancerHostnameSkip},
+			want: []string{},
+		},
+		{
+			name: "cname",
+			cfg:  Config{LoadBalancerHostnameMode: LoadBalancerHostnameCNAME},
+			want: sortedStrings(
+				"web.default.local. CNAME lb.example.com.",
+				"_http._tcp.local. PTR default/web._http._tcp.local.",
+				"default/web._http._tcp.local. SRV 0 0 80 lb.example.com.",
+				`default/web._http._tcp.local. TXT ""`,
+			),
+		},
+		{
+			name: "resolve",
+			cfg:  Config{LoadBalancerHostnameMode: LoadBalancerHostnameResolve},
+			want: webRecords(
+				"web.default.local. A 192.0.2.10",
+				"web.default.local. AAAA 2001:db8::10",
+				"10.2.0.192.in-addr.arpa. PTR web.default.local.",
+				"0.1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa. PTR web.default.local.",
+			),
+		},
+		{
+			name: "resolve IPv4",
+			cfg:  Config{LoadBalancerHostnameMode: LoadBalancerHostnameResolve, LoadBalancerHostnameFamily: AddressFamilyIPv4},
+			want: webRecords(
+				"web.default.local. A 192.0.2.10",
+				"10.2.0.192.in-addr.arpa. PTR web.default.local.",
+			),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := testService()
+			service.Spec.Type = corev1.ServiceTypeLoadBalancer
+			service.Spec.ClusterIP = ""
+			service.Spec.ClusterIPs = nil
+			hostname := "lb.example.com"
+			if tt.hostname != "" {
+				hostname = tt.hostname
+			}
+			service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{Hostname: hostname}}
+			got := recordStrings(BuildServiceRecords(service, tt.cfg))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("BuildServiceRecords() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestOwnerID(t *testing.T) {
+	owned := func(name string, owner string) *corev1.Service {
+		service := testService()
+		service.Name = name
+		if owner != "" {
+			service.Annotations[ownerIDAnnotation] = owner
+		}
+		return service
+	}
+	client := fake.NewSimpleClientset(owned("alpha", "a"), owned("beta", "b"), owned("web", ""))
+	factory := informers.NewSharedInformerFactory(client, 0)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	notify := map[string]chan resource.Resource{}
+	for _, owner := range []string{"a", "b"} {
+		notify[owner] = make(chan resource.Resource, 10)
+		s := NewServicesWatcher(factory, Config{OwnerID: owner, ReverseConflict: ReverseConflictAll}, notify[owner])
+		factory.Start(stop)
+		s.Run(stop)
+	}
+
+	// Each instance publishes its own services only, tagged with its ID
+	for owner, name := range map[string]string{"a": "alpha", "b": "beta"} {
+		res := receive(t, notify[owner])
+		if res.Action != resource.Added || res.Name != name {
+			t.Errorf("owner %s: got %s of %s, want %s added", owner, res.Action, res.Name, name)
+		}
+		want := fmt.Sprintf(`default/%s._http._tcp.local. TXT "owner=%s"`, name, owner)
+		found := false
+		for _, rr := range recordStrings(res.Records) {
+			found = found || rr == want
+		}
+		if !found {
+			t.Errorf("owner %s: published %v, want %s", owner, recordStrings(res.Records), want)
+		}
+		expectNone(t, notify[owner])
+	}
+
+	// Handing a service over withdraws it from its old owner only
+	beta := owned("beta", "a")
+	if _, err := client.CoreV1().Services(beta.Namespace).Update(context.TODO(), beta, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if res := receive(t, notify["b"]); res.Action != resource.Deleted || res.Name != "beta" {
+		t.Errorf("owner b: got %s of %s, want beta deleted", res.Action, res.Name)
+	}
+	if res := receive(t, notify["a"]); res.Action != resource.Added || res.Name != "beta" {
+		t.Errorf("owner a: got %s of %s, want beta added", res.Action, res.Name)
+	}
+}
+
+func TestExternalIPsPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		lb     bool
+		want   []string
+	}{
+		{name: "cluster IP", policy: ExternalIPsPolicyClusterIP, want: []string{"web.default.local. A 10.0.0.10"}},
+		{name: "external IPs", policy: ExternalIPsPolicyExternalIPs, want: []string{"web.default.local. A 192.168.1.20"}},
+		{name: "both", policy: ExternalIPsPolicyBoth, want: []string{"web.default.local. A 10.0.0.10", "web.default.local. A 192.168.1.20"}},
+		{name: "default", want: []string{"web.default.local. A 10.0.0.10", "web.default.local. A 192.168.1.20"}},
+		// The policy only decides between the cluster IP and the external IPs
+		{name: "load balancer", policy: ExternalIPsPolicyClusterIP, lb: true, want: []string{"web.default.local. A 192.168.1.10", "web.default.local. A 192.168.1.20"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := testService()
+			service.Annotations[useExternalIPsAnnotation] = "true"
+			service.Spec.ExternalIPs = []string{"192.168.1.20"}
+			if tt.lb {
+				service.Spec.Type = corev1.ServiceTypeLoadBalancer
+				service.Status.LoadBalancer.Ingress = []corev1.LoadBalancerIngress{{IP: "192.168.1.10"}}
+			}
+
+			var got []string
+			for _, rr := range recordStrings(BuildServiceRecords(service, Config{ExternalIPsPolicy: tt.policy})) {
+				if strings.HasPrefix(rr, "web.default.local. A") {
+					got = append(got, rr)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("address records = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
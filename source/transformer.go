@@ -0,0 +1,67 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// RecordTransformer post-processes the records built for an object before
+// they are published, e.g. to add TXT records, rewrite names or filter
+// records. obj is the *corev1.Service, *corev1.Endpoints or *v1.Ingress the
+// records were built for, and sourceType the name of the source. The
+// returned records are published instead of records, which must not be
+// modified in place.
+type RecordTransformer interface {
+	Transform(sourceType string, obj interface{}, records []dns.RR) []dns.RR
+}
+
+// RecordTransformerFunc adapts a function to a RecordTransformer
+type RecordTransformerFunc func(sourceType string, obj interface{}, records []dns.RR) []dns.RR
+
+// Transform calls f
+func (f RecordTransformerFunc) Transform(sourceType string, obj interface{}, records []dns.RR) []dns.RR {
+	return f(sourceType, obj, records)
+}
+
+var (
+	transformers      []RecordTransformer
+	transformersMutex sync.RWMutex
+)
+
+// RegisterTransformer adds a transformer applied to the records of every
+// object, after the ones registered before. Custom builds register their
+// transformers from the init function of a file added to the main package:
+//
+//	func init() {
+//		source.RegisterTransformer(source.RecordTransformerFunc(addOwnerTXT))
+//	}
+func RegisterTransformer(t RecordTransformer) {
+	transformersMutex.Lock()
+	defer transformersMutex.Unlock()
+	transformers = append(transformers, t)
+}
+
+// transform applies all registered transformers to records
+func transform(sourceType string, obj interface{}, records []dns.RR) []dns.RR {
+	transformersMutex.RLock()
+	defer transformersMutex.RUnlock()
+	for _, t := range transformers {
+		records = t.Transform(sourceType, obj, records)
+	}
+	return records
+}
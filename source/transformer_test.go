@@ -0,0 +1,109 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/blake/external-mdns/resource"
+	"github.com/miekg/dns"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// withTransformers replaces the registered transformers for the test
+func withTransformers(t *testing.T) {
+	transformersMutex.Lock()
+	old := transformers
+	transformers = nil
+	transformersMutex.Unlock()
+	t.Cleanup(func() {
+		transformersMutex.Lock()
+		transformers = old
+		transformersMutex.Unlock()
+	})
+}
+
+func TestTransform(t *testing.T) {
+	withTransformers(t)
+	var objects []interface{}
+	// Drop the reverse records, then add an owner TXT record to the rest
+	RegisterTransformer(RecordTransformerFunc(func(sourceType string, obj interface{}, records []dns.RR) []dns.RR {
+		objects = append(objects, obj)
+		var forward []dns.RR
+		for _, rr := range records {
+			if !strings.HasSuffix(rr.Header().Name, ".arpa.") {
+				forward = append(forward, rr)
+			}
+		}
+		return forward
+	}))
+	RegisterTransformer(RecordTransformerFunc(func(sourceType string, obj interface{}, records []dns.RR) []dns.RR {
+		service := obj.(*corev1.Service)
+		return append(records, &dns.TXT{
+			Hdr: dns.RR_Header{Name: "owner." + service.Name + ".local.", Rrtype: dns.TypeTXT},
+			Txt: []string{"source=" + sourceType},
+		})
+	}))
+
+	service := testService()
+	got := recordStrings(transform("service", service, parseRecords(t,
+		"web.default.local. A 10.0.0.10",
+		"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+	)))
+	want := []string{"owner.web.local. TXT \"source=service\"", "web.default.local. A 10.0.0.10"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("transform() = %v, want %v", got, want)
+	}
+	if len(objects) != 1 || objects[0] != service {
+		t.Errorf("transformer got objects %v, want the service", objects)
+	}
+}
+
+func TestTransformPublished(t *testing.T) {
+	withTransformers(t)
+	RegisterTransformer(RecordTransformerFunc(func(sourceType string, obj interface{}, records []dns.RR) []dns.RR {
+		var renamed []dns.RR
+		for _, rr := range records {
+			rr = dns.Copy(rr)
+			rr.Header().Name = strings.Replace(rr.Header().Name, ".default.local.", ".lab.local.", 1)
+			renamed = append(renamed, rr)
+		}
+		return renamed
+	}))
+
+	client := fake.NewSimpleClientset(testService())
+	factory := informers.NewSharedInformerFactory(client, 0)
+	notify := make(chan resource.Resource, 10)
+	s := NewServicesWatcher(factory, Config{ReverseConflict: ReverseConflictAll}, notify)
+
+	stop := make(chan struct{})
+	defer close(stop)
+	factory.Start(stop)
+	s.Run(stop)
+
+	res := receive(t, notify)
+	got := recordStrings(res.Records)
+	want := webRecords(
+		"web.lab.local. A 10.0.0.10",
+		"10.0.0.10.in-addr.arpa. PTR web.default.local.",
+	)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("published\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
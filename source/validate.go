@@ -0,0 +1,132 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package source
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	v1 "k8s.io/api/networking/v1"
+)
+
+// ValidateService returns an error for every External-mDNS annotation of the
+// service that is invalid. Services which are not published are not checked.
+func ValidateService(service *corev1.Service, cfg Config) []error {
+	var errs []error
+	if !isPublishable(service, cfg) {
+		return errs
+	}
+
+	annotationError := func(annotation string, err error) {
+		errs = append(errs, fmt.Errorf("annotation %s: %v", annotation, err))
+	}
+
+	if _, err := parseDomainName(serviceHostname(service, cfg)); err != nil {
+		annotationError(hostnameAnnotation, err)
+	}
+	for _, annotation := range []string{ptrTargetIPv4Annotation, ptrTargetIPv6Annotation, srvTargetAnnotation} {
+		if value, ok := service.Annotations[annotation]; ok {
+			if _, err := parseDomainName(value); err != nil {
+				annotationError(annotation, err)
+			}
+		}
+	}
+
+	svctxt, err := serviceTXT(service)
+	if err != nil {
+		annotationError(serviceTxtAnnotation, err)
+	}
+	var txtports []string
+	for port := range svctxt {
+		txtports = append(txtports, port)
+	}
+	if unknown := unknownPorts(service, txtports); len(unknown) > 0 {
+		annotationError(serviceTxtAnnotation, fmt.Errorf("unknown ports %v", unknown))
+	}
+
+	for _, annotation := range []string{srvPortAnnotation, primaryPortAnnotation} {
+		if value, ok := service.Annotations[annotation]; ok {
+			if _, err := resolvePort(service, value); err != nil {
+				annotationError(annotation, err)
+			}
+		}
+	}
+	if _, err := selectedPorts(service); err != nil {
+		annotationError(portsAnnotation, err)
+	}
+	if value, ok := service.Annotations[urlAnnotation]; ok {
+		if _, err := urlTXT(value); err != nil {
+			annotationError(urlAnnotation, err)
+		}
+	}
+
+	for _, annotation := range []string{wildcardAnnotation, useExternalIPsAnnotation} {
+		if value, ok := service.Annotations[annotation]; ok {
+			if _, err := strconv.ParseBool(strings.TrimSpace(value)); err != nil {
+				annotationError(annotation, err)
+			}
+		}
+	}
+	if value, ok := service.Annotations[minReadyAnnotation]; ok {
+		if _, err := strconv.Atoi(strings.TrimSpace(value)); err != nil {
+			annotationError(minReadyAnnotation, err)
+		}
+	}
+	if value, ok := service.Annotations[addressSourceAnnotation]; ok {
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case addressSourceClusterIP, addressSourceLoadBalancer, addressSourceBoth:
+		default:
+			annotationError(addressSourceAnnotation, fmt.Errorf("unknown address source %q", value))
+		}
+	}
+	if _, ok := service.Annotations[endpointWeightsAnnotation]; ok {
+		if _, err := endpointWeights(service); err != nil {
+			annotationError(endpointWeightsAnnotation, err)
+		}
+	}
+	if value, ok := service.Annotations[addressZonesAnnotation]; ok {
+		var zones map[string]string
+		if err := json.Unmarshal([]byte(value), &zones); err != nil {
+			annotationError(addressZonesAnnotation, err)
+		}
+	}
+
+	return errs
+}
+
+// ValidateIngress returns an error for every .local host of the ingress that
+// is not a valid domain name.
+func ValidateIngress(ingress *v1.Ingress) []error {
+	var errs []error
+	var hosts []string
+	for _, rule := range ingress.Spec.Rules {
+		hosts = append(hosts, rule.Host)
+	}
+	for _, tls := range ingress.Spec.TLS {
+		hosts = append(hosts, tls.Hosts...)
+	}
+	for _, host := range hosts {
+		if !isLocalName(host) {
+			continue
+		}
+		if _, err := parseDomainName(host); err != nil {
+			errs = append(errs, fmt.Errorf("host: %v", err))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,64 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/blake/external-mdns/source"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// validateObjects checks the annotations of all objects of the selected
+// sources, printing every error found. It returns the number of invalid
+// objects.
+func validateObjects(k8sClient kubernetes.Interface, cfg source.Config) (int, error) {
+	invalid := 0
+	report := func(kind string, namespace string, name string, errs []error) {
+		if len(errs) == 0 {
+			return
+		}
+		invalid++
+		for _, err := range errs {
+			fmt.Printf("%s %s/%s: %v\n", kind, namespace, name, err)
+		}
+	}
+
+	if sourceFlag.contains("service") || sourceFlag.contains("endpoints") {
+		services, err := k8sClient.CoreV1().Services(cfg.Namespace).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return invalid, err
+		}
+		for n := range services.Items {
+			service := &services.Items[n]
+			report("service", service.Namespace, service.Name, source.ValidateService(service, cfg))
+		}
+	}
+
+	if sourceFlag.contains("ingress") {
+		ingresses, err := k8sClient.NetworkingV1().Ingresses(cfg.Namespace).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return invalid, err
+		}
+		for n := range ingresses.Items {
+			ingress := &ingresses.Items[n]
+			report("ingress", ingress.Namespace, ingress.Name, source.ValidateIngress(ingress))
+		}
+	}
+
+	return invalid, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2023 Stefan Siegel
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/blake/external-mdns/source"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// annotatedService returns a published service with annotations
+func annotatedService(name string, annotations map[string]string) *corev1.Service {
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Annotations: map[string]string{"external-mdns.blake.github.io/publish": "true"},
+		},
+		Spec: corev1.ServiceSpec{
+			Type:      corev1.ServiceTypeClusterIP,
+			ClusterIP: "10.0.0.10",
+			Ports:     []corev1.ServicePort{{Name: "http", Port: 80, Protocol: corev1.ProtocolTCP}},
+		},
+	}
+	for annotation, value := range annotations {
+		service.Annotations[annotation] = value
+	}
+	return service
+}
+
+// hostIngress returns an ingress for host
+func hostIngress(name string, host string) *networkingv1.Ingress {
+	return &networkingv1.Ingress{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+		Spec:       networkingv1.IngressSpec{Rules: []networkingv1.IngressRule{{Host: host}}},
+	}
+}
+
+// captureStdout returns what f prints to standard output
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	f()
+	os.Stdout = stdout
+	w.Close()
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
+
+func TestValidateObjects(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		annotatedService("valid", map[string]string{"external-mdns.blake.github.io/service-txt": `{"http": {"path": "/"}}`}),
+		annotatedService("bad-txt", map[string]string{"external-mdns.blake.github.io/service-txt": `{"http":`}),
+		annotatedService("bad-wildcard", map[string]string{"external-mdns.blake.github.io/wildcard": "maybe"}),
+		hostIngress("valid", "web.local"),
+		hostIngress("bad-host", "web..local"),
+	)
+	// Unpublished services are not checked
+	unpublished := annotatedService("unpublished", map[string]string{"external-mdns.blake.github.io/wildcard": "maybe"})
+	delete(unpublished.Annotations, "external-mdns.blake.github.io/publish")
+	if err := client.Tracker().Add(unpublished); err != nil {
+		t.Fatal(err)
+	}
+
+	oldSources := sourceFlag
+	t.Cleanup(func() { sourceFlag = oldSources })
+
+	tests := []struct {
+		sources     k8sSource
+		wantInvalid int
+		wantObjects []string
+	}{
+		{sources: k8sSource{"service"}, wantInvalid: 2, wantObjects: []string{"service default/bad-txt", "service default/bad-wildcard"}},
+		{sources: k8sSource{"ingress"}, wantInvalid: 1, wantObjects: []string{"ingress default/bad-host"}},
+		{sources: k8sSource{"service", "ingress"}, wantInvalid: 3, wantObjects: []string{"service default/bad-txt", "service default/bad-wildcard", "ingress default/bad-host"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.sources, ","), func(t *testing.T) {
+			sourceFlag = tt.sources
+			var invalid int
+			var err error
+			out := captureStdout(t, func() {
+				invalid, err = validateObjects(client, source.Config{})
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// main exits non-zero if there are invalid objects
+			if invalid != tt.wantInvalid {
+				t.Errorf("validateObjects() = %d, want %d:\n%s", invalid, tt.wantInvalid, out)
+			}
+			for _, object := range tt.wantObjects {
+				if !strings.Contains(out, object+":") {
+					t.Errorf("report does not mention %s:\n%s", object, out)
+				}
+			}
+			if strings.Contains(out, "/valid") || strings.Contains(out, "unpublished") {
+				t.Errorf("report mentions a valid object:\n%s", out)
+			}
+		})
+	}
+}